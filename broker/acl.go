@@ -0,0 +1,286 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// Access is the kind of access to a topic an Authorizer decides on.
+type Access int
+
+const (
+	// AccessRead is needed to subscribe to a topic filter
+	AccessRead Access = 1 << iota
+	// AccessWrite is needed to publish to a topic, including will messages
+	AccessWrite
+)
+
+// Authorizer decides which topics a client may access. Authorize is called
+// concurrently for every PUBLISH, every topic filter of a SUBSCRIBE and the
+// will topic of a CONNECT.
+type Authorizer interface {
+	// Authorize reports whether the client may publish to the topic name
+	// (AccessWrite) or subscribe to the topic filter (AccessRead). For
+	// shared subscriptions the filter without "$share/<group>/" is passed.
+	Authorize(info ClientInfo, topic string, access Access) bool
+}
+
+// aclRule grants or denies access to the topics matching a topic filter.
+type aclRule struct {
+	filter string
+	access Access
+	deny   bool
+}
+
+type aclAuthorizer struct {
+	// anonymous rules apply to clients without user name, patterns to all
+	// clients after substituting %c and %u
+	anonymous []aclRule
+	users     map[string][]aclRule
+	patterns  []aclRule
+}
+
+// LoadACLFile reads an ACL file, see NewACLAuthorizer.
+func LoadACLFile(path string) (Authorizer, error) {
+	f, err := os.Open(path) // nolint: gosec
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	return NewACLAuthorizer(f)
+}
+
+// NewACLAuthorizer returns an Authorizer using an ACL file in the format
+// used by mosquitto:
+//
+//	# Rules before the first user line apply to clients without user name
+//	topic read public/#
+//	user alice
+//	topic readwrite alice/#
+//	topic deny alice/secret
+//	# Rules for all clients, %c is the client ID and %u the user name
+//	pattern write devices/%c/#
+//
+// The access is one of read, write, readwrite (the default) and deny, which
+// takes precedence. Everything not granted is denied. A pattern containing
+// %c or %u never matches clients whose ID or user name contains "/", "+" or
+// "#".
+func NewACLAuthorizer(r io.Reader) (Authorizer, error) {
+	a := &aclAuthorizer{users: make(map[string][]aclRule)}
+	var (
+		userName    string
+		userSection bool
+	)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		keyword, rest := cutField(text)
+		switch keyword {
+		case "user":
+			if rest == "" {
+				return nil, fmt.Errorf("broker: ACL file line %d: Missing user name", line)
+			}
+			userName, userSection = rest, true
+		case "topic", "pattern":
+			rule := aclRule{access: AccessRead | AccessWrite}
+			switch access, filter := cutField(rest); access {
+			case "read":
+				rule.access, rest = AccessRead, filter
+			case "write":
+				rule.access, rest = AccessWrite, filter
+			case "readwrite":
+				rest = filter
+			case "deny":
+				rule.deny, rest = true, filter
+			}
+			if rest == "" || !validTopicFilter(rest) {
+				return nil, fmt.Errorf("broker: ACL file line %d: Invalid topic %q", line, rest)
+			}
+			rule.filter = rest
+			switch {
+			case keyword == "pattern":
+				a.patterns = append(a.patterns, rule)
+			case userSection:
+				a.users[userName] = append(a.users[userName], rule)
+			default:
+				a.anonymous = append(a.anonymous, rule)
+			}
+		default:
+			return nil, fmt.Errorf("broker: ACL file line %d: Unknown keyword %q", line, keyword)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// cutField splits s at the first space.
+func cutField(s string) (field, rest string) {
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i+1:])
+}
+
+// Authorize grants access if a rule for the client grants it and no deny
+// rule matches. Subscriptions need a rule matching every topic the filter
+// matches, and are denied if a deny rule matches any of them.
+func (a *aclAuthorizer) Authorize(info ClientInfo, topic string, access Access) bool {
+	rules := a.anonymous
+	if info.UserName != "" {
+		rules = a.users[info.UserName]
+	}
+	for _, rule := range a.patterns {
+		if filter, ok := substitutePattern(rule.filter, info); ok {
+			rule.filter = filter
+			// Never append to the slice stored in the authorizer
+			rules = append(rules[:len(rules):len(rules)], rule)
+		}
+	}
+
+	granted := false
+	for _, rule := range rules {
+		switch {
+		case rule.deny:
+			if (access == AccessRead && filtersOverlap(rule.filter, topic)) ||
+				(access == AccessWrite && matchTopic(rule.filter, topic)) {
+				return false
+			}
+		case rule.access&access == 0:
+		case access == AccessRead:
+			granted = granted || coversFilter(rule.filter, topic)
+		default:
+			granted = granted || matchTopic(rule.filter, topic)
+		}
+	}
+	return granted
+}
+
+// substitutePattern replaces %c with the client ID and %u with the user
+// name. ok is false if a value can't be used safely in a topic level.
+func substitutePattern(filter string, info ClientInfo) (string, bool) {
+	for _, r := range []struct{ placeholder, value string }{
+		{"%c", info.ClientID},
+		{"%u", info.UserName},
+	} {
+		if !strings.Contains(filter, r.placeholder) {
+			continue
+		}
+		if r.value == "" || strings.ContainsAny(r.value, "/+#") {
+			return "", false
+		}
+		filter = strings.Replace(filter, r.placeholder, r.value, -1)
+	}
+	return filter, true
+}
+
+// coversFilter reports whether every topic matched by the topic filter
+// sub is also matched by the topic filter acl.
+func coversFilter(acl, sub string) bool {
+	if strings.HasPrefix(sub, "$") && isWildcard(acl[0]) {
+		return false
+	}
+	aclLevels := strings.Split(acl, "/")
+	subLevels := strings.Split(sub, "/")
+	for i, level := range aclLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(subLevels) {
+			return false
+		}
+		switch {
+		case subLevels[i] == "#":
+			return false
+		case level == "+":
+		case subLevels[i] == "+" || level != subLevels[i]:
+			return false
+		}
+	}
+	return len(aclLevels) == len(subLevels)
+}
+
+// filtersOverlap reports whether a topic exists that is matched by both
+// topic filters.
+func filtersOverlap(a, b string) bool {
+	// Topics starting with "$" are not matched by a wildcard
+	if (strings.HasPrefix(a, "$") && isWildcard(b[0])) || (strings.HasPrefix(b, "$") && isWildcard(a[0])) {
+		return false
+	}
+	aLevels := strings.Split(a, "/")
+	bLevels := strings.Split(b, "/")
+	for i := 0; ; i++ {
+		switch {
+		case i == len(aLevels) && i == len(bLevels):
+			return true
+		case i == len(aLevels):
+			// "a/#" also matches "a"
+			return i == len(bLevels)-1 && bLevels[i] == "#"
+		case i == len(bLevels):
+			return i == len(aLevels)-1 && aLevels[i] == "#"
+		case aLevels[i] == "#" || bLevels[i] == "#":
+			return true
+		case aLevels[i] != "+" && bLevels[i] != "+" && aLevels[i] != bLevels[i]:
+			return false
+		}
+	}
+}
+
+func isWildcard(c byte) bool {
+	return c == '+' || c == '#'
+}
+
+// authorized asks the Authorizer of the Server whether the client may
+// access the topic name or filter.
+func (c *client) authorized(topic string, access Access) bool {
+	if c.server.Authorizer == nil {
+		return true
+	}
+	if _, filter, ok := parseSharedFilter(topic); ok {
+		topic = filter
+	}
+	return c.server.Authorizer.Authorize(c.info(), topic, access)
+}
+
+// refusePublish answers a PUBLISH the client may not send with reason code
+// Not authorized, MQTT 5 only.
+func (c *client) refusePublish(p *packet.PublishControlPacket) {
+	id := p.VariableHeader.PacketID
+	switch p.FixedHeaderFlags.QoS {
+	case packet.QoSLevelAtLeastOnce:
+		ack := packet.NewPubAckControlPacket(id)
+		ack.VariableHeader.ReasonCode = packet.ReasonCodeNotAuthorized
+		c.send(ack)
+	case packet.QoSLevelExactlyOnce:
+		rec := packet.NewPubRecControlPacket(id)
+		rec.VariableHeader.ReasonCode = packet.ReasonCodeNotAuthorized
+		c.send(rec)
+	}
+}
@@ -0,0 +1,143 @@
+package broker
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testACL = `
+# anonymous clients
+topic read public/#
+
+user alice
+topic alice/#
+topic deny alice/secret
+topic write shared/in
+
+pattern readwrite devices/%c/#
+pattern read users/%u/inbox
+`
+
+func TestCoversFilter(t *testing.T) {
+	for _, test := range []struct {
+		acl, sub string
+		covered  bool
+	}{
+		{"a/#", "a/b/c", true},
+		{"a/#", "a/+", true},
+		{"a/#", "a", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/+", true},
+		{"a/+", "a/#", false},
+		{"a/b", "a/+", false},
+		{"a/b", "a/b/c", false},
+		{"#", "$SYS/#", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+	} {
+		assert.Equal(t, test.covered, coversFilter(test.acl, test.sub), "%v covers %v", test.acl, test.sub)
+	}
+}
+
+func TestFiltersOverlap(t *testing.T) {
+	for _, test := range []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"a/secret", "a/#", true},
+		{"a/secret", "a/+", true},
+		{"a/secret", "a/public", false},
+		{"a/#", "a", true},
+		{"a/b", "a", false},
+		{"+/b", "a/+", true},
+		{"#", "$SYS/x", false},
+		{"$SYS/#", "$SYS/+", true},
+	} {
+		assert.Equal(t, test.overlap, filtersOverlap(test.a, test.b), "%v overlaps %v", test.a, test.b)
+		assert.Equal(t, test.overlap, filtersOverlap(test.b, test.a), "%v overlaps %v", test.b, test.a)
+	}
+}
+
+func TestACLAuthorizer(t *testing.T) {
+	a, err := NewACLAuthorizer(strings.NewReader(testACL))
+	require.NoError(t, err)
+
+	anonymous := ClientInfo{ClientID: "d1"}
+	alice := ClientInfo{ClientID: "d2", UserName: "alice"}
+	for _, test := range []struct {
+		info       ClientInfo
+		topic      string
+		access     Access
+		authorized bool
+	}{
+		{anonymous, "public/#", AccessRead, true},
+		{anonymous, "public/news", AccessWrite, false},
+		{anonymous, "devices/d1/state", AccessWrite, true},
+		{anonymous, "devices/d2/state", AccessWrite, false},
+		{anonymous, "devices/+/state", AccessRead, false},
+		{anonymous, "users/alice/inbox", AccessRead, false},
+		{alice, "public/#", AccessRead, false},
+		{alice, "alice/x", AccessWrite, true},
+		{alice, "alice/secret", AccessWrite, false},
+		{alice, "alice/#", AccessRead, false},
+		{alice, "alice/+/x", AccessRead, true},
+		{alice, "shared/in", AccessWrite, true},
+		{alice, "shared/in", AccessRead, false},
+		{alice, "devices/d2/#", AccessRead, true},
+		{alice, "users/alice/inbox", AccessRead, true},
+		{ClientInfo{ClientID: "+"}, "devices/+/state", AccessWrite, false},
+	} {
+		assert.Equal(t, test.authorized, a.Authorize(test.info, test.topic, test.access), "%+v %v %v", test.info, test.topic, test.access)
+	}
+
+	for _, invalid := range []string{"topic", "topic read a/#/b", "user", "allow a"} {
+		_, err = NewACLAuthorizer(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestServerAuthorization(t *testing.T) {
+	s := NewServer()
+	a, err := NewACLAuthorizer(strings.NewReader(testACL))
+	require.NoError(t, err)
+	s.Authorizer = a
+	defer s.Shutdown(context.Background())
+
+	v5 := connect(t, s, "d1", 5)
+	defer v5.Close()
+	_, err = v5.Write(subscribePacket(1, "devices/#", 0, 5))
+	require.NoError(t, err)
+	packetType, body := readRaw(t, v5)
+	require.Equal(t, byte(packet.SUBACK), packetType)
+	assert.Equal(t, packet.ReasonCodeNotAuthorized, body[len(body)-1])
+
+	writePublish(t, v5, "devices/d2/state", "x", packet.QoSLevelAtLeastOnce, 1, 5)
+	packetType, body = readRaw(t, v5)
+	assert.Equal(t, byte(packet.PUBACK), packetType)
+	assert.Equal(t, []byte{0, 1, packet.ReasonCodeNotAuthorized}, body)
+	writePublish(t, v5, "devices/d2/state", "x", packet.QoSLevelExactlyOnce, 2, 5)
+	packetType, body = readRaw(t, v5)
+	assert.Equal(t, byte(packet.PUBREC), packetType)
+	assert.Equal(t, []byte{0, 2, packet.ReasonCodeNotAuthorized}, body)
+
+	subscribe(t, v5, "devices/d1/#", 1, 5)
+	v3 := connect(t, s, "d2", 4)
+	defer v3.Close()
+	_, err = v3.Write(subscribePacket(1, "devices/d1/#", 0, 4))
+	require.NoError(t, err)
+	packetType, body = readRaw(t, v3)
+	require.Equal(t, byte(packet.SUBACK), packetType)
+	assert.Equal(t, packet.ReturncodeFailure, body[len(body)-1])
+
+	// MQTT 3.1.1 messages are acknowledged but dropped
+	writePublish(t, v3, "devices/d1/state", "forged", packet.QoSLevelAtLeastOnce, 1, 4)
+	packetType, body = readRaw(t, v3)
+	assert.Equal(t, byte(packet.PUBACK), packetType)
+	assert.Equal(t, []byte{0, 1}, body)
+	writePublish(t, v5, "devices/d1/state", "real", packet.QoSLevelNone, 0, 5)
+	assert.Equal(t, []byte("real"), readPublish(t, v5, 5).Payload)
+}
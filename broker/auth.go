@@ -0,0 +1,346 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"bufio"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	// ErrBadCredentials is returned by an Authenticator to refuse a client
+	// with the CONNACK code Bad user name or password.
+	ErrBadCredentials = errors.New("broker: Bad user name or password")
+	// ErrNotAuthorized is returned by an Authenticator to refuse a client
+	// with the CONNACK code Not authorized.
+	ErrNotAuthorized = errors.New("broker: Not authorized")
+)
+
+// AuthRequest describes a client connecting to the Server.
+type AuthRequest struct {
+	// ClientID is empty if the client asked the Server to assign one and
+	// none is taken from its certificate, see Server.CertificateClientID.
+	ClientID string
+	UserName string
+	// Password is nil if the CONNECT had no password.
+	Password []byte
+	// TLS is nil for connections without TLS.
+	TLS *tls.ConnectionState
+	// Peer is the process connected to a Unix domain socket, nil for other
+	// connections or if its credentials are not available, e.g. on other
+	// platforms than Linux. A Unix domain socket client without Peer must
+	// not be trusted for being local, see NewPeerCredentialsAuthenticator.
+	Peer *PeerCredentials
+	// Proxy is the information sent by a trusted proxy with the PROXY
+	// protocol, see NewProxyListener. RemoteAddr is the address of the
+	// client then.
+	Proxy      *ProxyInfo
+	RemoteAddr net.Addr
+}
+
+// Authenticator decides whether a client may connect. Authenticate is
+// called concurrently for every CONNECT.
+type Authenticator interface {
+	// Authenticate returns nil to accept the client. ErrBadCredentials and
+	// ErrNotAuthorized refuse it with the matching CONNACK code, other
+	// errors are logged and refuse it with Server unavailable.
+	Authenticate(req AuthRequest) error
+}
+
+// EnhancedAuthenticator implements an MQTT 5 enhanced authentication
+// method, see Server.EnhancedAuthenticators. Start is called concurrently
+// for every CONNECT with the method and for every re-authentication.
+type EnhancedAuthenticator interface {
+	Start(req AuthRequest) AuthExchange
+}
+
+// AuthExchange is a single enhanced authentication of a client. Its methods
+// are called from the goroutine serving the client.
+type AuthExchange interface {
+	// Next takes the Authentication Data of the CONNECT or AUTH from the
+	// client and returns the Authentication Data of the reply. done reports
+	// whether the client has been authenticated: the reply is then sent in
+	// the CONNACK, or in an AUTH with reason code Success after
+	// re-authentication. Otherwise it is sent in an AUTH with reason code
+	// Continue authentication. Errors are handled as for Authenticator.
+	Next(data []byte) (reply []byte, done bool, err error)
+	// UserName returns the user name of the authenticated client, or "" to
+	// keep the user name of the CONNECT.
+	UserName() string
+}
+
+type allowAllAuthenticator struct{}
+
+// NewAllowAllAuthenticator returns an Authenticator accepting every client.
+func NewAllowAllAuthenticator() Authenticator {
+	return allowAllAuthenticator{}
+}
+
+func (allowAllAuthenticator) Authenticate(req AuthRequest) error {
+	return nil
+}
+
+type staticAuthenticator struct {
+	passwords map[string]string
+}
+
+// NewStaticAuthenticator returns an Authenticator accepting the clients
+// with a user name and password from users, which maps user names to
+// plain text passwords.
+func NewStaticAuthenticator(users map[string]string) Authenticator {
+	passwords := make(map[string]string, len(users))
+	for userName, password := range users {
+		passwords[userName] = password
+	}
+	return staticAuthenticator{passwords: passwords}
+}
+
+func (a staticAuthenticator) Authenticate(req AuthRequest) error {
+	if req.UserName == "" {
+		return ErrNotAuthorized
+	}
+	password, ok := a.passwords[req.UserName]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), req.Password) != 1 {
+		return ErrBadCredentials
+	}
+	return nil
+}
+
+type passwordFileAuthenticator struct {
+	hashes map[string]string
+	// dummy is checked for unknown users, so that they take as long as
+	// known ones. It is the first hash of the file, which has the cost used
+	// there.
+	dummy string
+}
+
+// LoadPasswordFile reads a password file, see NewPasswordFileAuthenticator.
+func LoadPasswordFile(path string) (Authenticator, error) {
+	f, err := os.Open(path) // nolint: gosec
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	return NewPasswordFileAuthenticator(f)
+}
+
+// NewPasswordFileAuthenticator returns an Authenticator checking user names
+// and passwords against a password file in the format used by mosquitto:
+// one "user:hash" per line, empty lines and lines starting with "#" are
+// ignored. Hashes are either bcrypt hashes ("$2a$", "$2b$" or "$2y$") or
+// PBKDF2-SHA512 hashes as written by mosquitto_passwd
+// ("$7$iterations$salt$hash" with base64 encoded salt and hash).
+func NewPasswordFileAuthenticator(r io.Reader) (Authenticator, error) {
+	a := passwordFileAuthenticator{hashes: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.IndexByte(text, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("broker: Password file line %d: Expected user:hash", line)
+		}
+		userName, hash := text[:i], text[i+1:]
+		if _, err := checkPassword(hash, nil); err != nil {
+			return nil, fmt.Errorf("broker: Password file line %d: %v", line, err)
+		}
+		a.hashes[userName] = hash
+		if a.dummy == "" {
+			a.dummy = hash
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a passwordFileAuthenticator) Authenticate(req AuthRequest) error {
+	if req.UserName == "" {
+		return ErrNotAuthorized
+	}
+	hash, ok := a.hashes[req.UserName]
+	if !ok {
+		if a.dummy != "" {
+			_, _ = checkPassword(a.dummy, req.Password) // nolint: gosec
+		}
+		return ErrBadCredentials
+	}
+	if ok, err := checkPassword(hash, req.Password); err != nil || !ok {
+		return ErrBadCredentials
+	}
+	return nil
+}
+
+// checkPassword reports whether password matches hash. An error is
+// returned if the hash is malformed.
+func checkPassword(hash string, password []byte) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return false, err
+		}
+		return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil, nil
+	case strings.HasPrefix(hash, "$7$"):
+		fields := strings.Split(hash, "$")
+		if len(fields) != 5 {
+			return false, errors.New("Malformed PBKDF2 hash")
+		}
+		iterations, err := strconv.Atoi(fields[2])
+		if err != nil || iterations <= 0 {
+			return false, errors.New("Malformed PBKDF2 iteration count")
+		}
+		salt, err := base64.StdEncoding.DecodeString(fields[3])
+		if err != nil {
+			return false, errors.New("Malformed PBKDF2 salt")
+		}
+		expected, err := base64.StdEncoding.DecodeString(fields[4])
+		if err != nil || len(expected) == 0 {
+			return false, errors.New("Malformed PBKDF2 hash")
+		}
+		if password == nil {
+			return false, nil
+		}
+		key := pbkdf2.Key(password, salt, iterations, len(expected), sha512.New)
+		return subtle.ConstantTimeCompare(key, expected) == 1, nil
+	default:
+		return false, errors.New("Unsupported password hash")
+	}
+}
+
+// authenticate asks the Authenticator of the Server whether the client may
+// connect, and refuses it otherwise.
+func (c *client) authenticate(req AuthRequest) error {
+	if c.server.Authenticator == nil {
+		return nil
+	}
+	if err := c.server.Authenticator.Authenticate(req); err != nil {
+		return c.refuseAuth(err)
+	}
+	return nil
+}
+
+// startAuth starts the enhanced authentication requested by the CONNECT p,
+// the client is connected once the AuthExchange has finished.
+func (c *client) startAuth(p *packet.ConnectControlPacket, req AuthRequest) error {
+	props := p.VariableHeader.ConnectProperties
+	authenticator, ok := c.server.EnhancedAuthenticators[props.AuthenticationMethod]
+	if !ok {
+		return c.refuse(packet.ConnAckNotAuthorized, packet.ReasonCodeBadAuthenticationMethod)
+	}
+	c.authMethod = props.AuthenticationMethod
+	c.auth = authenticator.Start(req)
+	c.pending = p
+	c.userName = req.UserName
+	// The AUTH packets have to arrive as fast as the CONNECT
+	c.dispatcher.SetTimeouts(c.dispatcher.ConnectTimeouts)
+	return c.continueAuth(props.AuthenticationData)
+}
+
+// continueAuth passes the Authentication Data from the client to the
+// exchange in progress and replies. A failed re-authentication closes the
+// connection.
+func (c *client) continueAuth(data []byte) error {
+	reply, done, err := c.auth.Next(data)
+	if err != nil {
+		c.auth = nil
+		if c.connected {
+			if err != ErrBadCredentials && err != ErrNotAuthorized {
+				c.server.logf("broker: Re-authenticating client %q: %v", c.id, err)
+			}
+			return &packet.ProtocolError{ReasonCode: packet.ReasonCodeNotAuthorized, Message: "Re-authentication failed"}
+		}
+		return c.refuseAuth(err)
+	}
+	if !done {
+		c.send(packet.NewAuth(packet.ReasonCodeContinueAuthentication, c.authMethod, reply))
+		return nil
+	}
+
+	userName := c.auth.UserName()
+	c.auth = nil
+	if c.connected {
+		// The user name is used for authorization and can't change
+		if userName != "" && userName != c.userName {
+			return &packet.ProtocolError{ReasonCode: packet.ReasonCodeNotAuthorized, Message: "Re-authenticated as different user"}
+		}
+		c.send(packet.NewAuth(packet.ReasonCodeSuccess, c.authMethod, reply))
+		return nil
+	}
+	p := c.pending
+	c.pending = nil
+	if userName == "" {
+		userName = c.userName
+	}
+	return c.acceptConnect(p, userName, reply)
+}
+
+func (c *client) authRequest(clientID, userName string, password []byte) AuthRequest {
+	return AuthRequest{
+		ClientID:   clientID,
+		UserName:   userName,
+		Password:   password,
+		TLS:        c.tlsState(),
+		Peer:       c.peerCredentials(),
+		Proxy:      c.proxy,
+		RemoteAddr: c.conn.RemoteAddr(),
+	}
+}
+
+// tlsState returns the state of a TLS connection, nil for other
+// connections.
+func (c *client) tlsState() *tls.ConnectionState {
+	conn, ok := c.conn.(interface {
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		return nil
+	}
+	state := conn.ConnectionState()
+	return &state
+}
+
+// refuseAuth refuses the client with the CONNACK code matching an error
+// returned by an Authenticator or AuthExchange.
+func (c *client) refuseAuth(err error) error {
+	switch err {
+	case ErrBadCredentials:
+		return c.refuse(packet.ConnAckBadUserNameOrPassword, packet.ReasonCodeBadUserNameOrPassword)
+	case ErrNotAuthorized:
+		return c.refuse(packet.ConnAckNotAuthorized, packet.ReasonCodeNotAuthorized)
+	default:
+		c.server.logf("broker: Authenticating client %q: %v", c.id, err)
+		return c.refuse(packet.ConnAckServerUnavailable, packet.ReasonCodeServerUnavailable)
+	}
+}
@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// credentialsConnectPacket builds a CONNECT with clean start, user name and
+// password.
+func credentialsConnectPacket(clientID string, level byte, userName, password string) []byte {
+	body := append(mqttString("MQTT"), level, 0xc2, 0, 0)
+	if level == 5 {
+		body = append(body, 0)
+	}
+	body = append(body, mqttString(clientID)...)
+	body = append(body, mqttString(userName)...)
+	body = append(body, mqttString(password)...)
+	return withFixedHeader(packet.CONNECT<<4, body)
+}
+
+type authenticatorFunc func(req AuthRequest) error
+
+func (f authenticatorFunc) Authenticate(req AuthRequest) error {
+	return f(req)
+}
+
+func TestStaticAuthenticator(t *testing.T) {
+	a := NewStaticAuthenticator(map[string]string{"user": "secret"})
+	assert.NoError(t, a.Authenticate(AuthRequest{UserName: "user", Password: []byte("secret")}))
+	assert.Equal(t, ErrBadCredentials, a.Authenticate(AuthRequest{UserName: "user", Password: []byte("wrong")}))
+	assert.Equal(t, ErrBadCredentials, a.Authenticate(AuthRequest{UserName: "other", Password: []byte("secret")}))
+	assert.Equal(t, ErrNotAuthorized, a.Authenticate(AuthRequest{}))
+}
+
+func TestPasswordFileAuthenticator(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("one"), bcrypt.MinCost)
+	require.NoError(t, err)
+	salt := []byte("0123456789ab")
+	pbkdf2Hash := "$7$101$" + base64.StdEncoding.EncodeToString(salt) + "$" +
+		base64.StdEncoding.EncodeToString(pbkdf2.Key([]byte("two"), salt, 101, 64, sha512.New))
+	file := "# users\n\nalice:" + string(bcryptHash) + "\nbob:" + pbkdf2Hash + "\n"
+
+	a, err := NewPasswordFileAuthenticator(strings.NewReader(file))
+	require.NoError(t, err)
+	assert.NoError(t, a.Authenticate(AuthRequest{UserName: "alice", Password: []byte("one")}))
+	assert.NoError(t, a.Authenticate(AuthRequest{UserName: "bob", Password: []byte("two")}))
+	assert.Equal(t, ErrBadCredentials, a.Authenticate(AuthRequest{UserName: "alice", Password: []byte("two")}))
+	assert.Equal(t, ErrBadCredentials, a.Authenticate(AuthRequest{UserName: "bob"}))
+	assert.Equal(t, ErrBadCredentials, a.Authenticate(AuthRequest{UserName: "carol", Password: []byte("one")}))
+	assert.Equal(t, string(bcryptHash), a.(passwordFileAuthenticator).dummy, "checked for unknown users")
+
+	for _, invalid := range []string{"alice", "alice:plain", "alice:$7$x$y$z", "alice:$2a$broken"} {
+		_, err = NewPasswordFileAuthenticator(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestServerAuthentication(t *testing.T) {
+	s := NewServer()
+	s.Authenticator = NewStaticAuthenticator(map[string]string{"user": "secret"})
+	connected := make(chan ClientInfo, 1)
+	s.Hooks.OnConnect = func(info ClientInfo) { connected <- info }
+	defer s.Shutdown(context.Background())
+
+	assert.Equal(t, packet.ConnAckBadUserNameOrPassword, connectRefused(t, s, credentialsConnectPacket("c", 4, "user", "wrong")))
+	assert.Equal(t, packet.ReasonCodeBadUserNameOrPassword, connectRefused(t, s, credentialsConnectPacket("c", 5, "user", "wrong")))
+	assert.Equal(t, packet.ConnAckNotAuthorized, connectRefused(t, s, connectPacket("c", 4)))
+	assert.Equal(t, packet.ReasonCodeNotAuthorized, connectRefused(t, s, connectPacket("c", 5)))
+
+	client, _ := connectRaw(t, s, credentialsConnectPacket("c", 5, "user", "secret"))
+	defer client.Close()
+	assert.Equal(t, "user", (<-connected).UserName)
+
+	s.Authenticator = authenticatorFunc(func(req AuthRequest) error {
+		assert.NotNil(t, req.RemoteAddr)
+		assert.Nil(t, req.TLS)
+		return errors.New("backend down")
+	})
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+	assert.Equal(t, packet.ReasonCodeServerUnavailable, connectRefused(t, s, connectPacket("d", 5)))
+}
@@ -0,0 +1,591 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+var errConnectionRefused = errors.New("broker: Connection refused")
+
+// client is a single connection. It implements packet.Handler, the handler
+// methods run in the goroutine of the Dispatcher. Packets to the client are
+// written by a separate goroutine.
+type client struct {
+	server     *Server
+	conn       net.Conn
+	metered    *meteredConn // conn counting the packets for Stats
+	dispatcher *packet.Dispatcher
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	outgoing   chan io.WriterTo
+	stopping   chan struct{}
+	writerDone chan struct{}
+	final      io.WriterTo
+
+	// detached is closed when the connection has been closed and detached
+	// from its session
+	detached chan struct{}
+
+	// Set by OnConnect, read-only afterwards
+	id            string
+	assignedID    bool // id was assigned by the Server
+	userName      string
+	proxy         *ProxyInfo
+	protocolLevel byte
+	connected     bool
+	session       *session
+
+	// authMethod is the enhanced authentication method of the CONNECT, set
+	// by OnConnect. auth is the exchange in progress, pending the CONNECT
+	// waiting for it. They are only accessed from the Dispatcher goroutine.
+	authMethod string
+	auth       AuthExchange
+	pending    *packet.ConnectControlPacket
+
+	// will is published when the connection ends without DISCONNECT, it is
+	// only accessed from the Dispatcher goroutine and after it ended.
+	will      *packet.PublishControlPacket
+	willDelay uint32
+
+	mu               sync.Mutex
+	disconnectReason byte
+
+	// stalled is set to 1 when a message was queued in the session because
+	// the outgoing queue was full, the writer drains the session queue
+	// after the next write. Accessed atomically.
+	stalled int32
+}
+
+func newClient(s *Server, conn net.Conn) *client {
+	c := &client{
+		server:     s,
+		conn:       conn,
+		outgoing:   make(chan io.WriterTo, s.OutgoingQueueSize),
+		stopping:   make(chan struct{}),
+		writerDone: make(chan struct{}),
+		detached:   make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.metered = newMeteredConn(conn, s.traffic)
+	c.dispatcher = packet.NewDispatcher(c.metered, c, packet.ReadTimeouts{
+		FixedHeader: s.ConnectTimeout,
+		Remaining:   s.ConnectTimeout,
+	})
+	c.dispatcher.MaxPacketSize = s.MaxPacketSize
+	return c
+}
+
+func (c *client) info() ClientInfo {
+	return ClientInfo{
+		ClientID:      c.id,
+		UserName:      c.userName,
+		RemoteAddr:    c.conn.RemoteAddr(),
+		Proxy:         c.proxy,
+		ProtocolLevel: c.protocolLevel,
+	}
+}
+
+func (c *client) serve() {
+	go c.writeLoop()
+	err := c.dispatcher.Serve(c.ctx)
+
+	var final io.WriterTo
+	if c.connected && int(c.protocolLevel) == 5 {
+		c.mu.Lock()
+		reason := c.disconnectReason
+		c.mu.Unlock()
+		switch e := err.(type) {
+		case *packet.ProtocolError:
+			reason = e.ReasonCode
+		case *packet.IdleTimeoutError:
+			reason = packet.ReasonCodeKeepAliveTimeout
+		}
+		if reason != packet.ReasonCodeNormalDisconnection {
+			final = packet.NewDisconnect(c.protocolLevel, reason)
+		}
+	}
+	c.stop(final)
+	_ = c.conn.Close() // nolint: gosec
+
+	if err != nil && err != errConnectionRefused && err != io.EOF && c.ctx.Err() == nil {
+		c.server.logf("broker: Closing connection of client %q: %v", c.id, err)
+	}
+	if c.connected && c.server.Hooks.OnDisconnect != nil {
+		c.server.Hooks.OnDisconnect(c.info(), err)
+	}
+}
+
+// close disconnects the client from outside of the Dispatcher goroutine.
+// MQTT 5 clients receive a DISCONNECT with the reason code.
+func (c *client) close(reasonCode byte) {
+	c.mu.Lock()
+	c.disconnectReason = reasonCode
+	c.mu.Unlock()
+	c.cancel()
+}
+
+// send queues p, it blocks until there is room in the queue or the client
+// is closed.
+func (c *client) send(p io.WriterTo) {
+	select {
+	case c.outgoing <- p:
+	case <-c.ctx.Done():
+	}
+}
+
+// trySend queues p unless the queue is full.
+func (c *client) trySend(p io.WriterTo) bool {
+	select {
+	case c.outgoing <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop flushes the queue, writes final if not nil and ends the writer.
+func (c *client) stop(final io.WriterTo) {
+	c.final = final
+	close(c.stopping)
+	c.cancel()
+	<-c.writerDone
+}
+
+func (c *client) writeLoop() {
+	defer close(c.writerDone)
+	for {
+		select {
+		case p := <-c.outgoing:
+			if err := c.write(p); err != nil {
+				c.cancel()
+				<-c.stopping
+				return
+			}
+			if atomic.CompareAndSwapInt32(&c.stalled, 1, 0) {
+				c.drain()
+			}
+		case <-c.stopping:
+			c.flush()
+			return
+		}
+	}
+}
+
+func (c *client) flush() {
+	for {
+		select {
+		case p := <-c.outgoing:
+			if err := c.write(p); err != nil {
+				return
+			}
+		default:
+			if c.final != nil {
+				_ = c.write(c.final) // nolint: gosec
+			}
+			return
+		}
+	}
+}
+
+func (c *client) write(p io.WriterTo) error {
+	if c.server.WriteTimeout > 0 {
+		if err := c.conn.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout)); err != nil {
+			return err
+		}
+	}
+	_, err := p.WriteTo(c.metered)
+	return err
+}
+
+// refuse sends a CONNACK with the return code matching the protocol level.
+func (c *client) refuse(returnCode, reasonCode byte) error {
+	code := returnCode
+	if int(c.protocolLevel) == 5 {
+		code = reasonCode
+	}
+	c.send(packet.NewConnAck(c.protocolLevel, false, code))
+	return errConnectionRefused
+}
+
+func (c *client) OnConnect(p *packet.ConnectControlPacket) error {
+	c.protocolLevel = p.VariableHeader.ProtocolLevel
+	switch c.protocolLevel {
+	case 3, 4, 5:
+	default:
+		c.protocolLevel = 4
+		return c.refuse(packet.ConnAckUnacceptableProtocolVersion, packet.ReasonCodeUnsupportedProtocolVersion)
+	}
+
+	// A Receive Maximum of 0 would allow no message at all
+	if rm := p.VariableHeader.ConnectProperties.ReceiveMaximumValue; rm != nil && *rm == 0 {
+		return c.refuse(packet.ConnAckServerUnavailable, packet.ReasonCodeProtocolError)
+	}
+
+	c.id = p.ConnectPayload.ClientID
+	c.proxy = proxyInfo(c.conn)
+	req := c.authRequest(c.id, p.ConnectPayload.UserName, p.ConnectPayload.Password)
+	if certID := certificateIdentity(req.TLS, c.server.CertificateClientID); certID != "" {
+		switch {
+		case c.id == "":
+			c.id = certID
+			c.assignedID = true
+			req.ClientID = certID
+		case c.id != certID && c.server.RequireCertificateClientID:
+			return c.refuse(packet.ConnAckIdentifierRejected, packet.ReasonCodeClientIdentifierNotValid)
+		}
+	}
+	if certUserName := certificateIdentity(req.TLS, c.server.CertificateUserName); certUserName != "" {
+		req.UserName = certUserName
+	}
+
+	// An empty client ID asks for an ID assigned by the Server, MQTT 3.1.1
+	// only allows that for clean sessions, MQTT 3.1 not at all
+	if !validClientID(c.id) ||
+		(c.id == "" && (c.protocolLevel == 3 || (c.protocolLevel == 4 && !p.VariableHeader.ConnectFlags.CleanStart))) {
+		return c.refuse(packet.ConnAckIdentifierRejected, packet.ReasonCodeClientIdentifierNotValid)
+	}
+	if p.VariableHeader.ConnectProperties.AuthenticationMethod != "" {
+		return c.startAuth(p, req)
+	}
+	if err := c.authenticate(req); err != nil {
+		return err
+	}
+	return c.acceptConnect(p, req.UserName, nil)
+}
+
+// acceptConnect connects the authenticated client sending p. authData is
+// the Authentication Data of the CONNACK concluding an enhanced
+// authentication.
+func (c *client) acceptConnect(p *packet.ConnectControlPacket, userName string, authData []byte) error {
+	c.userName = userName
+	if p.VariableHeader.ConnectFlags.WillFlag {
+		if !validTopicName(p.ConnectPayload.WillTopic) {
+			if int(c.protocolLevel) == 5 {
+				return c.refuse(packet.ConnAckServerUnavailable, packet.ReasonCodeTopicNameInvalid)
+			}
+			return errors.New("broker: Invalid will topic")
+		}
+		if !c.authorized(p.ConnectPayload.WillTopic, AccessWrite) {
+			return c.refuse(packet.ConnAckNotAuthorized, packet.ReasonCodeNotAuthorized)
+		}
+		c.will = newWill(p)
+		c.willDelay = uint32(p.ConnectPayload.WillProperties.WillDelayInterval)
+	}
+
+	expiry, capped := c.server.sessionExpiry(p)
+	keepAlive := p.VariableHeader.KeepAlive
+	err := c.server.attachSession(c, p.VariableHeader.ConnectFlags.CleanStart, expiry, func(present bool) {
+		if int(c.protocolLevel) == 5 {
+			var receiveMaximum uint16
+			if rm := p.VariableHeader.ConnectProperties.ReceiveMaximumValue; rm != nil {
+				receiveMaximum = uint16(*rm)
+			}
+			c.session.inflight.SetReceiveMaximum(receiveMaximum, c.server.ReceiveMaximum)
+		} else {
+			c.session.inflight.SetReceiveMaximum(0, 0)
+		}
+
+		connAck := packet.NewConnAck(c.protocolLevel, present, packet.ConnAckAccepted)
+		if c.assignedID && int(c.protocolLevel) == 5 {
+			connAck.VariableHeader.ConnAckProperties.AssignedClientID = c.id
+		}
+		if capped {
+			interval := int(expiry)
+			connAck.VariableHeader.ConnAckProperties.SessionExpiryInterval = &interval
+		}
+		if int(c.protocolLevel) == 5 {
+			connAck.VariableHeader.ConnAckProperties.ReceiveMaximum = c.server.ReceiveMaximum
+			connAck.VariableHeader.ConnAckProperties.MaximumPacketSize = uint32(c.server.MaxPacketSize)
+			sharedAvailable := !c.server.DisableSharedSubscriptions
+			connAck.VariableHeader.ConnAckProperties.SharedSubscriptionAvailable = &sharedAvailable
+			var overridden bool
+			if keepAlive, overridden = c.server.keepAlive(keepAlive); overridden {
+				connAck.VariableHeader.ConnAckProperties.ServerKeepAlive = &keepAlive
+			}
+			connAck.VariableHeader.ConnAckProperties.AuthenticationMethod = c.authMethod
+			connAck.VariableHeader.ConnAckProperties.AuthenticationData = authData
+		}
+		c.send(connAck)
+	})
+	if err != nil {
+		return err
+	}
+	c.dispatcher.Authenticated()
+	c.connected = true
+
+	// Allow one and a half times the keep alive before considering the
+	// client dead, 0 disables the keep alive mechanism
+	c.dispatcher.SetTimeouts(packet.ReadTimeouts{
+		FixedHeader: time.Duration(keepAlive) * 1500 * time.Millisecond,
+		Remaining:   c.server.ConnectTimeout,
+	})
+
+	if c.server.Hooks.OnConnect != nil {
+		c.server.Hooks.OnConnect(c.info())
+	}
+	return nil
+}
+
+// newWill builds the will message of a CONNECT with the will flag set.
+func newWill(p *packet.ConnectControlPacket) *packet.PublishControlPacket {
+	will := packet.NewPublish(p.ConnectPayload.WillTopic, 0, p.ConnectPayload.WillPayload, p.VariableHeader.ProtocolLevel)
+	will.FixedHeaderFlags.QoS = packet.QosLevel(p.VariableHeader.ConnectFlags.WillQoS)
+	will.FixedHeaderFlags.Retain = p.VariableHeader.ConnectFlags.WillRetain
+	wp := p.ConnectPayload.WillProperties
+	will.VariableHeader.PublishProperties = packet.PublishProperties{
+		PayloadFormatIndicator: wp.PayloadFormatIndicator,
+		MessageExpiryInterval:  wp.MessageExpiryInterval,
+		ContentType:            wp.ContentType,
+		ResponseTopic:          wp.ResponseTopic,
+		CorrelationData:        string(wp.CorrelationData),
+		UserProperties:         wp.UserProperties,
+	}
+	return will
+}
+
+func (c *client) OnPublish(p *packet.PublishControlPacket) error {
+	if !validTopicName(p.VariableHeader.Topic) {
+		return &packet.ProtocolError{ReasonCode: packet.ReasonCodeTopicNameInvalid, Message: "Invalid topic name"}
+	}
+	if c.server.Hooks.OnPublish != nil {
+		c.server.Hooks.OnPublish(c.info(), p)
+	}
+	authorized := c.authorized(p.VariableHeader.Topic, AccessWrite)
+	if !authorized && int(c.protocolLevel) == 5 {
+		c.refusePublish(p)
+		return nil
+	}
+	// MQTT 3.1.1 can't refuse a PUBLISH, like messages to $SYS topics, which
+	// are reserved for the statistics of the Server, it is acknowledged but
+	// dropped
+	drop := !authorized || strings.HasPrefix(p.VariableHeader.Topic, sysPrefix)
+	route := func() {
+		if !drop {
+			c.server.route(c.id, p)
+		}
+	}
+	if p.FixedHeaderFlags.Retain && !drop {
+		c.server.retained.Set(p)
+	}
+
+	id := p.VariableHeader.PacketID
+	switch p.FixedHeaderFlags.QoS {
+	case packet.QoSLevelAtLeastOnce:
+		route()
+		c.send(packet.NewPubAckControlPacket(id))
+	case packet.QoSLevelExactlyOnce:
+		// The message is routed right away, its packet ID is kept until the
+		// PUBREL to recognize retransmissions
+		duplicate, err := c.session.inflight.Receive(p)
+		if err != nil {
+			return &packet.ProtocolError{ReasonCode: packet.ReasonCodeReceiveMaximumExceeded, Message: err.Error()}
+		}
+		if !duplicate {
+			route()
+		}
+		c.send(packet.NewPubRecControlPacket(id))
+	default:
+		route()
+	}
+	return nil
+}
+
+func (c *client) OnSubscribe(p *packet.SubscribeControlPacket) error {
+	type retainedDelivery struct {
+		message RetainedMessage
+		sub     packet.Subscription
+	}
+	var retained []retainedDelivery
+	codes := make([]byte, 0, len(p.Payload.Subscriptions))
+	for _, sub := range p.Payload.Subscriptions {
+		shared := isSharedFilter(sub.Topic)
+		if shared && c.server.DisableSharedSubscriptions {
+			if int(c.protocolLevel) == 5 {
+				codes = append(codes, packet.ReasonCodeSharedSubscriptionsNotSupported)
+			} else {
+				codes = append(codes, packet.ReturncodeFailure)
+			}
+			continue
+		}
+		if shared && sub.NoLocal {
+			return &packet.ProtocolError{ReasonCode: packet.ReasonCodeProtocolError, Message: "No Local set on a shared subscription"}
+		}
+		if !validTopicFilter(sub.Topic) {
+			if int(c.protocolLevel) == 5 {
+				codes = append(codes, packet.ReasonCodeTopicFilterInvalid)
+			} else {
+				codes = append(codes, packet.ReturncodeFailure)
+			}
+			continue
+		}
+		if (isSysFilter(sub.Topic) && !c.server.sysAdmin(c.info())) || !c.authorized(sub.Topic, AccessRead) {
+			if int(c.protocolLevel) == 5 {
+				codes = append(codes, packet.ReasonCodeNotAuthorized)
+			} else {
+				codes = append(codes, packet.ReturncodeFailure)
+			}
+			continue
+		}
+		isNew := c.server.subscriptions.Subscribe(c.id, sub)
+		// Retained messages are not sent for shared subscriptions
+		if !shared && (sub.RetainHandling == 0 || (sub.RetainHandling == 1 && isNew)) {
+			for _, r := range c.server.retained.Match(sub.Topic) {
+				retained = append(retained, retainedDelivery{message: r, sub: sub})
+			}
+		}
+		codes = append(codes, byte(sub.QoS))
+		if c.server.Hooks.OnSubscribe != nil {
+			c.server.Hooks.OnSubscribe(c.info(), sub)
+		}
+	}
+	c.send(packet.NewSubAck(p.VariableHeader.PacketID, c.protocolLevel, codes))
+	for _, r := range retained {
+		c.deliver(newOutgoingMessage(r.message.Publish, r.sub, true, "", r.message.ExpiresAt))
+	}
+	return nil
+}
+
+func (c *client) OnUnsubscribe(p *packet.UnsubscribeControlPacket) error {
+	var codes []byte
+	for _, unsub := range p.Payload.UnSubscriptions {
+		existed := c.server.subscriptions.Unsubscribe(c.id, unsub.Topic)
+		if int(c.protocolLevel) == 5 {
+			if existed {
+				codes = append(codes, packet.ReasonCodeSuccess)
+			} else {
+				codes = append(codes, packet.ReasonCodeNoSubscriptionExisted)
+			}
+		}
+		if existed && isSharedFilter(unsub.Topic) {
+			c.session.mu.Lock()
+			orphaned := c.session.takeShared(func(filter string) bool { return filter == unsub.Topic })
+			c.session.mu.Unlock()
+			c.server.redistribute(c.id, orphaned)
+		}
+		if existed && c.server.Hooks.OnUnsubscribe != nil {
+			c.server.Hooks.OnUnsubscribe(c.info(), unsub.Topic)
+		}
+	}
+	c.send(packet.NewUnSubAck(p.VariableHeader.PacketID, c.protocolLevel, codes))
+	return nil
+}
+
+func (c *client) OnPingReq(p *packet.PingReqControlPacket) error {
+	c.send(packet.NewPingRespControlPacket())
+	return nil
+}
+
+func (c *client) OnDisconnect(p *packet.DisconnectControlPacket) error {
+	// A DISCONNECT during enhanced authentication just ends the exchange
+	if !c.connected {
+		return nil
+	}
+	if interval := p.VariableHeader.DisconnectProperties.SessionExpiryInterval; interval != nil {
+		if err := c.server.setSessionExpiry(c, uint32(*interval)); err != nil {
+			return err
+		}
+	}
+	// A normal DISCONNECT discards the will, MQTT 5 clients may ask for it
+	// to be published anyway
+	if p.VariableHeader.ReasonCode != packet.ReasonCodeDisconnectWithWillMessage {
+		c.will = nil
+	}
+	return nil
+}
+
+func (c *client) OnPubAck(p *packet.PubackControlPacket) error {
+	c.acknowledged(p.VariableHeader.PacketID)
+	if _, err := c.session.inflight.PubAck(p.VariableHeader.PacketID); err != nil {
+		c.server.logf("broker: PUBACK from %q: %v", c.id, err)
+	}
+	c.drain()
+	return nil
+}
+
+func (c *client) OnPubRec(p *packet.PubRecControlPacket) error {
+	id := p.VariableHeader.PacketID
+	c.acknowledged(id)
+	if p.VariableHeader.ReasonCode >= packet.ReasonCodeUnspecifiedError {
+		// The client refused the message, the flow ends here
+		if _, err := c.session.inflight.PubRec(id); err == nil {
+			_, _ = c.session.inflight.PubComp(id) // nolint: gosec
+		}
+		c.drain()
+		return nil
+	}
+
+	pubRel := packet.NewPubRelControlPacket(id)
+	if _, err := c.session.inflight.PubRec(id); err == packet.ErrPacketIDNotFound && int(c.protocolLevel) == 5 {
+		pubRel.VariableHeader.ReasonCode = packet.ReasonCodePacketIdentifierNotFound
+	}
+	c.send(pubRel)
+	return nil
+}
+
+func (c *client) OnPubRel(p *packet.PubRelControlPacket) error {
+	id := p.VariableHeader.PacketID
+	pubComp := packet.NewPubCompControlPacket(id)
+	if _, err := c.session.inflight.PubRel(id); err == packet.ErrPacketIDNotFound && int(c.protocolLevel) == 5 {
+		pubComp.VariableHeader.ReasonCode = packet.ReasonCodePacketIdentifierNotFound
+	}
+	c.send(pubComp)
+	return nil
+}
+
+func (c *client) OnPubComp(p *packet.PubCompControlPacket) error {
+	if _, err := c.session.inflight.PubComp(p.VariableHeader.PacketID); err != nil {
+		c.server.logf("broker: PUBCOMP from %q: %v", c.id, err)
+	}
+	c.drain()
+	return nil
+}
+
+func (c *client) OnAuth(p *packet.AuthControlPacket) error {
+	props := p.VariableHeader.AuthProperties
+	if props.AuthenticationMethod != c.authMethod {
+		return &packet.ProtocolError{ReasonCode: packet.ReasonCodeProtocolError, Message: "AUTH with different authentication method"}
+	}
+	switch p.VariableHeader.ReasonCode {
+	case packet.ReasonCodeContinueAuthentication:
+		if c.auth == nil {
+			return &packet.ProtocolError{ReasonCode: packet.ReasonCodeProtocolError, Message: "Unexpected AUTH"}
+		}
+	case packet.ReasonCodeReAuthenticate:
+		if !c.connected || c.auth != nil {
+			return &packet.ProtocolError{ReasonCode: packet.ReasonCodeProtocolError, Message: "Unexpected re-authentication"}
+		}
+		req := c.authRequest(c.id, c.userName, nil)
+		c.auth = c.server.EnhancedAuthenticators[c.authMethod].Start(req)
+	default:
+		return &packet.ProtocolError{ReasonCode: packet.ReasonCodeProtocolError, Message: fmt.Sprintf("AUTH with reason code 0x%02x", p.VariableHeader.ReasonCode)}
+	}
+	return c.continueAuth(props.AuthenticationData)
+}
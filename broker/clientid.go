@@ -0,0 +1,77 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ClientIDGenerator generates the client IDs of clients connecting with an
+// empty client ID.
+type ClientIDGenerator interface {
+	// GenerateClientID returns a new client ID. It is called with the
+	// Server's mutex held and must not call back into the Server. IDs that
+	// are already in use are made unique by the Server.
+	GenerateClientID() string
+}
+
+type randomClientIDGenerator struct {
+	prefix string
+}
+
+// NewRandomClientIDGenerator returns a generator of client IDs made of
+// prefix and 128 random bits in hex.
+func NewRandomClientIDGenerator(prefix string) ClientIDGenerator {
+	return randomClientIDGenerator{prefix: prefix}
+}
+
+func (g randomClientIDGenerator) GenerateClientID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b) // nolint: gosec
+	return g.prefix + hex.EncodeToString(b)
+}
+
+// defaultClientIDGenerator is used when the ClientIDGenerator of the Server
+// returns an invalid ID.
+var defaultClientIDGenerator = NewRandomClientIDGenerator("auto-")
+
+// validClientID reports whether id may be used as a client ID. It must be a
+// well-formed UTF-8 string without null characters.
+func validClientID(id string) bool {
+	return utf8.ValidString(id) && !strings.ContainsRune(id, 0)
+}
+
+// assignClientID returns a new client ID that isn't used by any session. It
+// must be called with the mutex of the Server held.
+func (s *Server) assignClientID() string {
+	id := s.ClientIDGenerator.GenerateClientID()
+	if id == "" || !validClientID(id) {
+		id = defaultClientIDGenerator.GenerateClientID()
+	}
+	unique := id
+	for n := 1; ; n++ {
+		if _, ok := s.sessions[unique]; !ok {
+			return unique
+		}
+		unique = id + "-" + strconv.Itoa(n)
+	}
+}
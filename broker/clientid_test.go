@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fixedClientIDGenerator string
+
+func (g fixedClientIDGenerator) GenerateClientID() string {
+	return string(g)
+}
+
+// connectRefused sends the CONNECT and returns the reason code of the
+// CONNACK.
+func connectRefused(t *testing.T, s *Server, connect []byte) byte {
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(server)
+
+	_, err := client.Write(connect)
+	require.NoError(t, err)
+	packetType, body := readRaw(t, client)
+	require.Equal(t, byte(packet.CONNACK), packetType)
+	return body[1]
+}
+
+func TestAssignedClientID(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	client, _ := connectRaw(t, s, connectPacket("", 4))
+	defer client.Close()
+	s.mu.Lock()
+	for id := range s.sessions {
+		assert.True(t, strings.HasPrefix(id, "auto-"), id)
+	}
+	assert.Len(t, s.sessions, 1)
+	s.mu.Unlock()
+}
+
+func TestAssignedClientIDUnique(t *testing.T) {
+	s := NewServer()
+	s.ClientIDGenerator = fixedClientIDGenerator("id")
+	defer s.Shutdown(context.Background())
+
+	for _, id := range []string{"id", "id-1"} {
+		client, connAck := connectRaw(t, s, connectPacketWithFlags("", 5, 0, nil))
+		defer client.Close()
+		assigned := append([]byte{packet.ASSIGNED_CLIENT_ID}, mqttString(id)...)
+		assert.True(t, bytes.Contains(connAck, assigned), "%v", connAck)
+		exists, online := sessionState(s, id)
+		assert.True(t, exists && online)
+	}
+}
+
+func TestInvalidClientID(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	assert.Equal(t, packet.ConnAckIdentifierRejected, connectRefused(t, s, connectPacketWithFlags("", 4, 0, nil)),
+		"MQTT 3.1.1 without clean session")
+	assert.Equal(t, packet.ConnAckIdentifierRejected, connectRefused(t, s, connectPacket("", 3)), "MQTT 3.1")
+	assert.Equal(t, packet.ReasonCodeClientIdentifierNotValid, connectRefused(t, s, connectPacket("a\x00b", 5)))
+	assert.Equal(t, packet.ReasonCodeClientIdentifierNotValid, connectRefused(t, s, connectPacket("\xff", 5)))
+}
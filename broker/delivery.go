@@ -0,0 +1,225 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// outgoingMessage is a message routed to a subscriber, waiting to be sent
+// if it can't be sent right away. qos and retain are the values for the
+// outgoing PUBLISH.
+type outgoingMessage struct {
+	publish *packet.PublishControlPacket
+	qos     packet.QosLevel
+	retain  bool
+
+	// shareFilter is the shared subscription the message was routed
+	// through, empty for regular subscriptions
+	shareFilter string
+	publisherID string
+
+	// expiresAt is computed from the Message Expiry Interval when the
+	// message arrived, zero if it never expires
+	expiresAt time.Time
+}
+
+// newOutgoingMessage prepares p for a subscriber. The QoS is the lower of
+// the PUBLISH and the subscription. retained is set for retained messages
+// sent because of a new subscription, otherwise the RETAIN flag is only
+// kept if the subscription has Retain As Published set.
+func newOutgoingMessage(p *packet.PublishControlPacket, sub packet.Subscription, retained bool, publisherID string, expiresAt time.Time) outgoingMessage {
+	m := outgoingMessage{
+		publish:     p,
+		qos:         p.FixedHeaderFlags.QoS,
+		retain:      retained || (sub.RetainAsPublished && p.FixedHeaderFlags.Retain),
+		publisherID: publisherID,
+		expiresAt:   expiresAt,
+	}
+	if sub.QoS < m.qos {
+		m.qos = sub.QoS
+	}
+	if isSharedFilter(sub.Topic) {
+		m.shareFilter = sub.Topic
+	}
+	return m
+}
+
+// outgoingPublish builds the PUBLISH sent to a subscriber. The packet ID is
+// assigned when the message is sent. The Message Expiry Interval is reduced
+// by the time the message has spent in the server.
+func outgoingPublish(m outgoingMessage, protocolLevel byte) *packet.PublishControlPacket {
+	p := m.publish
+	out := packet.NewPublish(p.VariableHeader.Topic, 0, p.Payload, protocolLevel)
+	out.FixedHeaderFlags.QoS = m.qos
+	out.FixedHeaderFlags.Retain = m.retain
+	out.VariableHeader.PublishProperties = p.VariableHeader.PublishProperties
+	// Topic aliases are negotiated per connection
+	out.VariableHeader.PublishProperties.TopicAlias = 0
+	if !m.expiresAt.IsZero() {
+		out.VariableHeader.PublishProperties.MessageExpiryInterval = remainingSeconds(m.expiresAt, time.Now())
+	}
+	return out
+}
+
+// remainingSeconds returns the whole seconds left until expiresAt, rounded
+// up so that a message that hasn't expired is never sent with an interval of
+// 0, which would mean it doesn't expire.
+func remainingSeconds(expiresAt, now time.Time) int {
+	remaining := expiresAt.Sub(now)
+	seconds := int((remaining + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// deliver sends a message to the client. It runs in the goroutine of the
+// publisher and never blocks on the client. QoS 0 messages are dropped if
+// the outgoing queue is full. QoS 1 and QoS 2 messages are queued in the
+// session if the client has too many messages in flight or the outgoing
+// queue is full, and never overtake queued messages. Expired messages are
+// dropped.
+func (c *client) deliver(m outgoingMessage) {
+	if expired(m.expiresAt, time.Now()) {
+		return
+	}
+	sess := c.session
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if m.qos == packet.QoSLevelNone {
+		c.trySend(outgoingPublish(m, c.protocolLevel))
+		return
+	}
+	if len(sess.resend) > 0 || len(sess.pending) > 0 || !c.sendTracked(m) {
+		c.server.enqueue(sess, m)
+	}
+}
+
+// sendTracked assigns a packet ID to a QoS 1 or QoS 2 message and queues
+// it without blocking. It reports false if no more messages may be in flight
+// or the outgoing queue is full, the writer then drains the session queue
+// once it has made room. It must be called with the mutex of the session
+// held.
+func (c *client) sendTracked(m outgoingMessage) bool {
+	out := outgoingPublish(m, c.protocolLevel)
+	id, err := c.session.inflight.Send(out)
+	if err != nil {
+		return false
+	}
+	// If the client goes away before the message has been written, it is
+	// sent again when the session is resumed
+	if !c.queue(out) {
+		c.untrack(id, m.qos)
+		return false
+	}
+	if m.shareFilter != "" {
+		c.session.sharedInflight[id] = m
+	}
+	return true
+}
+
+// queue queues p without blocking. If the outgoing queue is full, it sets
+// stalled so that the writer drains the session queue once it has made
+// room, and reports false.
+func (c *client) queue(p io.WriterTo) bool {
+	if c.trySend(p) {
+		return true
+	}
+	// Retry after setting stalled, in case the writer made room before it
+	// could see the flag
+	atomic.StoreInt32(&c.stalled, 1)
+	if !c.trySend(p) {
+		return false
+	}
+	atomic.CompareAndSwapInt32(&c.stalled, 1, 0)
+	return true
+}
+
+// untrack releases the packet ID of a message that was never queued.
+func (c *client) untrack(id uint16, qos packet.QosLevel) {
+	if qos == packet.QoSLevelExactlyOnce {
+		_, _ = c.session.inflight.PubRec(id)  // nolint: gosec
+		_, _ = c.session.inflight.PubComp(id) // nolint: gosec
+		return
+	}
+	_, _ = c.session.inflight.PubAck(id) // nolint: gosec
+}
+
+// drain sends queued messages as long as the client may receive them,
+// dropping those that have expired while waiting.
+func (c *client) drain() {
+	sess := c.session
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	c.drainLocked()
+}
+
+func (c *client) drainLocked() {
+	sess := c.session
+	for len(sess.resend) > 0 {
+		if !c.queue(sess.resend[0]) {
+			return
+		}
+		sess.resend[0] = nil
+		sess.resend = sess.resend[1:]
+	}
+	now := time.Now()
+	for len(sess.pending) > 0 {
+		if m := sess.pending[0]; !expired(m.expiresAt, now) && !c.sendTracked(m) {
+			return
+		}
+		sess.pending[0] = outgoingMessage{}
+		sess.pending = sess.pending[1:]
+	}
+}
+
+// acknowledged is called when the client has received the message with
+// packet ID id, it can't be passed to another member of a shared
+// subscription anymore.
+func (c *client) acknowledged(id uint16) {
+	sess := c.session
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	delete(sess.sharedInflight, id)
+}
+
+// resumeLocked sends the messages in flight of a resumed session again,
+// PUBLISH packets with DUP set, followed by the queued messages. Like
+// deliver it never blocks, packets that don't fit into the outgoing queue
+// are sent by the writer once it has made room. It must be called with the
+// mutex of the session held.
+func (c *client) resumeLocked() {
+	sess := c.session
+	sess.resend = nil
+	for _, m := range sess.inflight.Outbound() {
+		switch m.State {
+		case packet.AwaitingPubAck, packet.AwaitingPubRec:
+			m.Publish.FixedHeaderFlags.Dup = true
+			m.Publish.ProtocolLevel = c.protocolLevel
+			sess.resend = append(sess.resend, m.Publish)
+		case packet.AwaitingPubComp:
+			sess.resend = append(sess.resend, packet.NewPubRelControlPacket(m.PacketID))
+		}
+	}
+	c.drainLocked()
+}
@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeExpiringPublish(t *testing.T, c net.Conn, payload string, interval int) {
+	p, err := packet.BuildPublish("a", []byte(payload), 5,
+		packet.WithQoS(packet.QoSLevelAtLeastOnce), packet.WithPacketID(1),
+		packet.WithPublishProperties(packet.PublishProperties{MessageExpiryInterval: interval}))
+	require.NoError(t, err)
+	_, err = p.WriteTo(c)
+	require.NoError(t, err)
+	packetType, _ := readRaw(t, c)
+	require.Equal(t, byte(packet.PUBACK), packetType)
+}
+
+// offlineSubscriber leaves a session with a QoS 1 subscription to "a".
+func offlineSubscriber(t *testing.T, s *Server) []byte {
+	connect := connectPacketWithFlags("sub", 5, 0, []byte{packet.SESSION_EXPIRY_INTERVAL_ID, 0, 0, 0, 60})
+	subscriber, _ := connectRaw(t, s, connect)
+	subscribe(t, subscriber, "a", 1, 5)
+	require.NoError(t, subscriber.Close())
+	waitFor(t, func() bool {
+		_, online := sessionState(s, "sub")
+		return !online
+	})
+	return connect
+}
+
+func TestRemainingSeconds(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, 10, remainingSeconds(now.Add(10*time.Second), now))
+	assert.Equal(t, 10, remainingSeconds(now.Add(9500*time.Millisecond), now))
+	assert.Equal(t, 1, remainingSeconds(now, now))
+}
+
+func TestMessageExpiryOfflineQueue(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+	reconnect := offlineSubscriber(t, s)
+
+	publisher := connect(t, s, "pub", 5)
+	defer publisher.Close()
+	writeExpiringPublish(t, publisher, "expired", 1)
+	writeExpiringPublish(t, publisher, "forever", 0)
+	writeExpiringPublish(t, publisher, "later", 60)
+
+	s.mu.Lock()
+	sess := s.sessions["sub"]
+	s.mu.Unlock()
+	sess.mu.Lock()
+	require.Len(t, sess.pending, 3)
+	sess.pending[0].expiresAt = time.Now()
+	sess.pending[2].expiresAt = time.Now().Add(30 * time.Second)
+	sess.mu.Unlock()
+
+	subscriber, _ := connectRaw(t, s, reconnect)
+	defer subscriber.Close()
+	p := readPublish(t, subscriber, 5)
+	assert.Equal(t, []byte("forever"), p.Payload)
+	assert.Equal(t, 0, p.VariableHeader.PublishProperties.MessageExpiryInterval)
+	p = readPublish(t, subscriber, 5)
+	assert.Equal(t, []byte("later"), p.Payload)
+	assert.Equal(t, 30, p.VariableHeader.PublishProperties.MessageExpiryInterval, "interval decremented")
+}
+
+func TestMessageExpiryRetained(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	p, err := packet.BuildPublish("a", []byte("x"), 5, packet.WithRetain(true),
+		packet.WithPublishProperties(packet.PublishProperties{MessageExpiryInterval: 60}))
+	require.NoError(t, err)
+	s.retained.Set(p)
+	s.retained.root.children["a"].message.ExpiresAt = time.Now().Add(20 * time.Second)
+
+	subscriber := connect(t, s, "sub", 5)
+	defer subscriber.Close()
+	subscribe(t, subscriber, "a", 0, 5)
+	received := readPublish(t, subscriber, 5)
+	assert.Equal(t, 20, received.VariableHeader.PublishProperties.MessageExpiryInterval)
+}
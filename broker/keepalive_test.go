@@ -0,0 +1,52 @@
+package broker
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerKeepAliveBounds(t *testing.T) {
+	s := NewServer()
+	s.MinKeepAlive = 10 * time.Second
+	s.MaxKeepAlive = time.Minute
+	for _, tc := range []struct {
+		requested, expected int
+	}{
+		{30, 30},
+		{5, 10},
+		{120, 60},
+		{0, 60},
+	} {
+		keepAlive, overridden := s.keepAlive(tc.requested)
+		assert.Equal(t, tc.expected, keepAlive, "requested %v", tc.requested)
+		assert.Equal(t, tc.expected != tc.requested, overridden)
+	}
+
+	s.MaxKeepAlive = 0
+	keepAlive, overridden := s.keepAlive(0)
+	assert.Equal(t, 0, keepAlive)
+	assert.False(t, overridden)
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	s := NewServer()
+	s.MaxKeepAlive = time.Second
+	defer s.Shutdown(context.Background())
+
+	client, connAck := connectRaw(t, s, connectPacket("c", 5))
+	defer client.Close()
+	assert.Equal(t, []byte{0, 0, 5, packet.SERVER_KEEP_ALIVE_ID, 0, 1, packet.SHARED_SUBSCRIPTION_AVAILABLE_ID, 1}, connAck)
+
+	// Nothing is sent for one and a half times the keep alive
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(3*time.Second)))
+	header := make([]byte, 3)
+	_, err := io.ReadFull(client, header)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{packet.DISCONNECT << 4, 1, packet.ReasonCodeKeepAliveTimeout}, header)
+}
@@ -0,0 +1,493 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV1Prefix and proxyV2Signature start PROXY protocol version 1 and 2
+// headers.
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// PROXY protocol version 2 TLV types
+const (
+	pp2TypeALPN      = 0x01
+	pp2TypeAuthority = 0x02
+	pp2TypeSSL       = 0x20
+
+	pp2SubtypeSSLVersion = 0x21
+	pp2SubtypeSSLCN      = 0x22
+	pp2SubtypeSSLCipher  = 0x23
+	pp2SubtypeSSLSigAlg  = 0x24
+	pp2SubtypeSSLKeyAlg  = 0x25
+
+	pp2ClientSSL      = 0x01
+	pp2ClientCertConn = 0x02
+	pp2ClientCertSess = 0x04
+)
+
+// maxProxyV1HeaderLength is the length of the longest version 1 header,
+// including CRLF.
+const maxProxyV1HeaderLength = 107
+
+// ProxyConfig configures a listener accepting connections through proxies
+// sending the PROXY protocol, see NewProxyListener.
+type ProxyConfig struct {
+	// TrustedProxies are the networks of the proxies. Their connections must
+	// start with a PROXY protocol header, version 1 or 2. Connections from
+	// other addresses are served as they are.
+	TrustedProxies []*net.IPNet
+	// HeaderTimeout limits reading the header, 0 means 10 seconds.
+	HeaderTimeout time.Duration
+	// TLS, if not nil, serves TLS on all connections, after the header for
+	// those of trusted proxies.
+	TLS *tls.Config
+}
+
+// ParseTrustedProxies parses networks in CIDR notation, like
+// "10.0.0.0/8", or single IP addresses for ProxyConfig.TrustedProxies.
+func ParseTrustedProxies(networks ...string) ([]*net.IPNet, error) {
+	var parsed []*net.IPNet
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("broker: Invalid IP address %q", network)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed, nil
+}
+
+// ProxyInfo is the information a proxy sent in the PROXY protocol header.
+type ProxyInfo struct {
+	// SourceAddr is the address of the client, it is also returned by the
+	// RemoteAddr method of the connection.
+	SourceAddr net.Addr
+	// DestinationAddr is the address the proxy accepted the connection on.
+	DestinationAddr net.Addr
+	// ProxyAddr is the address of the proxy.
+	ProxyAddr net.Addr
+	// Authority is the host name the client asked for, e.g. with TLS SNI.
+	// Version 2 only.
+	Authority string
+	// ALPN is the application protocol negotiated. Version 2 only.
+	ALPN string
+	// TLS is set if the client connected to the proxy with TLS. Version 2
+	// only.
+	TLS *ProxyTLS
+}
+
+// ProxyTLS describes the TLS connection between the client and the proxy.
+type ProxyTLS struct {
+	// ClientCertificate reports whether the client presented a
+	// certificate, Verified whether the proxy verified it successfully.
+	ClientCertificate bool
+	Verified          bool
+	// Version is the TLS version, like "TLSv1.3".
+	Version string
+	// CommonName is the common name of the subject of the client
+	// certificate.
+	CommonName         string
+	Cipher             string
+	SignatureAlgorithm string
+	KeyAlgorithm       string
+}
+
+type proxyListener struct {
+	net.Listener
+	config ProxyConfig
+}
+
+// NewProxyListener returns a listener reading the PROXY protocol header of
+// the connections accepted by l from trusted proxies. ServeConn reads the
+// header before serving the connection, within HeaderTimeout, other users
+// of the connection with the first Read. Its source address is returned by
+// RemoteAddr and its information is passed to authentication and hooks.
+// Connections with an invalid header are closed. For TLS, set the TLS of
+// config rather than using tls.NewListener, the information of the header
+// is not available through a tls.Conn.
+func NewProxyListener(l net.Listener, config ProxyConfig) net.Listener {
+	if config.HeaderTimeout == 0 {
+		config.HeaderTimeout = 10 * time.Second
+	}
+	return &proxyListener{Listener: l, config: config}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(conn.RemoteAddr()) {
+		if l.config.TLS != nil {
+			return tls.Server(conn, l.config.TLS), nil
+		}
+		return conn, nil
+	}
+	proxy := &proxyConn{Conn: conn, r: bufio.NewReader(conn), timeout: l.config.HeaderTimeout}
+	if l.config.TLS != nil {
+		return &proxyTLSConn{Conn: tls.Server(proxy, l.config.TLS), proxy: proxy}, nil
+	}
+	return proxy, nil
+}
+
+func (l *proxyListener) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.config.TrustedProxies {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection from a trusted proxy. The header is read by
+// readHeader, called by ServeConn, or else by the first Read.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once sync.Once
+	err  error // set by once
+
+	mu   sync.Mutex
+	info *ProxyInfo
+}
+
+// readHeader reads the header unless it has been read. It must be called
+// before the connection is used by others: the read deadline is set to
+// limit reading the header and cleared afterwards.
+func (c *proxyConn) readHeader() error {
+	c.readHeaderOnce(true)
+	return c.err
+}
+
+func (c *proxyConn) readHeaderOnce(withTimeout bool) {
+	c.once.Do(func() {
+		if withTimeout {
+			if c.err = c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); c.err != nil {
+				return
+			}
+		}
+		info, err := readProxyHeader(c.r)
+		if err != nil {
+			c.err = fmt.Errorf("broker: Invalid PROXY protocol header from %v: %v", c.Conn.RemoteAddr(), err)
+			return
+		}
+		if info != nil {
+			info.ProxyAddr = c.Conn.RemoteAddr()
+		}
+		c.mu.Lock()
+		c.info = info
+		c.mu.Unlock()
+		if withTimeout {
+			c.err = c.Conn.SetReadDeadline(time.Time{})
+		}
+	})
+}
+
+// Read reads the header first if readHeader hasn't been called, within
+// the read deadline set by the caller.
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeaderOnce(false)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client, or of the proxy if the
+// header has no addresses or hasn't been read yet.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if info := c.ProxyInfo(); info != nil {
+		return info.SourceAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if info := c.ProxyInfo(); info != nil {
+		return info.DestinationAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxyInfo returns the information of the header, nil if the header has
+// no addresses, e.g. for health checks of the proxy, or hasn't been read
+// yet.
+func (c *proxyConn) ProxyInfo() *ProxyInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+// proxyTLSConn is a TLS connection over a proxyConn, which is kept for
+// unwrapProxyConn.
+type proxyTLSConn struct {
+	*tls.Conn
+	proxy *proxyConn
+}
+
+// unwrapProxyConn returns the proxyConn conn is or wraps, nil if there is
+// none.
+func unwrapProxyConn(conn net.Conn) *proxyConn {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *proxyConn:
+			return c
+		case *proxyTLSConn:
+			return c.proxy
+		case *webSocketConn:
+			conn = c.ws.UnderlyingConn()
+		case *tlsWebSocketConn:
+			conn = c.tls
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// proxyInfo returns the ProxyInfo of conn or of the connection it wraps.
+func proxyInfo(conn net.Conn) *ProxyInfo {
+	if proxy := unwrapProxyConn(conn); proxy != nil {
+		return proxy.ProxyInfo()
+	}
+	return nil
+}
+
+// readProxyHeader reads a version 1 or 2 header. It returns nil if the
+// header has no addresses.
+func readProxyHeader(r *bufio.Reader) (*ProxyInfo, error) {
+	// Only as many bytes as both versions have are peeked, the shortest
+	// version 1 header "PROXY UNKNOWN\r\n" is shorter than the version 2
+	// signature
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1Header(r)
+	}
+	if bytes.Equal(prefix, proxyV2Signature[:len(prefix)]) {
+		signature, err := r.Peek(len(proxyV2Signature))
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(signature, proxyV2Signature) {
+			return readProxyV2Header(r)
+		}
+	}
+	return nil, errors.New("No PROXY protocol header")
+}
+
+func readProxyV1Header(r *bufio.Reader) (*ProxyInfo, error) {
+	var line []byte
+	for len(line) < maxProxyV1HeaderLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("Version 1 header too long")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Malformed version 1 header %q", line)
+	}
+	source, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	destination, err := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyInfo{SourceAddr: source, DestinationAddr: destination}, nil
+}
+
+func parseProxyV1Addr(protocol, ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil || (addr.IP.To4() != nil) != (protocol == "TCP4") {
+		return nil, fmt.Errorf("Invalid %s address %q", protocol, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %q", port)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (*ProxyInfo, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0xf {
+	case 0:
+		// LOCAL: the proxy's own connection, e.g. a health check
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("Unsupported command %d", versionCommand&0xf)
+	}
+
+	var (
+		info     ProxyInfo
+		addrSize int
+	)
+	switch family {
+	case 0x11:
+		addrSize = 2*net.IPv4len + 4
+	case 0x21:
+		addrSize = 2*net.IPv6len + 4
+	default:
+		// UNSPEC, UDP and Unix domain socket addresses are not used
+		return nil, nil
+	}
+	if len(body) < addrSize {
+		return nil, errors.New("Version 2 addresses truncated")
+	}
+	ipLen := (addrSize - 4) / 2
+	info.SourceAddr = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	info.DestinationAddr = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	if err := parseProxyTLVs(body[addrSize:], &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// forEachTLV calls f for the type-length-value entries of b.
+func forEachTLV(b []byte, f func(typ byte, value []byte)) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return errors.New("Truncated TLV")
+		}
+		length := int(binary.BigEndian.Uint16(b[1:]))
+		if len(b) < 3+length {
+			return errors.New("Truncated TLV")
+		}
+		f(b[0], b[3:3+length])
+		b = b[3+length:]
+	}
+	return nil
+}
+
+func parseProxyTLVs(b []byte, info *ProxyInfo) error {
+	var sslErr error
+	err := forEachTLV(b, func(typ byte, value []byte) {
+		switch typ {
+		case pp2TypeALPN:
+			info.ALPN = string(value)
+		case pp2TypeAuthority:
+			info.Authority = string(value)
+		case pp2TypeSSL:
+			info.TLS, sslErr = parseProxySSL(value)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sslErr
+}
+
+// parseProxySSL parses the value of a PP2_TYPE_SSL TLV, it returns nil if
+// the client didn't use TLS.
+func parseProxySSL(value []byte) (*ProxyTLS, error) {
+	if len(value) < 5 {
+		return nil, errors.New("Truncated SSL TLV")
+	}
+	client, verify := value[0], binary.BigEndian.Uint32(value[1:])
+	if client&pp2ClientSSL == 0 {
+		return nil, nil
+	}
+	t := &ProxyTLS{ClientCertificate: client&(pp2ClientCertConn|pp2ClientCertSess) != 0}
+	t.Verified = t.ClientCertificate && verify == 0
+	err := forEachTLV(value[5:], func(typ byte, value []byte) {
+		switch typ {
+		case pp2SubtypeSSLVersion:
+			t.Version = string(value)
+		case pp2SubtypeSSLCN:
+			t.CommonName = string(value)
+		case pp2SubtypeSSLCipher:
+			t.Cipher = string(value)
+		case pp2SubtypeSSLSigAlg:
+			t.SignatureAlgorithm = string(value)
+		case pp2SubtypeSSLKeyAlg:
+			t.KeyAlgorithm = string(value)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
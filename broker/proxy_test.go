@@ -0,0 +1,280 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tlv(typ byte, value []byte) []byte {
+	b := []byte{typ, byte(len(value) >> 8), byte(len(value))}
+	return append(b, value...)
+}
+
+// proxyV2Header builds a version 2 PROXY header for TCP over IPv4.
+func proxyV2Header(command byte, source, destination *net.TCPAddr, tlvs ...[]byte) []byte {
+	body := append(append([]byte(nil), source.IP.To4()...), destination.IP.To4()...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, uint16(source.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(destination.Port))
+	body = append(body, ports...)
+	for _, t := range tlvs {
+		body = append(body, t...)
+	}
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|command, 0x11, byte(len(body)>>8), byte(len(body)))
+	return append(header, body...)
+}
+
+func readHeaderString(header string) (*ProxyInfo, error) {
+	return readProxyHeader(bufio.NewReader(strings.NewReader(header)))
+}
+
+func TestReadProxyV1Header(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.168.0.1 192.168.0.11 56324 1883\r\nCONNECT"))
+	info, err := readProxyHeader(r)
+	require.NoError(t, err)
+	assert.Equal(t, "192.168.0.1:56324", info.SourceAddr.String())
+	assert.Equal(t, "192.168.0.11:1883", info.DestinationAddr.String())
+	rest, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "CONNECT", string(rest), "bytes after the header are kept")
+
+	info, err = readHeaderString("PROXY TCP6 2001:db8::1 2001:db8::2 4000 1883\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:4000", info.SourceAddr.String())
+
+	info, err = readHeaderString("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n")
+	assert.NoError(t, err)
+	assert.Nil(t, info)
+
+	// The shortest header, with nothing following it until the Server
+	// answers
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go client.Write([]byte("PROXY UNKNOWN\r\n")) // nolint: errcheck
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(time.Second)))
+	info, err = readProxyHeader(bufio.NewReader(server))
+	assert.NoError(t, err)
+	assert.Nil(t, info)
+
+	for _, invalid := range []string{
+		"GET / HTTP/1.1\r\n",
+		"\r\n\r\n\x00\r\nQUIT\r",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.168.0.11 56324 1883\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 70000\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 1883\n",
+		"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n",
+	} {
+		_, err = readHeaderString(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestReadProxyV2Header(t *testing.T) {
+	source := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+	destination := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8883}
+	ssl := append([]byte{pp2ClientSSL | pp2ClientCertConn, 0, 0, 0, 0},
+		tlv(pp2SubtypeSSLVersion, []byte("TLSv1.3"))...)
+	ssl = append(ssl, tlv(pp2SubtypeSSLCN, []byte("device-1"))...)
+	ssl = append(ssl, tlv(pp2SubtypeSSLCipher, []byte("TLS_AES_128_GCM_SHA256"))...)
+	header := proxyV2Header(1, source, destination,
+		tlv(pp2TypeALPN, []byte("mqtt")),
+		tlv(pp2TypeAuthority, []byte("broker.example.com")),
+		tlv(0xe0, []byte("custom")),
+		tlv(pp2TypeSSL, ssl))
+
+	info, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header)))
+	require.NoError(t, err)
+	assert.Equal(t, source.String(), info.SourceAddr.String())
+	assert.Equal(t, destination.String(), info.DestinationAddr.String())
+	assert.Equal(t, "mqtt", info.ALPN)
+	assert.Equal(t, "broker.example.com", info.Authority)
+	assert.Equal(t, &ProxyTLS{
+		ClientCertificate: true,
+		Verified:          true,
+		Version:           "TLSv1.3",
+		CommonName:        "device-1",
+		Cipher:            "TLS_AES_128_GCM_SHA256",
+	}, info.TLS)
+
+	info, err = readProxyHeader(bufio.NewReader(bytes.NewReader(proxyV2Header(0, source, destination))))
+	assert.NoError(t, err)
+	assert.Nil(t, info, "LOCAL command")
+
+	_, err = readProxyHeader(bufio.NewReader(bytes.NewReader(header[:len(header)-1])))
+	assert.Error(t, err)
+	truncated := proxyV2Header(1, source, destination, []byte{pp2TypeALPN, 0, 9, 'x'})
+	_, err = readProxyHeader(bufio.NewReader(bytes.NewReader(truncated)))
+	assert.Error(t, err)
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := ParseTrustedProxies("10.0.0.0/8", "192.168.1.1", "2001:db8::/32")
+	require.NoError(t, err)
+	require.Len(t, networks, 3)
+	assert.True(t, networks[0].Contains(net.ParseIP("10.1.2.3")))
+	assert.True(t, networks[1].Contains(net.ParseIP("192.168.1.1")))
+	assert.False(t, networks[1].Contains(net.ParseIP("192.168.1.2")))
+	assert.True(t, networks[2].Contains(net.ParseIP("2001:db8::7")))
+
+	_, err = ParseTrustedProxies("proxy")
+	assert.Error(t, err)
+	_, err = ParseTrustedProxies("10.0.0.0/33")
+	assert.Error(t, err)
+}
+
+// serveProxied serves s on a local listener accepting the PROXY protocol
+// from trusted and returns its address.
+func serveProxied(t *testing.T, s *Server, trusted ...string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	networks, err := ParseTrustedProxies(trusted...)
+	require.NoError(t, err)
+	go s.Serve(NewProxyListener(l, ProxyConfig{TrustedProxies: networks}))
+	return l.Addr().String()
+}
+
+func TestProxyListener(t *testing.T) {
+	requests := make(chan AuthRequest, 1)
+	connected := make(chan ClientInfo, 1)
+	s := NewServer()
+	s.Authenticator = authenticatorFunc(func(req AuthRequest) error {
+		requests <- req
+		return nil
+	})
+	s.Hooks.OnConnect = func(info ClientInfo) { connected <- info }
+	defer s.Shutdown(context.Background())
+
+	addr := serveProxied(t, s, "127.0.0.0/8")
+	client, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write(append([]byte("PROXY TCP4 198.51.100.4 10.0.0.1 50000 1883\r\n"), connectPacket("c", 4)...))
+	require.NoError(t, err)
+	_, body := readRaw(t, client)
+	assert.Equal(t, packet.ConnAckAccepted, body[1])
+
+	req := <-requests
+	assert.Equal(t, "198.51.100.4:50000", req.RemoteAddr.String())
+	require.NotNil(t, req.Proxy)
+	assert.Equal(t, client.LocalAddr().String(), req.Proxy.ProxyAddr.String())
+	info := <-connected
+	assert.Equal(t, "198.51.100.4:50000", info.RemoteAddr.String())
+	assert.Equal(t, req.Proxy, info.Proxy)
+
+	// Connections from trusted proxies must start with a header
+	client, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write(connectPacket("d", 4))
+	require.NoError(t, err)
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestProxyListenerUntrusted(t *testing.T) {
+	connected := make(chan ClientInfo, 1)
+	s := NewServer()
+	s.Hooks.OnConnect = func(info ClientInfo) { connected <- info }
+	defer s.Shutdown(context.Background())
+
+	client, err := net.Dial("tcp", serveProxied(t, s, "10.0.0.0/8"))
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write(connectPacket("c", 4))
+	require.NoError(t, err)
+	_, body := readRaw(t, client)
+	assert.Equal(t, packet.ConnAckAccepted, body[1])
+	info := <-connected
+	assert.Equal(t, client.LocalAddr().String(), info.RemoteAddr.String())
+	assert.Nil(t, info.Proxy)
+}
+
+func TestProxyListenerHeaderTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	networks, err := ParseTrustedProxies("127.0.0.1")
+	require.NoError(t, err)
+	pl := NewProxyListener(l, ProxyConfig{TrustedProxies: networks, HeaderTimeout: 50 * time.Millisecond})
+	s := NewServer()
+	go s.Serve(pl)
+	defer s.Shutdown(context.Background())
+
+	// A proxy that doesn't send the header is disconnected
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestProxyConnAddrs(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &proxyConn{Conn: server, r: bufio.NewReader(server), timeout: time.Second}
+	defer conn.Close()
+
+	// Before the header the addresses of the proxy connection are returned
+	// without blocking
+	assert.Equal(t, server.RemoteAddr(), conn.RemoteAddr())
+	assert.Equal(t, server.LocalAddr(), conn.LocalAddr())
+	assert.Nil(t, conn.ProxyInfo())
+
+	go client.Write([]byte("PROXY TCP4 198.51.100.4 10.0.0.1 50000 1883\r\n")) // nolint: errcheck
+	require.NoError(t, conn.readHeader())
+	assert.Equal(t, "198.51.100.4:50000", conn.RemoteAddr().String())
+	assert.Equal(t, "10.0.0.1:1883", conn.LocalAddr().String())
+	assert.Equal(t, server.RemoteAddr(), conn.ProxyInfo().ProxyAddr)
+}
+
+func TestProxyListenerTLS(t *testing.T) {
+	f := newTLSFixture(t)
+	defer f.close()
+	config, err := f.config.Build()
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	networks, err := ParseTrustedProxies("127.0.0.1")
+	require.NoError(t, err)
+
+	connected := make(chan ClientInfo, 1)
+	s := NewServer()
+	s.Hooks.OnConnect = func(info ClientInfo) { connected <- info }
+	go s.Serve(NewProxyListener(l, ProxyConfig{TrustedProxies: networks, TLS: config}))
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 8883\r\n"))
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(f.ca.cert)
+	client := tls.Client(conn, &tls.Config{RootCAs: roots, ServerName: "broker"})
+	_, err = client.Write(connectPacket("c", 4))
+	require.NoError(t, err)
+	packetType, _ := readRaw(t, client)
+	assert.Equal(t, byte(packet.CONNACK), packetType)
+
+	info := <-connected
+	assert.Equal(t, "[2001:db8::1]:4000", info.RemoteAddr.String())
+	require.NotNil(t, info.Proxy)
+	assert.Equal(t, "[2001:db8::2]:8883", info.Proxy.DestinationAddr.String())
+}
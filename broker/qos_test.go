@@ -0,0 +1,345 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePublish(t *testing.T, c net.Conn, topic, payload string, qos packet.QosLevel, packetID uint16, level byte) {
+	opts := []packet.PublishOption{packet.WithQoS(qos)}
+	if qos != packet.QoSLevelNone {
+		opts = append(opts, packet.WithPacketID(packetID))
+	}
+	p, err := packet.BuildPublish(topic, []byte(payload), level, opts...)
+	require.NoError(t, err)
+	_, err = p.WriteTo(c)
+	require.NoError(t, err)
+}
+
+func readPublish(t *testing.T, c net.Conn, level byte) *packet.PublishControlPacket {
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+	received, err := packet.ReadPacket(c, level)
+	require.NoError(t, err)
+	p, ok := received.(*packet.PublishControlPacket)
+	require.True(t, ok, "%v", received)
+	return p
+}
+
+func outboundInflight(s *Server, clientID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	outbound, _ := s.sessions[clientID].inflight.Len()
+	return outbound
+}
+
+func subscribe(t *testing.T, c net.Conn, filter string, qos byte, level byte) {
+	_, err := c.Write(subscribePacket(1, filter, qos, level))
+	require.NoError(t, err)
+	packetType, body := readRaw(t, c)
+	require.Equal(t, byte(packet.SUBACK), packetType)
+	assert.Equal(t, qos&3, body[len(body)-1], "granted QoS")
+}
+
+func TestQoS1Inbound(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	client := connect(t, s, "c", 4)
+	defer client.Close()
+	writePublish(t, client, "a", "x", packet.QoSLevelAtLeastOnce, 3, 4)
+	packetType, body := readRaw(t, client)
+	assert.Equal(t, byte(packet.PUBACK), packetType)
+	assert.Equal(t, []byte{0, 3}, body)
+}
+
+func TestQoS2InboundDuplicate(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	subscriber := connect(t, s, "sub", 4)
+	defer subscriber.Close()
+	subscribe(t, subscriber, "a", 0, 4)
+
+	publisher := connect(t, s, "pub", 4)
+	defer publisher.Close()
+	for i := 0; i < 2; i++ {
+		writePublish(t, publisher, "a", "once", packet.QoSLevelExactlyOnce, 9, 4)
+		packetType, body := readRaw(t, publisher)
+		assert.Equal(t, byte(packet.PUBREC), packetType)
+		assert.Equal(t, []byte{0, 9}, body)
+	}
+	_, err := publisher.Write([]byte{packet.PUBREL<<4 | 2, 2, 0, 9})
+	require.NoError(t, err)
+	packetType, body := readRaw(t, publisher)
+	assert.Equal(t, byte(packet.PUBCOMP), packetType)
+	assert.Equal(t, []byte{0, 9}, body)
+
+	assert.Equal(t, []byte("once"), readPublish(t, subscriber, 4).Payload)
+	_, err = subscriber.Write([]byte{packet.PINGREQ << 4, 0})
+	require.NoError(t, err)
+	packetType, _ = readRaw(t, subscriber)
+	assert.Equal(t, byte(packet.PINGRESP), packetType, "duplicate not delivered")
+}
+
+func TestQoS2UnknownPubRel(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	client := connect(t, s, "c", 5)
+	defer client.Close()
+	_, err := client.Write([]byte{packet.PUBREL<<4 | 2, 2, 0, 1})
+	require.NoError(t, err)
+	packetType, body := readRaw(t, client)
+	assert.Equal(t, byte(packet.PUBCOMP), packetType)
+	assert.Equal(t, []byte{0, 1, packet.ReasonCodePacketIdentifierNotFound}, body)
+}
+
+func TestQoSOutboundDowngrade(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	subscriber := connect(t, s, "sub", 4)
+	defer subscriber.Close()
+	subscribe(t, subscriber, "a", 1, 4)
+
+	publisher := connect(t, s, "pub", 4)
+	defer publisher.Close()
+	writePublish(t, publisher, "a", "x", packet.QoSLevelExactlyOnce, 1, 4)
+
+	p := readPublish(t, subscriber, 4)
+	assert.Equal(t, packet.QoSLevelAtLeastOnce, p.FixedHeaderFlags.QoS)
+	assert.NotZero(t, p.VariableHeader.PacketID)
+	_, err := packet.NewPubAckControlPacket(p.VariableHeader.PacketID).WriteTo(subscriber)
+	require.NoError(t, err)
+	waitFor(t, func() bool { return outboundInflight(s, "sub") == 0 })
+}
+
+func TestPublishPropertiesForwarded(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	subscriber := connect(t, s, "sub", 5)
+	defer subscriber.Close()
+	subscribe(t, subscriber, "a", 1, 5)
+
+	props := packet.PublishProperties{
+		PayloadFormatIndicator: 1,
+		ContentType:            "text/plain",
+		ResponseTopic:          "r",
+		CorrelationData:        "c",
+		UserProperties:         []packet.UserProperty{{Key: "k", Value: "1"}, {Key: "k", Value: "2"}},
+	}
+	publisher := connect(t, s, "pub", 5)
+	defer publisher.Close()
+	p, err := packet.BuildPublish("a", []byte("x"), 5, packet.WithPublishProperties(props))
+	require.NoError(t, err)
+	_, err = p.WriteTo(publisher)
+	require.NoError(t, err)
+
+	received := readPublish(t, subscriber, 5).VariableHeader.PublishProperties
+	received.PropertyLength = 0
+	assert.Equal(t, props, received)
+}
+
+func TestQoSOutboundQoS2(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	subscriber := connect(t, s, "sub", 5)
+	defer subscriber.Close()
+	subscribe(t, subscriber, "a", 2, 5)
+
+	publisher := connect(t, s, "pub", 5)
+	defer publisher.Close()
+	writePublish(t, publisher, "a", "x", packet.QoSLevelExactlyOnce, 1, 5)
+
+	p := readPublish(t, subscriber, 5)
+	require.Equal(t, packet.QoSLevelExactlyOnce, p.FixedHeaderFlags.QoS)
+	id := p.VariableHeader.PacketID
+	_, err := packet.NewPubRecControlPacket(id).WriteTo(subscriber)
+	require.NoError(t, err)
+	packetType, body := readRaw(t, subscriber)
+	assert.Equal(t, byte(packet.PUBREL), packetType)
+	assert.Equal(t, []byte{byte(id >> 8), byte(id)}, body)
+	_, err = packet.NewPubCompControlPacket(id).WriteTo(subscriber)
+	require.NoError(t, err)
+	waitFor(t, func() bool { return outboundInflight(s, "sub") == 0 })
+}
+
+func TestQoSRedeliveryWithDup(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	subscriber, _ := connectRaw(t, s, connectPacketWithFlags("sub", 4, 0, nil))
+	subscribe(t, subscriber, "a/#", 1, 4)
+
+	publisher := connect(t, s, "pub", 4)
+	defer publisher.Close()
+	for _, payload := range []string{"1", "2", "3"} {
+		writePublish(t, publisher, "a/b", payload, packet.QoSLevelAtLeastOnce, 1, 4)
+		readRaw(t, publisher)
+	}
+
+	first := readPublish(t, subscriber, 4)
+	assert.False(t, first.FixedHeaderFlags.Dup)
+	require.NoError(t, subscriber.Close())
+	waitFor(t, func() bool {
+		_, online := sessionState(s, "sub")
+		return !online
+	})
+
+	subscriber, connAck := connectRaw(t, s, connectPacketWithFlags("sub", 4, 0, nil))
+	defer subscriber.Close()
+	assert.Equal(t, byte(1), connAck[0], "session present")
+	for _, payload := range []string{"1", "2", "3"} {
+		p := readPublish(t, subscriber, 4)
+		assert.Equal(t, []byte(payload), p.Payload, "in order")
+		assert.True(t, p.FixedHeaderFlags.Dup)
+	}
+}
+
+func TestRedeliveryDoesNotBlockPublisher(t *testing.T) {
+	s := NewServer()
+	s.OutgoingQueueSize = 1
+	defer s.Shutdown(context.Background())
+
+	subscriber, _ := connectRaw(t, s, connectPacketWithFlags("sub", 4, 0, nil))
+	subscribe(t, subscriber, "a", 1, 4)
+
+	publisher := connect(t, s, "pub", 4)
+	defer publisher.Close()
+	publish := func(payload string, id uint16) {
+		writePublish(t, publisher, "a", payload, packet.QoSLevelAtLeastOnce, id, 4)
+		packetType, _ := readRaw(t, publisher)
+		require.Equal(t, byte(packet.PUBACK), packetType)
+	}
+	for i, payload := range []string{"1", "2", "3"} {
+		publish(payload, uint16(i+1))
+	}
+	require.NoError(t, subscriber.Close())
+	waitFor(t, func() bool {
+		_, online := sessionState(s, "sub")
+		return !online
+	})
+
+	// The resumed session has more packets to send again than fit into the
+	// outgoing queue, which must not block messages routed meanwhile
+	server, subscriber := net.Pipe()
+	defer subscriber.Close()
+	go s.ServeConn(server)
+	_, err := subscriber.Write(connectPacketWithFlags("sub", 4, 0, nil))
+	require.NoError(t, err)
+	waitFor(t, func() bool {
+		_, online := sessionState(s, "sub")
+		return online
+	})
+	publish("4", 4)
+
+	packetType, _ := readRaw(t, subscriber)
+	require.Equal(t, byte(packet.CONNACK), packetType)
+	for _, payload := range []string{"1", "2", "3", "4"} {
+		assert.Equal(t, []byte(payload), readPublish(t, subscriber, 4).Payload, "in order")
+	}
+}
+
+func TestReceiveMaximumOutbound(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	props := []byte{packet.RECEIVE_MAXIMUM_ID, 0, 1}
+	subscriber, _ := connectRaw(t, s, connectPacketWithFlags("sub", 5, 2, props))
+	defer subscriber.Close()
+	subscribe(t, subscriber, "a", 1, 5)
+
+	publisher := connect(t, s, "pub", 5)
+	defer publisher.Close()
+	for _, payload := range []string{"1", "2"} {
+		writePublish(t, publisher, "a", payload, packet.QoSLevelAtLeastOnce, 1, 5)
+		readRaw(t, publisher)
+	}
+
+	p := readPublish(t, subscriber, 5)
+	assert.Equal(t, []byte("1"), p.Payload)
+	require.NoError(t, subscriber.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err := subscriber.Read(make([]byte, 1))
+	assert.Error(t, err, "second message held back")
+
+	_, err = packet.NewPubAckControlPacket(p.VariableHeader.PacketID).WriteTo(subscriber)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("2"), readPublish(t, subscriber, 5).Payload)
+}
+
+func TestReceiveMaximumAdvertised(t *testing.T) {
+	s := NewServer()
+	s.ReceiveMaximum = 1
+	defer s.Shutdown(context.Background())
+
+	client, connAck := connectRaw(t, s, connectPacket("c", 5))
+	defer client.Close()
+	assert.Equal(t, []byte{0, 0, 5, packet.RECEIVE_MAXIMUM_ID, 0, 1, packet.SHARED_SUBSCRIPTION_AVAILABLE_ID, 1}, connAck)
+
+	writePublish(t, client, "a", "x", packet.QoSLevelExactlyOnce, 1, 5)
+	packetType, _ := readRaw(t, client)
+	require.Equal(t, byte(packet.PUBREC), packetType)
+	writePublish(t, client, "a", "x", packet.QoSLevelExactlyOnce, 2, 5)
+	packetType, body := readRaw(t, client)
+	assert.Equal(t, byte(packet.DISCONNECT), packetType)
+	assert.Equal(t, packet.ReasonCodeReceiveMaximumExceeded, body[0])
+}
+
+func TestReceiveMaximumZeroRefused(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	props := []byte{packet.RECEIVE_MAXIMUM_ID, 0, 0}
+	assert.Equal(t, packet.ReasonCodeProtocolError, connectRefused(t, s, connectPacketWithFlags("c", 5, 2, props)))
+	exists, _ := sessionState(s, "c")
+	assert.False(t, exists)
+}
+
+func TestReceiveMaximumIgnoresQoS1(t *testing.T) {
+	s := NewServer()
+	s.ReceiveMaximum = 1
+	defer s.Shutdown(context.Background())
+
+	client, _ := connectRaw(t, s, connectPacket("c", 5))
+	defer client.Close()
+	writePublish(t, client, "a", "x", packet.QoSLevelExactlyOnce, 1, 5)
+	packetType, _ := readRaw(t, client)
+	require.Equal(t, byte(packet.PUBREC), packetType)
+	for _, id := range []uint16{2, 3} {
+		writePublish(t, client, "a", "x", packet.QoSLevelAtLeastOnce, id, 5)
+		packetType, body := readRaw(t, client)
+		assert.Equal(t, byte(packet.PUBACK), packetType)
+		assert.Equal(t, []byte{0, byte(id)}, body[:2])
+	}
+}
+
+func TestSlowSubscriberDoesNotBlockPublisher(t *testing.T) {
+	s := NewServer()
+	s.OutgoingQueueSize = 1
+	defer s.Shutdown(context.Background())
+
+	subscriber := connect(t, s, "sub", 4)
+	defer subscriber.Close()
+	subscribe(t, subscriber, "a", 1, 4)
+
+	publisher := connect(t, s, "pub", 4)
+	defer publisher.Close()
+	payloads := []string{"1", "2", "3", "4", "5"}
+	for i, payload := range payloads {
+		writePublish(t, publisher, "a", payload, packet.QoSLevelAtLeastOnce, uint16(i+1), 4)
+		packetType, _ := readRaw(t, publisher)
+		require.Equal(t, byte(packet.PUBACK), packetType)
+	}
+
+	for _, payload := range payloads {
+		assert.Equal(t, []byte(payload), readPublish(t, subscriber, 4).Payload)
+	}
+}
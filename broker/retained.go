@@ -0,0 +1,195 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// RetainedMessage is a retained PUBLISH and the time it expires, computed
+// from its Message Expiry Interval when it was stored. ExpiresAt is zero for
+// messages that never expire.
+type RetainedMessage struct {
+	Publish   *packet.PublishControlPacket
+	ExpiresAt time.Time
+}
+
+// messageExpiry returns the time a PUBLISH arriving at arrival expires, or
+// the zero time if it has no Message Expiry Interval.
+func messageExpiry(p *packet.PublishControlPacket, arrival time.Time) time.Time {
+	interval := p.VariableHeader.PublishProperties.MessageExpiryInterval
+	if interval <= 0 {
+		return time.Time{}
+	}
+	return arrival.Add(time.Duration(interval) * time.Second)
+}
+
+// expired reports whether a message expiring at expiresAt has expired at
+// now.
+func expired(expiresAt, now time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+type retainedNode struct {
+	children map[string]*retainedNode
+	message  *RetainedMessage
+}
+
+func newRetainedNode() *retainedNode {
+	return &retainedNode{children: make(map[string]*retainedNode)}
+}
+
+// RetainedStore is a concurrency-safe store of the last retained PUBLISH per
+// topic. Like SubscriptionTree it is a trie with one level per topic level,
+// but here the topic filter is matched against the stored topics.
+type RetainedStore struct {
+	mu    sync.Mutex
+	root  *retainedNode
+	count int
+}
+
+func NewRetainedStore() *RetainedStore {
+	return &RetainedStore{root: newRetainedNode()}
+}
+
+// Set stores p as the retained message of its topic. A PUBLISH with an empty
+// payload deletes the retained message instead.
+func (s *RetainedStore) Set(p *packet.PublishControlPacket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	levels := strings.Split(p.VariableHeader.Topic, "/")
+	if len(p.Payload) == 0 {
+		s.delete(levels)
+		return
+	}
+
+	n := s.root
+	for _, level := range levels {
+		child, ok := n.children[level]
+		if !ok {
+			child = newRetainedNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+	if n.message == nil {
+		s.count++
+	}
+	n.message = &RetainedMessage{Publish: p, ExpiresAt: messageExpiry(p, time.Now())}
+}
+
+func (s *RetainedStore) delete(levels []string) {
+	path := make([]*retainedNode, 0, len(levels)+1)
+	n := s.root
+	path = append(path, n)
+	for _, level := range levels {
+		child, ok := n.children[level]
+		if !ok {
+			return
+		}
+		n = child
+		path = append(path, n)
+	}
+	if n.message == nil {
+		return
+	}
+	n.message = nil
+	s.count--
+
+	// Prune nodes without message and children
+	for i := len(levels) - 1; i >= 0; i-- {
+		node := path[i+1]
+		if node.message != nil || len(node.children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+}
+
+// Match returns the retained messages with topics matching filter. Expired
+// messages are removed instead of being returned.
+func (s *RetainedStore) Match(filter string) []RetainedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		matched []RetainedMessage
+		stale   [][]string
+		now     = time.Now()
+	)
+	var walk func(n *retainedNode, filter []string, topic []string)
+	collect := func(n *retainedNode, topic []string) {
+		if n.message == nil {
+			return
+		}
+		if expired(n.message.ExpiresAt, now) {
+			stale = append(stale, append([]string(nil), topic...))
+			return
+		}
+		matched = append(matched, *n.message)
+	}
+	walk = func(n *retainedNode, filter []string, topic []string) {
+		if len(filter) == 0 {
+			collect(n, topic)
+			return
+		}
+		switch filter[0] {
+		case "#":
+			// "#" also matches the parent level, "a/#" matches "a"
+			if len(topic) > 0 {
+				collect(n, topic)
+			}
+			for level, child := range n.children {
+				if len(topic) == 0 && strings.HasPrefix(level, "$") {
+					continue
+				}
+				walk(child, filter, append(topic, level))
+			}
+		case "+":
+			for level, child := range n.children {
+				if len(topic) == 0 && strings.HasPrefix(level, "$") {
+					continue
+				}
+				walk(child, filter[1:], append(topic, level))
+			}
+		default:
+			if child, ok := n.children[filter[0]]; ok {
+				walk(child, filter[1:], append(topic, filter[0]))
+			}
+		}
+	}
+	walk(s.root, strings.Split(filter, "/"), nil)
+
+	for _, levels := range stale {
+		s.delete(levels)
+	}
+	return matched
+}
+
+// Len returns the number of retained messages, including expired messages
+// that haven't been removed yet.
+func (s *RetainedStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
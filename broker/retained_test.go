@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func retainedPublish(t *testing.T, topic, payload string) *packet.PublishControlPacket {
+	p, err := packet.BuildPublish(topic, []byte(payload), 5, packet.WithRetain(true))
+	require.NoError(t, err)
+	return p
+}
+
+func retainedTopics(s *RetainedStore, filter string) []string {
+	var topics []string
+	for _, m := range s.Match(filter) {
+		topics = append(topics, m.Publish.VariableHeader.Topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func TestRetainedStoreMatch(t *testing.T) {
+	s := NewRetainedStore()
+	for _, topic := range []string{"a", "a/b", "a/c", "a/b/c", "$SYS/uptime"} {
+		s.Set(retainedPublish(t, topic, "x"))
+	}
+	assert.Equal(t, 5, s.Len())
+
+	assert.Equal(t, []string{"a/b"}, retainedTopics(s, "a/b"))
+	assert.Equal(t, []string{"a/b", "a/c"}, retainedTopics(s, "a/+"))
+	assert.Equal(t, []string{"a", "a/b", "a/b/c", "a/c"}, retainedTopics(s, "a/#"))
+	assert.Equal(t, []string{"a", "a/b", "a/b/c", "a/c"}, retainedTopics(s, "#"))
+	assert.Equal(t, []string{"a/b/c"}, retainedTopics(s, "+/+/c"))
+	assert.Equal(t, []string{"$SYS/uptime"}, retainedTopics(s, "$SYS/#"))
+	assert.Nil(t, retainedTopics(s, "b/#"))
+}
+
+func TestRetainedStoreReplaceAndDelete(t *testing.T) {
+	s := NewRetainedStore()
+	s.Set(retainedPublish(t, "a/b", "first"))
+	s.Set(retainedPublish(t, "a/b", "second"))
+	require.Equal(t, 1, s.Len())
+	assert.Equal(t, []byte("second"), s.Match("a/b")[0].Publish.Payload)
+
+	s.Set(retainedPublish(t, "a/b", ""))
+	assert.Equal(t, 0, s.Len())
+	assert.Empty(t, s.Match("#"))
+	assert.Empty(t, s.root.children, "empty nodes are pruned")
+}
+
+func TestRetainedStoreExpiry(t *testing.T) {
+	s := NewRetainedStore()
+	p := retainedPublish(t, "a", "x")
+	p.VariableHeader.PublishProperties.MessageExpiryInterval = 10
+	s.Set(p)
+	require.Len(t, s.Match("a"), 1)
+
+	s.root.children["a"].message.ExpiresAt = time.Now()
+	assert.Empty(t, s.Match("a"))
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestServerDeliversRetained(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	publisher := connect(t, s, "pub", 5)
+	defer publisher.Close()
+	_, err := retainedPublish(t, "a/b", "retained").WriteTo(publisher)
+	require.NoError(t, err)
+	waitFor(t, func() bool { return s.retained.Len() == 1 })
+
+	subscriber := connect(t, s, "sub", 5)
+	defer subscriber.Close()
+	_, err = subscriber.Write(subscribePacket(1, "a/+", 0, 5))
+	require.NoError(t, err)
+	packetType, _ := readRaw(t, subscriber)
+	require.Equal(t, byte(packet.SUBACK), packetType)
+	require.NoError(t, subscriber.SetReadDeadline(time.Now().Add(time.Second)))
+	received, err := packet.ReadPacket(subscriber, 5)
+	require.NoError(t, err)
+	publish, ok := received.(*packet.PublishControlPacket)
+	require.True(t, ok)
+	assert.Equal(t, []byte("retained"), publish.Payload)
+	assert.True(t, publish.FixedHeaderFlags.Retain)
+
+	// Retain Handling 2: don't send retained messages
+	_, err = subscriber.Write(subscribePacket(2, "a/#", 2<<4, 5))
+	require.NoError(t, err)
+	packetType, _ = readRaw(t, subscriber)
+	require.Equal(t, byte(packet.SUBACK), packetType)
+	_, err = subscriber.Write([]byte{packet.PINGREQ << 4, 0})
+	require.NoError(t, err)
+	packetType, _ = readRaw(t, subscriber)
+	assert.Equal(t, byte(packet.PINGRESP), packetType)
+}
@@ -0,0 +1,84 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"github.com/infinimesh/mqtt-go/scram"
+)
+
+type scramAuthenticator struct {
+	credentials map[string]scram.Credentials
+}
+
+// NewSCRAMAuthenticator returns an EnhancedAuthenticator for the
+// authentication method SCRAM-SHA-256 (scram.Method). users maps user names
+// to their salted credentials, see scram.NewCredentials. If the CONNECT has
+// a user name, it must match the one authenticated.
+func NewSCRAMAuthenticator(users map[string]scram.Credentials) EnhancedAuthenticator {
+	credentials := make(map[string]scram.Credentials, len(users))
+	for userName, c := range users {
+		credentials[userName] = c
+	}
+	return scramAuthenticator{credentials: credentials}
+}
+
+func (a scramAuthenticator) Start(req AuthRequest) AuthExchange {
+	return &scramExchange{
+		conversation: scram.NewServerConversation(a.lookup),
+		userName:     req.UserName,
+	}
+}
+
+func (a scramAuthenticator) lookup(userName string) (scram.Credentials, bool) {
+	c, ok := a.credentials[userName]
+	return c, ok
+}
+
+// scramExchange takes the client-first-message, replying with the
+// server-first-message, and the client-final-message, concluded by the
+// server-final-message.
+type scramExchange struct {
+	conversation *scram.ServerConversation
+	userName     string
+	first        bool
+}
+
+func (e *scramExchange) Next(data []byte) (reply []byte, done bool, err error) {
+	if !e.first {
+		e.first = true
+		reply, err = e.conversation.ServerFirst(data)
+		if err == nil && e.userName != "" && e.userName != e.conversation.UserName() {
+			err = ErrNotAuthorized
+		}
+	} else {
+		reply, err = e.conversation.ServerFinal(data)
+		done = true
+	}
+	switch err {
+	case nil:
+		return reply, done, nil
+	case scram.ErrMalformedMessage, scram.ErrUnknownUser, scram.ErrInvalidProof, scram.ErrOutOfOrder:
+		return nil, false, ErrBadCredentials
+	default:
+		return nil, false, err
+	}
+}
+
+func (e *scramExchange) UserName() string {
+	return e.conversation.UserName()
+}
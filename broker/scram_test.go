@@ -0,0 +1,161 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/scram"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// authConnectPacket builds an MQTT 5 CONNECT starting enhanced
+// authentication.
+func authConnectPacket(clientID, method string, data []byte) []byte {
+	props := append([]byte{packet.AUTHENTICATION_METHOD_ID}, mqttString(method)...)
+	props = append(props, packet.AUTHENTICATION_DATA_ID)
+	props = append(props, mqttString(string(data))...)
+	return connectPacketWithFlags(clientID, 5, 2, props)
+}
+
+func readAuth(t *testing.T, c net.Conn) *packet.AuthControlPacket {
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+	received, err := packet.ReadPacket(c, 5)
+	require.NoError(t, err)
+	auth, ok := received.(*packet.AuthControlPacket)
+	require.True(t, ok, "%v", received)
+	return auth
+}
+
+// connAckAuthData returns the Authentication Data following the
+// Authentication Method in the CONNACK body.
+func connAckAuthData(t *testing.T, connAck []byte) []byte {
+	prefix := append([]byte{packet.AUTHENTICATION_METHOD_ID}, mqttString(scram.Method)...)
+	prefix = append(prefix, packet.AUTHENTICATION_DATA_ID)
+	i := bytes.Index(connAck, prefix)
+	require.True(t, i >= 0, "%v", connAck)
+	data := connAck[i+len(prefix):]
+	length := int(binary.BigEndian.Uint16(data))
+	return data[2 : 2+length]
+}
+
+func scramServer(t *testing.T) *Server {
+	credentials, err := scram.NewCredentials("pencil", 0)
+	require.NoError(t, err)
+	s := NewServer()
+	s.EnhancedAuthenticators = map[string]EnhancedAuthenticator{
+		scram.Method: NewSCRAMAuthenticator(map[string]scram.Credentials{"user": credentials}),
+	}
+	return s
+}
+
+// scramConnect runs CONNECT -> AUTH -> AUTH -> CONNACK and returns the
+// connection and the CONNACK reason code.
+func scramConnect(t *testing.T, s *Server, userName, password string) (net.Conn, byte) {
+	conversation, err := scram.NewClientConversation(userName, password)
+	require.NoError(t, err)
+	server, client := net.Pipe()
+	go s.ServeConn(server)
+
+	_, err = client.Write(authConnectPacket("c", scram.Method, conversation.ClientFirst()))
+	require.NoError(t, err)
+	auth := readAuth(t, client)
+	assert.Equal(t, packet.ReasonCodeContinueAuthentication, auth.VariableHeader.ReasonCode)
+	assert.Equal(t, scram.Method, auth.VariableHeader.AuthProperties.AuthenticationMethod)
+
+	clientFinal, err := conversation.ClientFinal(auth.VariableHeader.AuthProperties.AuthenticationData)
+	require.NoError(t, err)
+	_, err = packet.NewAuth(packet.ReasonCodeContinueAuthentication, scram.Method, clientFinal).WriteTo(client)
+	require.NoError(t, err)
+
+	packetType, body := readRaw(t, client)
+	require.Equal(t, byte(packet.CONNACK), packetType)
+	if body[1] == packet.ReasonCodeSuccess {
+		assert.NoError(t, conversation.Verify(connAckAuthData(t, body)))
+	}
+	return client, body[1]
+}
+
+func TestSCRAMAuthentication(t *testing.T) {
+	s := scramServer(t)
+	connected := make(chan ClientInfo, 1)
+	s.Hooks.OnConnect = func(info ClientInfo) { connected <- info }
+	defer s.Shutdown(context.Background())
+
+	client, code := scramConnect(t, s, "user", "pencil")
+	defer client.Close()
+	assert.Equal(t, packet.ReasonCodeSuccess, code)
+	assert.Equal(t, "user", (<-connected).UserName)
+
+	// The session is usable after authentication
+	subscribe(t, client, "a", 0, 5)
+}
+
+func TestSCRAMAuthenticationRefused(t *testing.T) {
+	s := scramServer(t)
+	defer s.Shutdown(context.Background())
+
+	client, code := scramConnect(t, s, "user", "eraser")
+	client.Close()
+	assert.Equal(t, packet.ReasonCodeBadUserNameOrPassword, code)
+
+	assert.Equal(t, packet.ReasonCodeBadAuthenticationMethod, connectRefused(t, s, authConnectPacket("c", "SCRAM-SHA-1", nil)))
+
+	// Unknown users are only refused at the end of the exchange
+	client, code = scramConnect(t, s, "other", "pencil")
+	client.Close()
+	assert.Equal(t, packet.ReasonCodeBadUserNameOrPassword, code)
+}
+
+func TestSCRAMReAuthentication(t *testing.T) {
+	s := scramServer(t)
+	defer s.Shutdown(context.Background())
+	client, code := scramConnect(t, s, "user", "pencil")
+	defer client.Close()
+	require.Equal(t, packet.ReasonCodeSuccess, code)
+
+	conversation, err := scram.NewClientConversation("user", "pencil")
+	require.NoError(t, err)
+	_, err = packet.NewAuth(packet.ReasonCodeReAuthenticate, scram.Method, conversation.ClientFirst()).WriteTo(client)
+	require.NoError(t, err)
+	auth := readAuth(t, client)
+	require.Equal(t, packet.ReasonCodeContinueAuthentication, auth.VariableHeader.ReasonCode)
+
+	clientFinal, err := conversation.ClientFinal(auth.VariableHeader.AuthProperties.AuthenticationData)
+	require.NoError(t, err)
+	_, err = packet.NewAuth(packet.ReasonCodeContinueAuthentication, scram.Method, clientFinal).WriteTo(client)
+	require.NoError(t, err)
+	auth = readAuth(t, client)
+	assert.Equal(t, packet.ReasonCodeSuccess, auth.VariableHeader.ReasonCode)
+	assert.NoError(t, conversation.Verify(auth.VariableHeader.AuthProperties.AuthenticationData))
+}
+
+func TestSCRAMDisconnectDuringAuthentication(t *testing.T) {
+	s := scramServer(t)
+	defer s.Shutdown(context.Background())
+	conversation, err := scram.NewClientConversation("user", "pencil")
+	require.NoError(t, err)
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(server)
+
+	_, err = client.Write(authConnectPacket("c", scram.Method, conversation.ClientFirst()))
+	require.NoError(t, err)
+	readAuth(t, client)
+	disconnect := packet.NewDisconnect(5, packet.ReasonCodeNormalDisconnection)
+	interval := 60
+	disconnect.VariableHeader.DisconnectProperties.SessionExpiryInterval = &interval
+	_, err = disconnect.WriteTo(client)
+	require.NoError(t, err)
+
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	exists, _ := sessionState(s, "c")
+	assert.False(t, exists)
+}
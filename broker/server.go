@@ -0,0 +1,372 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package broker implements an embeddable MQTT broker on top of package
+// packet.
+package broker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown has been called.
+var ErrServerClosed = errors.New("broker: Server closed")
+
+// ClientInfo describes a connected client to hooks.
+type ClientInfo struct {
+	ClientID   string
+	UserName   string
+	RemoteAddr net.Addr
+	// Proxy is set for clients connected through a trusted proxy sending
+	// the PROXY protocol.
+	Proxy         *ProxyInfo
+	ProtocolLevel byte
+}
+
+// Hooks are called by the Server on client events. All hooks are optional.
+// They are called from the goroutine serving the client and should not block.
+type Hooks struct {
+	// OnConnect is called after the CONNACK has been sent.
+	OnConnect func(info ClientInfo)
+	// OnDisconnect is called when the connection has been closed. err is nil
+	// if the client sent DISCONNECT.
+	OnDisconnect func(info ClientInfo, err error)
+	// OnPublish is called for every PUBLISH received, before it is routed.
+	OnPublish func(info ClientInfo, p *packet.PublishControlPacket)
+	// OnSubscribe is called for every subscription that has been accepted.
+	OnSubscribe func(info ClientInfo, sub packet.Subscription)
+	// OnUnsubscribe is called for every topic filter a client unsubscribes.
+	OnUnsubscribe func(info ClientInfo, topicFilter string)
+}
+
+// Server is an MQTT broker. Configure it before calling Serve, the fields
+// must not be changed afterwards.
+type Server struct {
+	// ConnectTimeout is the time a client has to send CONNECT after the
+	// connection has been established. It also limits how long reading the
+	// rest of any packet may take once its fixed header has arrived.
+	ConnectTimeout time.Duration
+	// WriteTimeout limits writing a single packet to a client.
+	WriteTimeout time.Duration
+	// OutgoingQueueSize is the number of packets buffered per client.
+	// QoS 0 messages for a client with a full queue are dropped.
+	OutgoingQueueSize int
+	// ReceiveMaximum is the number of QoS 2 messages an MQTT 5 client may
+	// have in flight towards the Server, it is sent in the CONNACK. Clients
+	// exceeding it are disconnected. QoS 1 messages don't count: the PUBACK
+	// is queued before the next packet is read, so the Server never holds
+	// an unacknowledged QoS 1 message. 0 means the protocol default of
+	// 65535.
+	ReceiveMaximum uint16
+	// MaxPacketSize is the size in bytes of the largest packet the Server
+	// accepts, MQTT 5 clients are told in the CONNACK. Clients sending
+	// larger packets are disconnected before the packet is read. 0 means no
+	// limit.
+	MaxPacketSize int
+	// MinKeepAlive and MaxKeepAlive bound the keep alive of MQTT 5 clients,
+	// which are told the value in use with the Server Keep Alive property. A
+	// keep alive of 0 (no keep alive) is replaced by MaxKeepAlive. Bounds
+	// of 0 are not enforced. MQTT 3.1.1 clients can't be told, they keep
+	// their own keep alive.
+	MinKeepAlive time.Duration
+	MaxKeepAlive time.Duration
+	// SharedSubscriptionStrategy chooses the member of a shared
+	// subscription receiving a message. NewServer uses round robin.
+	SharedSubscriptionStrategy SharedSubscriptionStrategy
+	// DisableSharedSubscriptions rejects subscriptions to
+	// "$share/<group>/<filter>".
+	DisableSharedSubscriptions bool
+	// MaxSessionExpiry caps the time a session outlives its connection, it
+	// also applies to MQTT 3.1.1 sessions without clean session. 0 means no
+	// limit.
+	MaxSessionExpiry time.Duration
+	// MaxQueuedMessages is the number of QoS 1 and 2 messages stored per
+	// session while the client is offline or has as many messages in flight
+	// as its Receive Maximum allows. Further messages are dropped.
+	MaxQueuedMessages int
+	// Authenticator decides which clients may connect. NewServer accepts
+	// all clients, nil does as well.
+	Authenticator Authenticator
+	// EnhancedAuthenticators maps MQTT 5 authentication methods to their
+	// implementation. Clients connecting with an authentication method
+	// are authenticated by it instead of the Authenticator, clients
+	// requesting other methods are refused.
+	EnhancedAuthenticators map[string]EnhancedAuthenticator
+	// CertificateClientID and CertificateUserName take the client ID and
+	// user name of clients with a verified TLS client certificate from the
+	// certificate. The client ID from the certificate is used if the CONNECT
+	// has none, the user name replaces the one of the CONNECT.
+	CertificateClientID CertificateIdentity
+	CertificateUserName CertificateIdentity
+	// RequireCertificateClientID refuses clients with a verified client
+	// certificate whose CONNECT has a client ID other than the one taken
+	// from the certificate.
+	RequireCertificateClientID bool
+	// Authorizer decides which topics clients may publish and subscribe to.
+	// If nil, all topics are allowed.
+	Authorizer Authorizer
+	// ClientIDGenerator generates the client IDs of clients connecting with
+	// an empty client ID. MQTT 3.1.1 clients must request a clean session
+	// for that. NewServer uses random IDs prefixed with "auto-".
+	ClientIDGenerator ClientIDGenerator
+	// SysInterval is the interval at which statistics are published to the
+	// "$SYS/broker/" topics. 0 disables them.
+	SysInterval time.Duration
+	// SysAdmin reports whether a client may subscribe to $SYS topics. If
+	// nil, no client may.
+	SysAdmin func(info ClientInfo) bool
+	// ErrorLog is used for errors accepting connections and serving
+	// clients. If nil, the log package's standard logger is used.
+	ErrorLog *log.Logger
+	Hooks    Hooks
+
+	mu            sync.Mutex
+	listeners     map[net.Listener]struct{}
+	conns         map[*client]struct{}
+	sessions      map[string]*session
+	subscriptions *SubscriptionTree
+	retained      *RetainedStore
+	started       time.Time
+	traffic       *traffic
+	sysOnce       sync.Once
+	shuttingDown  bool
+	done          chan struct{}
+	wg            sync.WaitGroup
+}
+
+// NewServer creates a Server with default settings.
+func NewServer() *Server {
+	return &Server{
+		ConnectTimeout:             10 * time.Second,
+		WriteTimeout:               10 * time.Second,
+		OutgoingQueueSize:          1024,
+		MaxQueuedMessages:          1000,
+		SharedSubscriptionStrategy: NewRoundRobinStrategy(),
+		Authenticator:              NewAllowAllAuthenticator(),
+		ClientIDGenerator:          defaultClientIDGenerator,
+		listeners:                  make(map[net.Listener]struct{}),
+		conns:                      make(map[*client]struct{}),
+		sessions:                   make(map[string]*session),
+		subscriptions:              NewSubscriptionTree(),
+		retained:                   NewRetainedStore(),
+		started:                    time.Now(),
+		traffic:                    &traffic{},
+		done:                       make(chan struct{}),
+	}
+}
+
+// keepAlive returns the keep alive in seconds for a client requesting
+// requested and whether it differs from the requested value.
+func (s *Server) keepAlive(requested int) (int, bool) {
+	keepAlive := time.Duration(requested) * time.Second
+	switch {
+	case s.MaxKeepAlive > 0 && (keepAlive == 0 || keepAlive > s.MaxKeepAlive):
+		keepAlive = s.MaxKeepAlive
+	case s.MinKeepAlive > 0 && keepAlive > 0 && keepAlive < s.MinKeepAlive:
+		keepAlive = s.MinKeepAlive
+	}
+	seconds := int(keepAlive / time.Second)
+	if seconds > 65535 {
+		seconds = 65535
+	}
+	return seconds, seconds != requested
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Serve accepts connections on l and serves each of them in a new
+// goroutine. It may be called for several listeners at once. Serve always
+// returns a non-nil error, ErrServerClosed after Shutdown.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l) {
+		return ErrServerClosed
+	}
+	defer s.untrackListener(l)
+
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return ErrServerClosed
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() { // nolint: staticcheck
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else if tempDelay *= 2; tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				s.logf("broker: Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single connection and blocks until it is closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	// The PROXY protocol header is read before the client uses conn
+	if proxy := unwrapProxyConn(conn); proxy != nil {
+		if err := proxy.readHeader(); err != nil {
+			s.logf("broker: Closing connection: %v", err)
+			_ = conn.Close() // nolint: gosec
+			return
+		}
+	}
+	c := newClient(s, conn)
+	if !s.trackConn(c) {
+		_ = conn.Close() // nolint: gosec
+		return
+	}
+	defer s.untrackConn(c)
+	c.serve()
+}
+
+// Shutdown closes all listeners and disconnects all clients, MQTT 5 clients
+// with reason code Server shutting down. It waits until all connections have
+// been closed or ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.shuttingDown {
+		s.shuttingDown = true
+		close(s.done)
+	}
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for c := range s.conns {
+		c.close(packet.ReasonCodeServerShuttingDown)
+	}
+	s.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trackListener registers l to be closed by Shutdown. It returns false if
+// the Server is already shutting down.
+func (s *Server) trackListener(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.mu.Lock()
+	delete(s.listeners, l)
+	s.mu.Unlock()
+}
+
+func (s *Server) trackConn(c *client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	if s.SysInterval > 0 {
+		s.sysOnce.Do(func() { go s.publishSys() })
+	}
+	return true
+}
+
+func (s *Server) untrackConn(c *client) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	s.detachSession(c)
+	close(c.detached)
+	s.wg.Done()
+}
+
+// route delivers a PUBLISH to all clients with a matching subscription and
+// to one member of each matching shared subscription. Messages for offline
+// sessions are queued.
+func (s *Server) route(publisherID string, p *packet.PublishControlPacket) {
+	topic := p.VariableHeader.Topic
+	expiresAt := messageExpiry(p, time.Now())
+	subscribers := s.subscriptions.Match(topic, publisherID)
+	groups := s.subscriptions.MatchShared(topic)
+
+	type delivery struct {
+		client  *client
+		message outgoingMessage
+	}
+	s.mu.Lock()
+	deliveries := make([]delivery, 0, len(subscribers)+len(groups))
+	add := func(sess *session, sub packet.Subscription) {
+		m := newOutgoingMessage(p, sub, false, publisherID, expiresAt)
+		if sess.client == nil {
+			sess.mu.Lock()
+			s.enqueue(sess, m)
+			sess.mu.Unlock()
+			return
+		}
+		deliveries = append(deliveries, delivery{client: sess.client, message: m})
+	}
+	for _, sub := range subscribers {
+		if sess, ok := s.sessions[sub.ClientID]; ok {
+			add(sess, sub.Subscription)
+		}
+	}
+	for _, group := range groups {
+		if sess, sub, ok := s.pickMember(group, "", publisherID, p); ok {
+			add(sess, sub)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, d := range deliveries {
+		d.client.deliver(d.message)
+	}
+}
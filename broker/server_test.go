@@ -0,0 +1,189 @@
+package broker
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func withFixedHeader(header byte, body []byte) []byte {
+	// Test packets are always shorter than 128 bytes
+	return append([]byte{header, byte(len(body))}, body...)
+}
+
+func connectPacket(clientID string, level byte) []byte {
+	return connectPacketWithFlags(clientID, level, 2, nil)
+}
+
+// connectPacketWithFlags builds a CONNECT, props are only used for level 5.
+func connectPacketWithFlags(clientID string, level byte, flags byte, props []byte) []byte {
+	body := append(mqttString("MQTT"), level, flags, 0, 0)
+	if level == 5 {
+		body = append(body, byte(len(props)))
+		body = append(body, props...)
+	}
+	body = append(body, mqttString(clientID)...)
+	return withFixedHeader(packet.CONNECT<<4, body)
+}
+
+func subscribePacket(packetID uint16, filter string, qos byte, level byte) []byte {
+	body := []byte{byte(packetID >> 8), byte(packetID)}
+	if level == 5 {
+		body = append(body, 0)
+	}
+	body = append(body, mqttString(filter)...)
+	body = append(body, qos)
+	return withFixedHeader(packet.SUBSCRIBE<<4|2, body)
+}
+
+// readRaw reads a packet without parsing it, package packet only parses
+// packets sent by clients.
+func readRaw(t *testing.T, c net.Conn) (packetType byte, body []byte) {
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+	b := make([]byte, 1)
+	_, err := io.ReadFull(c, b)
+	require.NoError(t, err)
+	packetType = b[0] >> 4
+
+	length, multiplier := 0, 1
+	for {
+		_, err = io.ReadFull(c, b)
+		require.NoError(t, err)
+		length += int(b[0]&127) * multiplier
+		multiplier *= 128
+		if b[0]&128 == 0 {
+			break
+		}
+	}
+	body = make([]byte, length)
+	_, err = io.ReadFull(c, body)
+	require.NoError(t, err)
+	return
+}
+
+func connect(t *testing.T, s *Server, clientID string, level byte) net.Conn {
+	client, _ := connectRaw(t, s, connectPacket(clientID, level))
+	return client
+}
+
+// connectRaw sends the CONNECT and returns the body of the CONNACK.
+func connectRaw(t *testing.T, s *Server, connect []byte) (net.Conn, []byte) {
+	server, client := net.Pipe()
+	go s.ServeConn(server)
+
+	_, err := client.Write(connect)
+	require.NoError(t, err)
+	packetType, body := readRaw(t, client)
+	require.Equal(t, byte(packet.CONNACK), packetType)
+	require.Equal(t, byte(0), body[1], "CONNACK return code")
+	return client, body
+}
+
+// waitFor polls cond until it returns true or a second has passed.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServerRoutesPublish(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	subscriber := connect(t, s, "sub", 4)
+	defer subscriber.Close()
+	_, err := subscriber.Write(subscribePacket(1, "a/+", 0, 4))
+	require.NoError(t, err)
+	packetType, body := readRaw(t, subscriber)
+	assert.Equal(t, byte(packet.SUBACK), packetType)
+	assert.Equal(t, []byte{0, 1, 0}, body)
+
+	publisher := connect(t, s, "pub", 5)
+	defer publisher.Close()
+	p, err := packet.BuildPublish("a/b", []byte("hello"), 5)
+	require.NoError(t, err)
+	_, err = p.WriteTo(publisher)
+	require.NoError(t, err)
+
+	require.NoError(t, subscriber.SetReadDeadline(time.Now().Add(time.Second)))
+	received, err := packet.ReadPacket(subscriber, 4)
+	require.NoError(t, err)
+	publish, ok := received.(*packet.PublishControlPacket)
+	require.True(t, ok)
+	assert.Equal(t, "a/b", publish.VariableHeader.Topic)
+	assert.Equal(t, []byte("hello"), publish.Payload)
+}
+
+func TestServerShutdown(t *testing.T) {
+	s := NewServer()
+	client := connect(t, s, "c", 5)
+	defer client.Close()
+
+	go func() {
+		assert.NoError(t, s.Shutdown(context.Background()))
+	}()
+
+	packetType, body := readRaw(t, client)
+	assert.Equal(t, byte(packet.DISCONNECT), packetType)
+	assert.Equal(t, []byte{packet.ReasonCodeServerShuttingDown}, body)
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	s := NewServer()
+	s.MaxPacketSize = 100
+	defer s.Shutdown(context.Background())
+
+	client, connAck := connectRaw(t, s, connectPacket("c5", 5))
+	defer client.Close()
+	assert.Equal(t, []byte{0, 0, 7, packet.MAXIMUM_PACKET_SIZE_ID, 0, 0, 0, 100, packet.SHARED_SUBSCRIPTION_AVAILABLE_ID, 1}, connAck)
+
+	// Only the fixed header of a PUBLISH with 200 bytes remaining is sent
+	_, err := client.Write([]byte{packet.PUBLISH << 4, 200, 1})
+	require.NoError(t, err)
+	packetType, body := readRaw(t, client)
+	assert.Equal(t, byte(packet.DISCONNECT), packetType)
+	assert.Equal(t, []byte{packet.ReasonCodePacketTooLarge}, body)
+
+	// MQTT 3.1.1 has no reason codes, the connection is just closed
+	client = connect(t, s, "c4", 4)
+	defer client.Close()
+	// The Server may close the pipe before the write returns
+	_, _ = client.Write([]byte{packet.PUBLISH << 4, 200, 1})
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMatchTopic(t *testing.T) {
+	for _, tc := range []struct {
+		filter, topic string
+		expected      bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"+/+", "/b", true},
+		{"#", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	} {
+		assert.Equal(t, tc.expected, matchTopic(tc.filter, tc.topic), "%v %v", tc.filter, tc.topic)
+	}
+}
@@ -0,0 +1,354 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// sessionNeverExpires is the MQTT 5 session expiry interval for sessions
+// that don't expire.
+const sessionNeverExpires = 0xFFFFFFFF
+
+// session is the state of a client that may outlive the connection: the
+// subscriptions (kept in the SubscriptionTree of the Server), the packet
+// IDs and QoS 1/2 messages in flight, and the messages queued while the
+// client is offline.
+//
+// inflight, resend and pending are guarded by mu, which also keeps the
+// outgoing messages in order. The other fields are guarded by the mutex of
+// the Server, which must be acquired first if both are needed.
+type session struct {
+	id       string
+	inflight *packet.InflightTracker
+
+	mu sync.Mutex
+	// resend are the packets in flight of a resumed session that didn't fit
+	// into the outgoing queue yet, they are sent before pending
+	resend  []io.WriterTo
+	pending []outgoingMessage
+	// sharedInflight are the messages in flight routed through shared
+	// subscriptions that haven't been received yet
+	sharedInflight map[uint16]outgoingMessage
+
+	// client is nil while the client is offline
+	client *client
+	// expiryInterval is the number of seconds the session outlives the
+	// connection, 0 ends the session with the connection.
+	expiryInterval uint32
+	expiresAt      time.Time
+	timer          *time.Timer
+
+	// will is the will message waiting for the Will Delay Interval
+	will      *packet.PublishControlPacket
+	willTimer *time.Timer
+}
+
+func newSession(id string) *session {
+	return &session{
+		id:             id,
+		inflight:       packet.NewInflightTracker(0, 0),
+		sharedInflight: make(map[uint16]outgoingMessage),
+	}
+}
+
+// sessionExpiry returns the session expiry interval requested by the
+// CONNECT, capped by the Server. capped reports whether the cap applied.
+func (s *Server) sessionExpiry(p *packet.ConnectControlPacket) (interval uint32, capped bool) {
+	if int(p.VariableHeader.ProtocolLevel) == 5 {
+		interval = uint32(p.VariableHeader.ConnectProperties.SessionExpiryInterval)
+	} else if !p.VariableHeader.ConnectFlags.CleanStart {
+		// MQTT 3.1.1 persistent sessions don't expire
+		interval = sessionNeverExpires
+	}
+	return s.capSessionExpiry(interval)
+}
+
+func (s *Server) capSessionExpiry(interval uint32) (uint32, bool) {
+	max := s.MaxSessionExpiry / time.Second
+	if s.MaxSessionExpiry > 0 && time.Duration(interval) > max {
+		return uint32(max), true
+	}
+	return interval, false
+}
+
+// takeWill removes the delayed will message of the session and returns it.
+func (sess *session) takeWill() *packet.PublishControlPacket {
+	if sess.willTimer != nil {
+		sess.willTimer.Stop()
+		sess.willTimer = nil
+	}
+	will := sess.will
+	sess.will = nil
+	return will
+}
+
+// attachSession connects c to its session. Unless cleanStart is set, an
+// existing session is resumed. Resuming a session cancels its delayed will
+// message, ending it publishes the will. A client without client ID is
+// assigned a new one. accept is called before any message can be delivered
+// to c, the messages of a resumed session are sent right after it.
+//
+// If another connection uses the session, it is closed with reason code
+// Session taken over and c waits until it has been detached, so its will
+// message is handled as for any other closed connection. Of several clients
+// connecting with the same client ID at once, the last one to get the
+// session keeps it.
+func (s *Server) attachSession(c *client, cleanStart bool, expiryInterval uint32, accept func(present bool)) error {
+	var (
+		will     *packet.PublishControlPacket
+		orphaned []outgoingMessage
+	)
+	s.mu.Lock()
+	if c.id == "" {
+		c.id = s.assignClientID()
+		c.assignedID = true
+	}
+	sess, present := s.sessions[c.id]
+	for present && sess.client != nil {
+		old := sess.client
+		s.mu.Unlock()
+		old.close(packet.ReasonCodeSessionTakenOver)
+		select {
+		case <-old.detached:
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+		s.mu.Lock()
+		sess, present = s.sessions[c.id]
+	}
+	if present {
+		if sess.timer != nil {
+			sess.timer.Stop()
+			sess.timer = nil
+		}
+		if cleanStart {
+			will, orphaned = s.discardSession(sess)
+			present = false
+		} else {
+			sess.takeWill()
+		}
+	}
+	if !present {
+		sess = newSession(c.id)
+		s.sessions[c.id] = sess
+	}
+
+	sess.client = c
+	sess.expiryInterval = expiryInterval
+	c.session = sess
+	sess.mu.Lock()
+	s.mu.Unlock()
+
+	accept(present)
+	c.resumeLocked()
+	sess.mu.Unlock()
+
+	s.redistribute(c.id, orphaned)
+	if will != nil {
+		s.publishWill(c.id, will)
+	}
+	return nil
+}
+
+// detachSession is called when the connection of c has been closed. The
+// session is discarded or kept until it expires. The will message of c, if
+// any, is published now or after its Will Delay Interval unless the session
+// ends earlier. Queued messages of shared subscriptions are passed to other
+// members.
+func (s *Server) detachSession(c *client) {
+	var (
+		wills    []*packet.PublishControlPacket
+		orphaned []outgoingMessage
+	)
+	s.mu.Lock()
+	sess := c.session
+	switch {
+	case sess == nil:
+	case sess.client != c:
+		// The session has been taken over by another connection
+		if c.will != nil {
+			wills = append(wills, c.will)
+		}
+	default:
+		sess.client = nil
+		sess.mu.Lock()
+		orphaned = sess.takeShared(func(string) bool { return true })
+		sess.mu.Unlock()
+
+		if c.will != nil {
+			if c.willDelay == 0 || sess.expiryInterval == 0 {
+				wills = append(wills, c.will)
+			} else {
+				sess.will = c.will
+				sess.willTimer = time.AfterFunc(time.Duration(c.willDelay)*time.Second, func() {
+					s.publishDelayedWill(sess)
+				})
+			}
+		}
+
+		switch sess.expiryInterval {
+		case 0:
+			will, inflight := s.discardSession(sess)
+			if will != nil {
+				wills = append(wills, will)
+			}
+			orphaned = append(orphaned, inflight...)
+		case sessionNeverExpires:
+		default:
+			expiry := time.Duration(sess.expiryInterval) * time.Second
+			sess.expiresAt = time.Now().Add(expiry)
+			sess.timer = time.AfterFunc(expiry, func() {
+				s.expireSession(sess)
+			})
+		}
+	}
+	s.mu.Unlock()
+
+	s.redistribute(c.id, orphaned)
+	for _, will := range wills {
+		s.publishWill(c.id, will)
+	}
+}
+
+func (s *Server) expireSession(sess *session) {
+	s.mu.Lock()
+	if s.sessions[sess.id] != sess || sess.client != nil || time.Now().Before(sess.expiresAt) {
+		s.mu.Unlock()
+		return
+	}
+	will, orphaned := s.discardSession(sess)
+	s.mu.Unlock()
+
+	s.redistribute(sess.id, orphaned)
+	if will != nil {
+		s.publishWill(sess.id, will)
+	}
+}
+
+func (s *Server) publishDelayedWill(sess *session) {
+	s.mu.Lock()
+	will := sess.takeWill()
+	s.mu.Unlock()
+
+	if will != nil {
+		s.publishWill(sess.id, will)
+	}
+}
+
+// publishWill publishes the will message of clientID like a regular PUBLISH.
+func (s *Server) publishWill(clientID string, will *packet.PublishControlPacket) {
+	if will.FixedHeaderFlags.Retain {
+		s.retained.Set(will)
+	}
+	s.route(clientID, will)
+}
+
+// discardSession removes the session and its subscriptions unless it has
+// already been replaced. It returns the delayed will message that has to be
+// published because the session ended, and the messages of shared
+// subscriptions that have to be passed to other members. It must be called
+// with the mutex of the Server held.
+func (s *Server) discardSession(sess *session) (*packet.PublishControlPacket, []outgoingMessage) {
+	if sess.timer != nil {
+		sess.timer.Stop()
+		sess.timer = nil
+	}
+	will := sess.takeWill()
+	if s.sessions[sess.id] != sess {
+		return will, nil
+	}
+	delete(s.sessions, sess.id)
+	s.subscriptions.UnsubscribeAll(sess.id)
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	orphaned := sess.takeShared(func(string) bool { return true })
+	for _, m := range sess.inflight.Outbound() {
+		if shared, ok := sess.sharedInflight[m.PacketID]; ok {
+			orphaned = append(orphaned, shared)
+		}
+	}
+	return will, orphaned
+}
+
+// setSessionExpiry changes the expiry interval on DISCONNECT. MQTT 5 doesn't
+// allow to set it if the CONNECT requested 0.
+func (s *Server) setSessionExpiry(c *client, interval uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.session.expiryInterval == 0 && interval != 0 {
+		return &packet.ProtocolError{ReasonCode: packet.ReasonCodeProtocolError, Message: "Session expiry interval was 0 in CONNECT"}
+	}
+	c.session.expiryInterval, _ = s.capSessionExpiry(interval)
+	return nil
+}
+
+// enqueue stores a message to be sent later. QoS 0 messages are not stored.
+// When the queue is full, expired messages are removed to make room,
+// otherwise the message is dropped. It must be called with the mutex of the
+// session held.
+func (s *Server) enqueue(sess *session, m outgoingMessage) {
+	if m.qos == packet.QoSLevelNone {
+		return
+	}
+	if len(sess.pending) >= s.MaxQueuedMessages {
+		sess.dropExpired(time.Now())
+		if len(sess.pending) >= s.MaxQueuedMessages {
+			return
+		}
+	}
+	sess.pending = append(sess.pending, m)
+}
+
+// dropExpired removes the queued messages that have expired at now.
+func (sess *session) dropExpired(now time.Time) {
+	pending := sess.pending[:0]
+	for _, m := range sess.pending {
+		if !expired(m.expiresAt, now) {
+			pending = append(pending, m)
+		}
+	}
+	for i := len(pending); i < len(sess.pending); i++ {
+		sess.pending[i] = outgoingMessage{}
+	}
+	sess.pending = pending
+}
+
+// takeShared removes the queued messages routed through shared
+// subscriptions accepted by match, so they can be passed to other members.
+// It must be called with the mutex of the session held.
+func (sess *session) takeShared(match func(filter string) bool) (taken []outgoingMessage) {
+	kept := sess.pending[:0]
+	for _, m := range sess.pending {
+		if m.shareFilter != "" && match(m.shareFilter) {
+			taken = append(taken, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	for i := len(kept); i < len(sess.pending); i++ {
+		sess.pending[i] = outgoingMessage{}
+	}
+	sess.pending = kept
+	return taken
+}
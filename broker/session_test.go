@@ -0,0 +1,117 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sessionState(s *Server, clientID string) (exists, online bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[clientID]
+	return ok, ok && sess.client != nil
+}
+
+func TestSessionResume(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	subscriber, connAck := connectRaw(t, s, connectPacketWithFlags("sub", 4, 0, nil))
+	assert.Equal(t, byte(0), connAck[0], "session present")
+	_, err := subscriber.Write(subscribePacket(1, "a/b", 1, 4))
+	require.NoError(t, err)
+	readRaw(t, subscriber)
+	require.NoError(t, subscriber.Close())
+	waitFor(t, func() bool {
+		exists, online := sessionState(s, "sub")
+		return exists && !online
+	})
+
+	publisher := connect(t, s, "pub", 4)
+	defer publisher.Close()
+	p, err := packet.BuildPublish("a/b", []byte("offline"), 4, packet.WithQoS(packet.QoSLevelAtLeastOnce), packet.WithPacketID(1))
+	require.NoError(t, err)
+	_, err = p.WriteTo(publisher)
+	require.NoError(t, err)
+	waitFor(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		sess := s.sessions["sub"]
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		return len(sess.pending) == 1
+	})
+
+	subscriber, connAck = connectRaw(t, s, connectPacketWithFlags("sub", 4, 0, nil))
+	defer subscriber.Close()
+	assert.Equal(t, byte(1), connAck[0], "session present")
+	require.NoError(t, subscriber.SetReadDeadline(time.Now().Add(time.Second)))
+	received, err := packet.ReadPacket(subscriber, 4)
+	require.NoError(t, err)
+	publish, ok := received.(*packet.PublishControlPacket)
+	require.True(t, ok)
+	assert.Equal(t, []byte("offline"), publish.Payload)
+}
+
+func TestSessionCleanStart(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	client, _ := connectRaw(t, s, connectPacketWithFlags("c", 4, 0, nil))
+	require.NoError(t, client.Close())
+	waitFor(t, func() bool {
+		_, online := sessionState(s, "c")
+		return !online
+	})
+
+	client, connAck := connectRaw(t, s, connectPacketWithFlags("c", 4, 2, nil))
+	assert.Equal(t, byte(0), connAck[0], "session present")
+	require.NoError(t, client.Close())
+	waitFor(t, func() bool {
+		exists, _ := sessionState(s, "c")
+		return !exists
+	})
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s := NewServer()
+	s.MaxSessionExpiry = time.Second
+	defer s.Shutdown(context.Background())
+
+	// Session Expiry Interval 3600, capped to 1 second
+	props := []byte{packet.SESSION_EXPIRY_INTERVAL_ID, 0, 0, 0x0e, 0x10}
+	client, connAck := connectRaw(t, s, connectPacketWithFlags("c", 5, 0, props))
+	assert.Equal(t, []byte{0, 0, 7, packet.SESSION_EXPIRY_INTERVAL_ID, 0, 0, 0, 1, packet.SHARED_SUBSCRIPTION_AVAILABLE_ID, 1}, connAck)
+	require.NoError(t, client.Close())
+
+	waitFor(t, func() bool {
+		exists, online := sessionState(s, "c")
+		return exists && !online
+	})
+	s.mu.Lock()
+	s.sessions["c"].expiresAt = time.Now()
+	expire := s.sessions["c"]
+	s.mu.Unlock()
+	s.expireSession(expire)
+	exists, _ := sessionState(s, "c")
+	assert.False(t, exists)
+}
+
+func TestSessionExpiryOnDisconnect(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	client := connect(t, s, "c", 5)
+	defer client.Close()
+	// Setting a session expiry interval is not allowed after CONNECT with 0
+	_, err := client.Write(withFixedHeader(packet.DISCONNECT<<4, []byte{0, 5, packet.SESSION_EXPIRY_INTERVAL_ID, 0, 0, 0, 10}))
+	require.NoError(t, err)
+	packetType, body := readRaw(t, client)
+	assert.Equal(t, byte(packet.DISCONNECT), packetType)
+	assert.Equal(t, []byte{packet.ReasonCodeProtocolError}, body)
+}
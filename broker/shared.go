@@ -0,0 +1,144 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// SharedSubscriptionStrategy chooses the member of a shared subscription
+// that receives a message. Pick is called concurrently.
+type SharedSubscriptionStrategy interface {
+	// Pick returns an index into group.Members, which is never empty.
+	// Members that are offline are only passed if no member is online.
+	Pick(group SharedGroup, publisherID string, p *packet.PublishControlPacket) int
+}
+
+type roundRobinStrategy struct {
+	mu   sync.Mutex
+	next map[string]int
+}
+
+// NewRoundRobinStrategy returns a strategy passing messages to the members
+// of each group in turn.
+func NewRoundRobinStrategy() SharedSubscriptionStrategy {
+	return &roundRobinStrategy{next: make(map[string]int)}
+}
+
+func (s *roundRobinStrategy) Pick(group SharedGroup, publisherID string, p *packet.PublishControlPacket) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.next[group.Filter] % len(group.Members)
+	s.next[group.Filter] = i + 1
+	return i
+}
+
+type randomStrategy struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewRandomStrategy returns a strategy passing each message to a random
+// member.
+func NewRandomStrategy(seed int64) SharedSubscriptionStrategy {
+	return &randomStrategy{rand: rand.New(rand.NewSource(seed))} // nolint: gosec
+}
+
+func (s *randomStrategy) Pick(group SharedGroup, publisherID string, p *packet.PublishControlPacket) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Intn(len(group.Members))
+}
+
+type stickyStrategy struct{}
+
+// NewStickyStrategy returns a strategy passing all messages of a publisher
+// to the same member, chosen by a hash of the publisher's client ID. The
+// member only changes when the group does.
+func NewStickyStrategy() SharedSubscriptionStrategy {
+	return stickyStrategy{}
+}
+
+func (stickyStrategy) Pick(group SharedGroup, publisherID string, p *packet.PublishControlPacket) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(publisherID)) // nolint: gosec
+	return int(h.Sum32() % uint32(len(group.Members)))
+}
+
+// pickMember chooses the session receiving a message routed through a
+// shared subscription, preferring members that are online. except is
+// excluded from the group. It must be called with the mutex of the Server
+// held.
+func (s *Server) pickMember(group SharedGroup, except, publisherID string, p *packet.PublishControlPacket) (*session, packet.Subscription, bool) {
+	var online, offline []Subscriber
+	for _, member := range group.Members {
+		sess, ok := s.sessions[member.ClientID]
+		switch {
+		case !ok || member.ClientID == except:
+		case sess.client != nil:
+			online = append(online, member)
+		default:
+			offline = append(offline, member)
+		}
+	}
+	candidates := online
+	if len(candidates) == 0 {
+		candidates = offline
+	}
+	if len(candidates) == 0 {
+		return nil, packet.Subscription{}, false
+	}
+
+	group.Members = candidates
+	member := candidates[s.SharedSubscriptionStrategy.Pick(group, publisherID, p)]
+	return s.sessions[member.ClientID], member.Subscription, true
+}
+
+// redistribute passes messages of a member leaving a shared subscription to
+// the other members. Messages without a shared subscription are dropped.
+func (s *Server) redistribute(from string, messages []outgoingMessage) {
+	for _, m := range messages {
+		if m.shareFilter == "" {
+			continue
+		}
+		group := SharedGroup{
+			Filter:  m.shareFilter,
+			Members: s.subscriptions.SharedMembers(m.shareFilter),
+		}
+		s.mu.Lock()
+		sess, sub, ok := s.pickMember(group, from, m.publisherID, m.publish)
+		var c *client
+		if ok {
+			m = newOutgoingMessage(m.publish, sub, false, m.publisherID, m.expiresAt)
+			if c = sess.client; c == nil {
+				sess.mu.Lock()
+				s.enqueue(sess, m)
+				sess.mu.Unlock()
+			}
+		}
+		s.mu.Unlock()
+
+		if c != nil {
+			c.deliver(m)
+		}
+	}
+}
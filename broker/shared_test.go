@@ -0,0 +1,156 @@
+package broker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSharedFilter(t *testing.T) {
+	group, filter, ok := parseSharedFilter("$share/consumers/a/+")
+	assert.True(t, ok)
+	assert.Equal(t, "consumers", group)
+	assert.Equal(t, "a/+", filter)
+
+	for _, tc := range []struct {
+		filter string
+		valid  bool
+	}{
+		{"$share/g/#", true},
+		{"$share/g/a/b", true},
+		{"$share//a", false},
+		{"$share/g", false},
+		{"$share/g/", false},
+		{"$share/g+/a", false},
+		{"$share/g/a/#/b", false},
+		{"$share/g/$share/h/a", false},
+	} {
+		assert.Equal(t, tc.valid, validTopicFilter(tc.filter), tc.filter)
+	}
+}
+
+func TestSubscriptionTreeShared(t *testing.T) {
+	tree := NewSubscriptionTree()
+	tree.Subscribe("c2", packet.Subscription{Topic: "$share/g/a/+"})
+	tree.Subscribe("c1", packet.Subscription{Topic: "$share/g/a/+", QoS: packet.QoSLevelAtLeastOnce})
+	tree.Subscribe("c3", packet.Subscription{Topic: "$share/h/a/b"})
+	tree.Subscribe("c4", packet.Subscription{Topic: "a/b"})
+	assert.Equal(t, 4, tree.Len())
+
+	assert.Len(t, tree.Match("a/b", ""), 1, "shared subscriptions are matched separately")
+	groups := tree.MatchShared("a/b")
+	require.Len(t, groups, 2)
+	for _, group := range groups {
+		if group.Filter == "$share/g/a/+" {
+			require.Len(t, group.Members, 2)
+			assert.Equal(t, "c1", group.Members[0].ClientID)
+			assert.Equal(t, packet.QoSLevelAtLeastOnce, group.Members[0].Subscription.QoS)
+		} else {
+			assert.Equal(t, "$share/h/a/b", group.Filter)
+		}
+	}
+	assert.Len(t, tree.SharedMembers("$share/g/a/+"), 2)
+	assert.Len(t, tree.Subscriptions("c3"), 1)
+
+	assert.True(t, tree.Unsubscribe("c3", "$share/h/a/b"))
+	assert.False(t, tree.Unsubscribe("c3", "$share/h/a/b"))
+	tree.UnsubscribeAll("c1")
+	tree.UnsubscribeAll("c2")
+	tree.UnsubscribeAll("c4")
+	assert.Equal(t, 0, tree.Len())
+	assert.Empty(t, tree.root.children)
+}
+
+func TestSharedSubscriptionStrategies(t *testing.T) {
+	group := SharedGroup{Filter: "$share/g/a", Members: make([]Subscriber, 3)}
+
+	roundRobin := NewRoundRobinStrategy()
+	var picked []int
+	for i := 0; i < 4; i++ {
+		picked = append(picked, roundRobin.Pick(group, "pub", nil))
+	}
+	assert.Equal(t, []int{0, 1, 2, 0}, picked)
+
+	sticky := NewStickyStrategy()
+	first := sticky.Pick(group, "pub", nil)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, first, sticky.Pick(group, "pub", nil))
+	}
+
+	random := NewRandomStrategy(1)
+	for i := 0; i < 10; i++ {
+		i := random.Pick(group, "pub", nil)
+		assert.True(t, i >= 0 && i < 3)
+	}
+}
+
+func TestServerSharedSubscription(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	c1 := connect(t, s, "c1", 4)
+	defer c1.Close()
+	subscribe(t, c1, "$share/g/a", 0, 4)
+	c2 := connect(t, s, "c2", 5)
+	defer c2.Close()
+	subscribe(t, c2, "$share/g/a", 0, 5)
+
+	publisher := connect(t, s, "pub", 4)
+	defer publisher.Close()
+	for _, payload := range []string{"1", "2", "3", "4"} {
+		writePublish(t, publisher, "a", payload, packet.QoSLevelNone, 0, 4)
+	}
+	// Members are sorted by client ID
+	assert.Equal(t, []byte("1"), readPublish(t, c1, 4).Payload)
+	assert.Equal(t, []byte("3"), readPublish(t, c1, 4).Payload)
+	assert.Equal(t, []byte("2"), readPublish(t, c2, 5).Payload)
+	assert.Equal(t, []byte("4"), readPublish(t, c2, 5).Payload)
+}
+
+func TestServerSharedSubscriptionRedistribution(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	c1, _ := connectRaw(t, s, connectPacketWithFlags("c1", 4, 0, nil))
+	subscribe(t, c1, "$share/g/a", 1, 4)
+	require.NoError(t, c1.Close())
+	waitFor(t, func() bool {
+		_, online := sessionState(s, "c1")
+		return !online
+	})
+
+	// c1 is the only member, the message is queued for it
+	publisher := connect(t, s, "pub", 4)
+	defer publisher.Close()
+	writePublish(t, publisher, "a", "queued", packet.QoSLevelAtLeastOnce, 1, 4)
+	readRaw(t, publisher)
+
+	c2 := connect(t, s, "c2", 4)
+	defer c2.Close()
+	subscribe(t, c2, "$share/g/a", 1, 4)
+
+	// c1 leaves by starting a new session, c2 gets its message
+	c1, _ = connectRaw(t, s, connectPacketWithFlags("c1", 4, 2, nil))
+	defer c1.Close()
+	p := readPublish(t, c2, 4)
+	assert.Equal(t, []byte("queued"), p.Payload)
+	assert.Equal(t, packet.QoSLevelAtLeastOnce, p.FixedHeaderFlags.QoS)
+}
+
+func TestServerSharedSubscriptionsDisabled(t *testing.T) {
+	s := NewServer()
+	s.DisableSharedSubscriptions = true
+	defer s.Shutdown(context.Background())
+
+	client, connAck := connectRaw(t, s, connectPacket("c", 5))
+	defer client.Close()
+	assert.Equal(t, []byte{0, 0, 2, packet.SHARED_SUBSCRIPTION_AVAILABLE_ID, 0}, connAck)
+	_, err := client.Write(subscribePacket(1, "$share/g/a", 0, 5))
+	require.NoError(t, err)
+	packetType, body := readRaw(t, client)
+	assert.Equal(t, byte(packet.SUBACK), packetType)
+	assert.Equal(t, []byte{0, 1, 0, packet.ReasonCodeSharedSubscriptionsNotSupported}, body)
+}
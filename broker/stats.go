@@ -0,0 +1,177 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// PacketStats counts the packets of one type and their size in bytes,
+// including the fixed header.
+type PacketStats struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// Stats is a snapshot of the statistics of a Server.
+type Stats struct {
+	Uptime time.Duration
+	// ClientsConnected is the number of connected clients,
+	// ClientsDisconnected the number of sessions of offline clients.
+	ClientsConnected    int
+	ClientsDisconnected int
+	Subscriptions       int
+	RetainedMessages    int
+	// Received and Sent are indexed by control packet type.
+	Received [16]PacketStats
+	Sent     [16]PacketStats
+}
+
+// packetCounters are PacketStats per control packet type, updated
+// atomically.
+type packetCounters [16]PacketStats
+
+func (c *packetCounters) add(packetType byte, size int) {
+	atomic.AddUint64(&c[packetType].Packets, 1)
+	atomic.AddUint64(&c[packetType].Bytes, uint64(size))
+}
+
+func (c *packetCounters) snapshot() (snapshot [16]PacketStats) {
+	for i := range c {
+		snapshot[i].Packets = atomic.LoadUint64(&c[i].Packets)
+		snapshot[i].Bytes = atomic.LoadUint64(&c[i].Bytes)
+	}
+	return
+}
+
+// traffic holds the packet counters of a Server.
+type traffic struct {
+	received packetCounters
+	sent     packetCounters
+}
+
+type meterState int
+
+const (
+	meterAwaitingType meterState = iota
+	meterReadingLength
+	meterReadingBody
+)
+
+// packetMeter follows the packet boundaries in a stream of MQTT packets and
+// counts each complete packet.
+type packetMeter struct {
+	counters *packetCounters
+
+	state      meterState
+	packetType byte
+	size       int
+	remaining  int
+	multiplier int
+}
+
+func (m *packetMeter) observe(b []byte) {
+	for len(b) > 0 {
+		switch m.state {
+		case meterAwaitingType:
+			m.packetType = b[0] >> 4
+			m.size, m.remaining, m.multiplier = 1, 0, 1
+			m.state = meterReadingLength
+			b = b[1:]
+		case meterReadingLength:
+			m.size++
+			m.remaining += int(b[0]&127) * m.multiplier
+			m.multiplier *= 128
+			more := b[0]&128 != 0
+			b = b[1:]
+			if !more {
+				m.state = meterReadingBody
+				if m.remaining == 0 {
+					m.done()
+				}
+			}
+		case meterReadingBody:
+			n := len(b)
+			if n > m.remaining {
+				n = m.remaining
+			}
+			m.size += n
+			m.remaining -= n
+			b = b[n:]
+			if m.remaining == 0 {
+				m.done()
+			}
+		}
+	}
+}
+
+func (m *packetMeter) done() {
+	m.counters.add(m.packetType, m.size)
+	m.state = meterAwaitingType
+}
+
+// meteredConn counts the packets read from and written to a connection.
+// Reads and writes may happen concurrently, but not several reads or
+// several writes.
+type meteredConn struct {
+	net.Conn
+	in, out packetMeter
+}
+
+func newMeteredConn(conn net.Conn, t *traffic) *meteredConn {
+	return &meteredConn{
+		Conn: conn,
+		in:   packetMeter{counters: &t.received},
+		out:  packetMeter{counters: &t.sent},
+	}
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.observe(b[:n])
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.observe(b[:n])
+	return n, err
+}
+
+// Stats returns the current statistics of the Server.
+func (s *Server) Stats() Stats {
+	stats := Stats{
+		Uptime:           time.Since(s.started),
+		Subscriptions:    s.subscriptions.Len(),
+		RetainedMessages: s.retained.Len(),
+		Received:         s.traffic.received.snapshot(),
+		Sent:             s.traffic.sent.snapshot(),
+	}
+	s.mu.Lock()
+	for _, sess := range s.sessions {
+		if sess.client != nil {
+			stats.ClientsConnected++
+		} else {
+			stats.ClientsDisconnected++
+		}
+	}
+	s.mu.Unlock()
+	return stats
+}
@@ -0,0 +1,314 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// Subscriber is a client matched by SubscriptionTree.Match. If several
+// subscriptions of the client match, they are merged: QoS is the maximum of
+// the matching subscriptions and RetainAsPublished is set if any of them
+// has it set.
+type Subscriber struct {
+	ClientID     string
+	Subscription packet.Subscription
+}
+
+// SharedGroup is a shared subscription matched by
+// SubscriptionTree.MatchShared. Filter is the full topic filter including
+// "$share/<group>/", Members are sorted by client ID.
+type SharedGroup struct {
+	Filter  string
+	Members []Subscriber
+}
+
+type subscriptionNode struct {
+	children    map[string]*subscriptionNode
+	subscribers map[string]packet.Subscription
+	// shared maps share names to their members
+	shared map[string]map[string]packet.Subscription
+}
+
+func newSubscriptionNode() *subscriptionNode {
+	return &subscriptionNode{
+		children:    make(map[string]*subscriptionNode),
+		subscribers: make(map[string]packet.Subscription),
+		shared:      make(map[string]map[string]packet.Subscription),
+	}
+}
+
+// subscribersFor returns the map holding the subscriptions to filter at
+// this node, nil if there is none. filter is the full topic filter.
+func (n *subscriptionNode) subscribersFor(filter string, create bool) map[string]packet.Subscription {
+	group, _, shared := parseSharedFilter(filter)
+	if !shared {
+		return n.subscribers
+	}
+	members, ok := n.shared[group]
+	if !ok && create {
+		members = make(map[string]packet.Subscription)
+		n.shared[group] = members
+	}
+	return members
+}
+
+// splitFilter returns the topic levels of filter, without the "$share/<group>"
+// prefix of shared subscriptions.
+func splitFilter(filter string) []string {
+	if _, topicFilter, shared := parseSharedFilter(filter); shared {
+		filter = topicFilter
+	}
+	return strings.Split(filter, "/")
+}
+
+// SubscriptionTree is a concurrency-safe index of subscriptions. It is a
+// trie with one level per topic level, "+" and "#" are stored as regular
+// children and followed during matching. Shared subscriptions are stored
+// at the node of their filter, grouped by share name.
+type SubscriptionTree struct {
+	mu      sync.RWMutex
+	root    *subscriptionNode
+	clients map[string]map[string]struct{}
+	count   int
+}
+
+func NewSubscriptionTree() *SubscriptionTree {
+	return &SubscriptionTree{
+		root:    newSubscriptionNode(),
+		clients: make(map[string]map[string]struct{}),
+	}
+}
+
+// Subscribe adds or replaces the subscription of clientID to sub.Topic. It
+// reports whether the subscription is new.
+func (t *SubscriptionTree) Subscribe(clientID string, sub packet.Subscription) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.root
+	for _, level := range splitFilter(sub.Topic) {
+		child, ok := n.children[level]
+		if !ok {
+			child = newSubscriptionNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+	subscribers := n.subscribersFor(sub.Topic, true)
+	_, existed := subscribers[clientID]
+	subscribers[clientID] = sub
+	if existed {
+		return false
+	}
+
+	filters, ok := t.clients[clientID]
+	if !ok {
+		filters = make(map[string]struct{})
+		t.clients[clientID] = filters
+	}
+	filters[sub.Topic] = struct{}{}
+	t.count++
+	return true
+}
+
+// Unsubscribe removes the subscription of clientID to filter and reports
+// whether it existed.
+func (t *SubscriptionTree) Unsubscribe(clientID, filter string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.unsubscribe(clientID, filter)
+}
+
+// UnsubscribeAll removes all subscriptions of clientID.
+func (t *SubscriptionTree) UnsubscribeAll(clientID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for filter := range t.clients[clientID] {
+		t.unsubscribe(clientID, filter)
+	}
+}
+
+func (t *SubscriptionTree) unsubscribe(clientID, filter string) bool {
+	filterLevels := splitFilter(filter)
+	path := make([]*subscriptionNode, 0, len(filterLevels)+1)
+	n := t.root
+	path = append(path, n)
+	for _, level := range filterLevels {
+		child, ok := n.children[level]
+		if !ok {
+			return false
+		}
+		n = child
+		path = append(path, n)
+	}
+	subscribers := n.subscribersFor(filter, false)
+	if _, ok := subscribers[clientID]; !ok {
+		return false
+	}
+	delete(subscribers, clientID)
+	if group, _, shared := parseSharedFilter(filter); shared && len(subscribers) == 0 {
+		delete(n.shared, group)
+	}
+
+	// Prune nodes without subscribers and children
+	for i := len(filterLevels) - 1; i >= 0; i-- {
+		node := path[i+1]
+		if len(node.subscribers) > 0 || len(node.shared) > 0 || len(node.children) > 0 {
+			break
+		}
+		delete(path[i].children, filterLevels[i])
+	}
+
+	delete(t.clients[clientID], filter)
+	if len(t.clients[clientID]) == 0 {
+		delete(t.clients, clientID)
+	}
+	t.count--
+	return true
+}
+
+// Subscriptions returns the subscriptions of clientID.
+func (t *SubscriptionTree) Subscriptions(clientID string) []packet.Subscription {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var subs []packet.Subscription
+	for filter := range t.clients[clientID] {
+		subs = append(subs, t.find(filter)[clientID])
+	}
+	return subs
+}
+
+// find returns the subscribers of filter, nil if there are none.
+func (t *SubscriptionTree) find(filter string) map[string]packet.Subscription {
+	n := t.root
+	for _, level := range splitFilter(filter) {
+		child, ok := n.children[level]
+		if !ok {
+			return nil
+		}
+		n = child
+	}
+	return n.subscribersFor(filter, false)
+}
+
+// SharedMembers returns the members of the shared subscription filter,
+// sorted by client ID.
+func (t *SubscriptionTree) SharedMembers(filter string) []Subscriber {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return sortedSubscribers(t.find(filter))
+}
+
+func sortedSubscribers(subscriptions map[string]packet.Subscription) []Subscriber {
+	subscribers := make([]Subscriber, 0, len(subscriptions))
+	for clientID, sub := range subscriptions {
+		subscribers = append(subscribers, Subscriber{ClientID: clientID, Subscription: sub})
+	}
+	sort.Slice(subscribers, func(i, j int) bool {
+		return subscribers[i].ClientID < subscribers[j].ClientID
+	})
+	return subscribers
+}
+
+// Len returns the number of subscriptions.
+func (t *SubscriptionTree) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.count
+}
+
+// Match returns the clients subscribed to topic, each client only once.
+// Subscriptions with No Local set are skipped for publisherID.
+func (t *SubscriptionTree) Match(topic string, publisherID string) []Subscriber {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	matched := make(map[string]packet.Subscription)
+	collect := func(n *subscriptionNode) {
+		for clientID, sub := range n.subscribers {
+			if sub.NoLocal && clientID == publisherID {
+				continue
+			}
+			if existing, ok := matched[clientID]; ok {
+				if existing.QoS > sub.QoS {
+					sub.QoS = existing.QoS
+				}
+				sub.RetainAsPublished = sub.RetainAsPublished || existing.RetainAsPublished
+			}
+			matched[clientID] = sub
+		}
+	}
+	levels := strings.Split(topic, "/")
+	t.root.match(levels, 0, strings.HasPrefix(topic, "$"), collect)
+
+	subscribers := make([]Subscriber, 0, len(matched))
+	for clientID, sub := range matched {
+		subscribers = append(subscribers, Subscriber{ClientID: clientID, Subscription: sub})
+	}
+	return subscribers
+}
+
+// MatchShared returns the shared subscriptions matching topic. Each group
+// receives the message once, the member is chosen by the caller.
+func (t *SubscriptionTree) MatchShared(topic string) []SharedGroup {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var groups []SharedGroup
+	collect := func(n *subscriptionNode) {
+		for _, members := range n.shared {
+			sorted := sortedSubscribers(members)
+			groups = append(groups, SharedGroup{
+				Filter:  sorted[0].Subscription.Topic,
+				Members: sorted,
+			})
+		}
+	}
+	levels := strings.Split(topic, "/")
+	t.root.match(levels, 0, strings.HasPrefix(topic, "$"), collect)
+	return groups
+}
+
+// match calls collect for every node matching levels[i:]. Wildcards on the
+// first level don't match topics starting with "$".
+func (n *subscriptionNode) match(levels []string, i int, dollar bool, collect func(*subscriptionNode)) {
+	wildcards := i > 0 || !dollar
+	if wildcards {
+		// "#" also matches the parent level, "a/#" matches "a"
+		if child, ok := n.children["#"]; ok {
+			collect(child)
+		}
+	}
+	if i == len(levels) {
+		collect(n)
+		return
+	}
+	if wildcards {
+		if child, ok := n.children["+"]; ok {
+			child.match(levels, i+1, dollar, collect)
+		}
+	}
+	if child, ok := n.children[levels[i]]; ok {
+		child.match(levels, i+1, dollar, collect)
+	}
+}
@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionTreeMatch(t *testing.T) {
+	tree := NewSubscriptionTree()
+	tree.Subscribe("a", packet.Subscription{Topic: "sensors/+/temp", QoS: packet.QoSLevelNone})
+	tree.Subscribe("a", packet.Subscription{Topic: "sensors/#", QoS: packet.QoSLevelExactlyOnce})
+	tree.Subscribe("b", packet.Subscription{Topic: "sensors/1/temp", QoS: packet.QoSLevelAtLeastOnce, NoLocal: true})
+	tree.Subscribe("c", packet.Subscription{Topic: "#"})
+
+	subscribers := tree.Match("sensors/1/temp", "b")
+	assert.Len(t, subscribers, 2, "a once, b skipped due to No Local, c")
+	for _, s := range subscribers {
+		if s.ClientID == "a" {
+			assert.Equal(t, packet.QoSLevelExactlyOnce, s.Subscription.QoS)
+		}
+	}
+
+	assert.Len(t, tree.Match("sensors", ""), 2, "sensors/# matches the parent level")
+	assert.Len(t, tree.Match("$SYS/uptime", ""), 0)
+
+	tree.Subscribe("c", packet.Subscription{Topic: "$SYS/+"})
+	assert.Len(t, tree.Match("$SYS/uptime", ""), 1)
+}
+
+func TestSubscriptionTreeUnsubscribe(t *testing.T) {
+	tree := NewSubscriptionTree()
+	assert.True(t, tree.Subscribe("a", packet.Subscription{Topic: "a/b/c"}))
+	assert.False(t, tree.Subscribe("a", packet.Subscription{Topic: "a/b/c", QoS: packet.QoSLevelAtLeastOnce}))
+	tree.Subscribe("a", packet.Subscription{Topic: "x"})
+	assert.Equal(t, 2, tree.Len())
+	assert.Len(t, tree.Subscriptions("a"), 2)
+
+	assert.False(t, tree.Unsubscribe("a", "a/b"))
+	assert.True(t, tree.Unsubscribe("a", "a/b/c"))
+	assert.Empty(t, tree.root.children["a"], "empty nodes are pruned")
+
+	tree.UnsubscribeAll("a")
+	assert.Equal(t, 0, tree.Len())
+	assert.Empty(t, tree.Match("x", ""))
+}
+
+var (
+	benchmarkTree     *SubscriptionTree
+	benchmarkTreeOnce sync.Once
+)
+
+// populatedTree returns a tree with 1M subscriptions of 100k clients, each
+// subscribed to its own devices and to some shared wildcard filters.
+func populatedTree() *SubscriptionTree {
+	benchmarkTreeOnce.Do(func() {
+		benchmarkTree = NewSubscriptionTree()
+		for i := 0; i < 1000000; i++ {
+			clientID := fmt.Sprintf("client-%d", i%100000)
+			var filter string
+			switch i % 4 {
+			case 0:
+				filter = fmt.Sprintf("tenant/%d/device/%d/telemetry", i%1000, i)
+			case 1:
+				filter = fmt.Sprintf("tenant/%d/device/%d/#", i%1000, i)
+			case 2:
+				filter = fmt.Sprintf("tenant/%d/device/+/state/%d", i%1000, i%50)
+			case 3:
+				filter = fmt.Sprintf("tenant/%d/+/%d/telemetry", i%1000, i)
+			}
+			benchmarkTree.Subscribe(clientID, packet.Subscription{Topic: filter})
+		}
+	})
+	return benchmarkTree
+}
+
+func BenchmarkSubscriptionTreeMatch(b *testing.B) {
+	tree := populatedTree()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Match(fmt.Sprintf("tenant/%d/device/%d/telemetry", i%1000, i%1000000), "")
+	}
+}
+
+func BenchmarkSubscriptionTreeMatchParallel(b *testing.B) {
+	tree := populatedTree()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			tree.Match(fmt.Sprintf("tenant/%d/device/%d/state/%d", i%1000, i, i%50), "")
+			i++
+		}
+	})
+}
+
+func BenchmarkSubscriptionTreeSubscribe(b *testing.B) {
+	tree := populatedTree()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filter := fmt.Sprintf("bench/%d/+/value", i)
+		tree.Subscribe("bench", packet.Subscription{Topic: filter})
+		tree.Unsubscribe("bench", filter)
+	}
+}
@@ -0,0 +1,108 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// Version is the version of the broker, published to $SYS/broker/version.
+const Version = "0.1.0"
+
+const sysPrefix = "$SYS/"
+
+// isSysFilter reports whether filter, or the filter of a shared
+// subscription, matches $SYS topics.
+func isSysFilter(filter string) bool {
+	if _, topicFilter, ok := parseSharedFilter(filter); ok {
+		filter = topicFilter
+	}
+	return filter == "$SYS" || strings.HasPrefix(filter, sysPrefix)
+}
+
+// sysAdmin reports whether the client may subscribe to $SYS topics.
+func (s *Server) sysAdmin(info ClientInfo) bool {
+	return s.SysAdmin != nil && s.SysAdmin(info)
+}
+
+// sysTopics returns the values published below $SYS/broker/, in the format
+// used by mosquitto. Counters per packet type are only included once they
+// are not 0.
+func sysTopics(stats Stats) map[string]string {
+	itoa := func(v int) string { return strconv.Itoa(v) }
+	utoa := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	topics := map[string]string{
+		"$SYS/broker/version":                 "mqtt-go version " + Version,
+		"$SYS/broker/uptime":                  utoa(uint64(stats.Uptime/time.Second)) + " seconds",
+		"$SYS/broker/clients/connected":       itoa(stats.ClientsConnected),
+		"$SYS/broker/clients/disconnected":    itoa(stats.ClientsDisconnected),
+		"$SYS/broker/clients/total":           itoa(stats.ClientsConnected + stats.ClientsDisconnected),
+		"$SYS/broker/subscriptions/count":     itoa(stats.Subscriptions),
+		"$SYS/broker/retained messages/count": itoa(stats.RetainedMessages),
+	}
+
+	var total [2]PacketStats
+	for i, counters := range [2]*[16]PacketStats{&stats.Received, &stats.Sent} {
+		direction := [2]string{"received", "sent"}[i]
+		for packetType, c := range counters {
+			total[i].Packets += c.Packets
+			total[i].Bytes += c.Bytes
+			if c.Packets == 0 {
+				continue
+			}
+			name := strings.ToLower(packet.ControlPacketType(packetType).String())
+			topics["$SYS/broker/"+name+"/messages/"+direction] = utoa(c.Packets)
+			topics["$SYS/broker/"+name+"/bytes/"+direction] = utoa(c.Bytes)
+		}
+		topics["$SYS/broker/messages/"+direction] = utoa(total[i].Packets)
+		topics["$SYS/broker/bytes/"+direction] = utoa(total[i].Bytes)
+	}
+	return topics
+}
+
+// publishSys publishes the statistics to the $SYS topics every
+// SysInterval until the Server is shut down. The messages are retained and
+// only published when the value changed.
+func (s *Server) publishSys() {
+	ticker := time.NewTicker(s.SysInterval)
+	defer ticker.Stop()
+
+	published := make(map[string]string)
+	for {
+		for topic, value := range sysTopics(s.Stats()) {
+			if published[topic] == value {
+				continue
+			}
+			published[topic] = value
+			p := packet.NewPublish(topic, 0, []byte(value), 4)
+			p.FixedHeaderFlags.Retain = true
+			s.retained.Set(p)
+			s.route("", p)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
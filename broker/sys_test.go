@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketMeter(t *testing.T) {
+	var counters packetCounters
+	m := packetMeter{counters: &counters}
+	stream := append(withFixedHeader(packet.PUBLISH<<4, append(mqttString("a"), "xyz"...)), packet.PINGREQ<<4, 0)
+	for _, b := range stream {
+		m.observe([]byte{b})
+	}
+	m.observe(stream)
+
+	assert.Equal(t, PacketStats{Packets: 2, Bytes: 16}, counters[packet.PUBLISH])
+	assert.Equal(t, PacketStats{Packets: 2, Bytes: 4}, counters[packet.PINGREQ])
+}
+
+func TestSysTopics(t *testing.T) {
+	stats := Stats{
+		Uptime:              90 * time.Second,
+		ClientsConnected:    2,
+		ClientsDisconnected: 1,
+	}
+	stats.Received[packet.PUBLISH] = PacketStats{Packets: 3, Bytes: 30}
+	stats.Received[packet.CONNECT] = PacketStats{Packets: 2, Bytes: 40}
+
+	topics := sysTopics(stats)
+	assert.Equal(t, "90 seconds", topics["$SYS/broker/uptime"])
+	assert.Equal(t, "3", topics["$SYS/broker/clients/total"])
+	assert.Equal(t, "3", topics["$SYS/broker/publish/messages/received"])
+	assert.Equal(t, "30", topics["$SYS/broker/publish/bytes/received"])
+	assert.Equal(t, "5", topics["$SYS/broker/messages/received"])
+	assert.Equal(t, "70", topics["$SYS/broker/bytes/received"])
+	assert.Equal(t, "0", topics["$SYS/broker/messages/sent"])
+	assert.NotContains(t, topics, "$SYS/broker/publish/messages/sent")
+}
+
+func TestServerSys(t *testing.T) {
+	s := NewServer()
+	s.SysInterval = 10 * time.Millisecond
+	s.SysAdmin = func(info ClientInfo) bool { return info.ClientID == "admin" }
+	defer s.Shutdown(context.Background())
+
+	user := connect(t, s, "user", 5)
+	defer user.Close()
+	_, err := user.Write(subscribePacket(1, "$SYS/#", 0, 5))
+	require.NoError(t, err)
+	packetType, body := readRaw(t, user)
+	require.Equal(t, byte(packet.SUBACK), packetType)
+	assert.Equal(t, packet.ReasonCodeNotAuthorized, body[len(body)-1])
+
+	admin := connect(t, s, "admin", 5)
+	defer admin.Close()
+	subscribe(t, admin, "$SYS/broker/version", 0, 5)
+	p := readPublish(t, admin, 5)
+	assert.Equal(t, "$SYS/broker/version", p.VariableHeader.Topic)
+	assert.Equal(t, []byte("mqtt-go version "+Version), p.Payload)
+
+	// Clients can't publish to $SYS topics
+	subscribe(t, admin, "$SYS/fake", 0, 5)
+	writePublish(t, user, "$SYS/fake", "x", packet.QoSLevelNone, 0, 5)
+	_, err = admin.Write([]byte{packet.PINGREQ << 4, 0})
+	require.NoError(t, err)
+	packetType, _ = readRaw(t, admin)
+	assert.Equal(t, byte(packet.PINGRESP), packetType)
+}
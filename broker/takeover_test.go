@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readUntilClosed returns the packets types read from c until the
+// connection is closed.
+func readUntilClosed(c net.Conn) <-chan []byte {
+	types := make(chan []byte, 1)
+	go func() {
+		var read []byte
+		b := make([]byte, 2)
+		for {
+			if _, err := io.ReadFull(c, b); err != nil {
+				break
+			}
+			read = append(read, b[0]>>4)
+			if _, err := io.CopyN(ioutil.Discard, c, int64(b[1])); err != nil {
+				break
+			}
+		}
+		types <- read
+	}()
+	return types
+}
+
+func TestSessionTakeover(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	sessionExpiry := []byte{packet.SESSION_EXPIRY_INTERVAL_ID, 0, 0, 0, 60}
+	first, _ := connectRaw(t, s, connectPacketWithFlags("c", 5, 0, sessionExpiry))
+	subscribe(t, first, "a", 1, 5)
+	require.NoError(t, first.SetReadDeadline(time.Now().Add(time.Second)))
+	closed := readUntilClosed(first)
+
+	second, connAck := connectRaw(t, s, connectPacketWithFlags("c", 5, 0, sessionExpiry))
+	defer second.Close()
+	assert.Equal(t, byte(1), connAck[0], "session present")
+	assert.Equal(t, []byte{packet.DISCONNECT}, <-closed)
+
+	publisher := connect(t, s, "pub", 5)
+	defer publisher.Close()
+	writePublish(t, publisher, "a", "x", packet.QoSLevelAtLeastOnce, 1, 5)
+	assert.Equal(t, []byte("x"), readPublish(t, second, 5).Payload, "subscription transferred")
+}
+
+func TestSessionTakeoverWill(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+	watcher := subscribeToWill(t, s)
+	defer watcher.Close()
+
+	// A Will Delay Interval longer than the takeover suppresses the will
+	sessionExpiry := []byte{packet.SESSION_EXPIRY_INTERVAL_ID, 0, 0, 0, 60}
+	willDelay := []byte{packet.WILL_DELAY_INTERVAL_ID, 0, 0, 0, 30}
+	first, _ := connectRaw(t, s, willConnectPacket("c", 5, 0, sessionExpiry, willDelay))
+	closed := readUntilClosed(first)
+	second, _ := connectRaw(t, s, willConnectPacket("c", 4, 0, nil, nil))
+	<-closed
+	expectWill(t, watcher, false)
+
+	// Without delay the will of the old connection is published
+	closed = readUntilClosed(second)
+	third, _ := connectRaw(t, s, connectPacket("c", 4))
+	defer third.Close()
+	<-closed
+	expectWill(t, watcher, true)
+}
+
+func TestSessionTakeoverConcurrent(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	const clients = 10
+	closed := make(chan []byte, clients)
+	for i := 0; i < clients; i++ {
+		server, client := net.Pipe()
+		defer client.Close()
+		go s.ServeConn(server)
+		go func() {
+			if _, err := client.Write(connectPacket("c", 5)); err == nil {
+				closed <- <-readUntilClosed(client)
+			}
+		}()
+	}
+
+	for i := 0; i < clients-1; i++ {
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("Connections not taken over in time")
+		}
+	}
+	waitFor(t, func() bool {
+		exists, online := sessionState(s, "c")
+		return exists && online
+	})
+	s.mu.Lock()
+	assert.Len(t, s.conns, 1)
+	s.mu.Unlock()
+}
@@ -0,0 +1,263 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig configures a TLS listener, see ListenTLS.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM encoded certificate chain and
+	// private key of the Server.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile contains the PEM encoded CA certificates used to verify
+	// client certificates.
+	ClientCAFile string
+	// ClientAuth is tls.NoClientCert (the default) to not ask for client
+	// certificates, tls.VerifyClientCertIfGiven to make them optional or
+	// tls.RequireAndVerifyClientCert to require them. Verifying client
+	// certificates requires ClientCAFile.
+	ClientAuth tls.ClientAuthType
+	// CipherSuites are the enabled cipher suites for TLS 1.2 and earlier,
+	// nil means the defaults of package tls.
+	CipherSuites []uint16
+	// MinVersion is the minimum TLS version accepted, 0 means TLS 1.2.
+	MinVersion uint16
+	// ReloadInterval is the interval at which the files are checked for
+	// changes during handshakes, changed files are loaded again. 0 disables
+	// reloading. If loading fails, the previous files stay in use.
+	ReloadInterval time.Duration
+	// ErrorLog is used for errors reloading the files. If nil, the log
+	// package's standard logger is used.
+	ErrorLog *log.Logger
+}
+
+// ListenTLS listens on the network address addr and serves TLS as
+// configured by config on the accepted connections.
+func ListenTLS(network, addr string, config TLSConfig) (net.Listener, error) {
+	tlsConfig, err := config.Build()
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, tlsConfig), nil
+}
+
+// Build loads the files of c and returns a tls.Config using them, for
+// listeners not created by ListenTLS.
+func (c TLSConfig) Build() (*tls.Config, error) {
+	if c.ClientAuth >= tls.VerifyClientCertIfGiven && c.ClientCAFile == "" {
+		return nil, errors.New("broker: Verifying client certificates requires a client CA file")
+	}
+	store := &certificateStore{config: c}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetConfigForClient: store.getConfigForClient}, nil
+}
+
+// certificateStore holds the tls.Config built from the files of a TLSConfig
+// and reloads it when the files change.
+type certificateStore struct {
+	config TLSConfig
+
+	mu       sync.Mutex
+	current  *tls.Config
+	modTimes []time.Time
+	checked  time.Time
+}
+
+func (s *certificateStore) files() []string {
+	files := []string{s.config.CertFile, s.config.KeyFile}
+	if s.config.ClientCAFile != "" {
+		files = append(files, s.config.ClientCAFile)
+	}
+	return files
+}
+
+// readModTimes returns the modification times of the files.
+func (s *certificateStore) readModTimes() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range s.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// load reads the files and replaces the current tls.Config. It must be
+// called with mu held, except by Build.
+func (s *certificateStore) load() error {
+	modTimes, err := s.readModTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   s.config.ClientAuth,
+		CipherSuites: s.config.CipherSuites,
+		MinVersion:   s.config.MinVersion,
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if s.config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(s.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("broker: No certificates found in " + s.config.ClientCAFile)
+		}
+	}
+	s.current = config
+	s.modTimes = modTimes
+	s.checked = time.Now()
+	return nil
+}
+
+func (s *certificateStore) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.config.ReloadInterval > 0 && time.Since(s.checked) >= s.config.ReloadInterval {
+		s.checked = time.Now()
+		if s.changed() {
+			if err := s.load(); err != nil {
+				s.logf("broker: Reloading TLS files: %v", err)
+			}
+		}
+	}
+	return s.current, nil
+}
+
+// changed reports whether any file has been modified since it was loaded.
+func (s *certificateStore) changed() bool {
+	modTimes, err := s.readModTimes()
+	if err != nil {
+		// Files being replaced may be missing for a moment
+		return false
+	}
+	for i, modTime := range modTimes {
+		if !modTime.Equal(s.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *certificateStore) logf(format string, args ...interface{}) {
+	if s.config.ErrorLog != nil {
+		s.config.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// CertificateIdentity selects the field of a verified client certificate
+// identifying the client.
+type CertificateIdentity int
+
+const (
+	// IdentityNone doesn't use the certificate.
+	IdentityNone CertificateIdentity = iota
+	// IdentityCommonName uses the common name of the subject.
+	IdentityCommonName
+	// IdentityDNSName uses the first DNS name of the subject alternative
+	// names.
+	IdentityDNSName
+	// IdentityEmailAddress uses the first email address of the subject
+	// alternative names.
+	IdentityEmailAddress
+	// IdentityURI uses the first URI of the subject alternative names.
+	IdentityURI
+)
+
+// certificateIdentity returns the identity of the client with the TLS
+// state, "" if it has no verified certificate or the field is empty.
+func certificateIdentity(state *tls.ConnectionState, identity CertificateIdentity) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	switch identity {
+	case IdentityCommonName:
+		return cert.Subject.CommonName
+	case IdentityDNSName:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case IdentityEmailAddress:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case IdentityURI:
+		return firstURI(cert)
+	}
+	return ""
+}
+
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// firstURI returns the first URI of the subject alternative names of cert.
+// The extension is parsed here as x509.Certificate has no URIs before Go
+// 1.10.
+func firstURI(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var names asn1.RawValue
+		if rest, err := asn1.Unmarshal(ext.Value, &names); err != nil || len(rest) > 0 || names.Tag != asn1.TagSequence {
+			return ""
+		}
+		for rest := names.Bytes; len(rest) > 0; {
+			var name asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+				return ""
+			}
+			// uniformResourceIdentifier [6] IA5String
+			if name.Class == asn1.ClassContextSpecific && name.Tag == 6 {
+				return string(name.Bytes)
+			}
+		}
+	}
+	return ""
+}
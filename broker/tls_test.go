@@ -0,0 +1,281 @@
+package broker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate signed by parent, a self-signed CA if
+// parent is nil.
+func newTestCert(t *testing.T, parent *testCert, template *x509.Certificate) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// writeFiles writes the PEM encoded certificate and key.
+func (c *testCert) writeFiles(t *testing.T, certFile, keyFile string) {
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+	if keyFile == "" {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+}
+
+type tlsFixture struct {
+	dir    string
+	ca     *testCert
+	client *testCert
+	config TLSConfig
+}
+
+func newTLSFixture(t *testing.T) *tlsFixture {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	f := &tlsFixture{dir: dir}
+	f.ca = newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}})
+	f.ca.writeFiles(t, filepath.Join(dir, "ca.pem"), "")
+	server := newTestCert(t, f.ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "broker"},
+		DNSNames:    []string{"broker"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	server.writeFiles(t, filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+	f.client = newTestCert(t, f.ca, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "device-1"},
+		DNSNames:       []string{"device-1.example.com"},
+		EmailAddresses: []string{"owner@example.com"},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	f.config = TLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	return f
+}
+
+func (f *tlsFixture) close() {
+	_ = os.RemoveAll(f.dir) // nolint: gosec
+}
+
+// drainingConn reads while closing, the close_notify alerts of both sides
+// would block each other on a pipe otherwise.
+type drainingConn struct {
+	*tls.Conn
+}
+
+func (c drainingConn) Close() error {
+	go io.Copy(ioutil.Discard, c.Conn) // nolint: errcheck
+	return c.Conn.Close()
+}
+
+// dial connects a TLS client with the client certificate, if withCert is
+// set, to s over a pipe.
+func (f *tlsFixture) dial(t *testing.T, s *Server, serverConfig *tls.Config, withCert bool) net.Conn {
+	roots := x509.NewCertPool()
+	roots.AddCert(f.ca.cert)
+	clientConfig := &tls.Config{RootCAs: roots, ServerName: "broker"}
+	if withCert {
+		clientConfig.Certificates = []tls.Certificate{f.client.tlsCertificate()}
+	}
+	server, client := net.Pipe()
+	go s.ServeConn(tls.Server(server, serverConfig))
+	return drainingConn{tls.Client(client, clientConfig)}
+}
+
+func TestTLSClientCertificateIdentity(t *testing.T) {
+	f := newTLSFixture(t)
+	defer f.close()
+	config, err := f.config.Build()
+	require.NoError(t, err)
+
+	s := NewServer()
+	s.CertificateClientID = IdentityCommonName
+	s.CertificateUserName = IdentityEmailAddress
+	connected := make(chan ClientInfo, 1)
+	s.Hooks.OnConnect = func(info ClientInfo) { connected <- info }
+	defer s.Shutdown(context.Background())
+
+	client := f.dial(t, s, config, true)
+	defer client.Close()
+	_, err = client.Write(credentialsConnectPacket("", 5, "other", "secret"))
+	require.NoError(t, err)
+	packetType, body := readRaw(t, client)
+	require.Equal(t, byte(packet.CONNACK), packetType)
+	assert.Equal(t, packet.ReasonCodeSuccess, body[1])
+	info := <-connected
+	assert.Equal(t, "device-1", info.ClientID)
+	assert.Equal(t, "owner@example.com", info.UserName)
+
+	// Without certificate the CONNECT is used as is
+	client = f.dial(t, s, config, false)
+	defer client.Close()
+	_, err = client.Write(credentialsConnectPacket("c", 5, "other", "secret"))
+	require.NoError(t, err)
+	readRaw(t, client)
+	info = <-connected
+	assert.Equal(t, "c", info.ClientID)
+	assert.Equal(t, "other", info.UserName)
+}
+
+func TestCertificateIdentityURI(t *testing.T) {
+	// Subject alternative names with a DNS name and a URI
+	san, err := asn1.Marshal([]asn1.RawValue{
+		{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte("device-1.example.com")},
+		{Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte("spiffe://example.com/device-1")},
+	})
+	require.NoError(t, err)
+	cert := newTestCert(t, nil, &x509.Certificate{
+		Subject:         pkix.Name{CommonName: "device-1"},
+		ExtraExtensions: []pkix.Extension{{Id: oidSubjectAltName, Value: san}},
+	})
+	state := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert.cert}}}
+	assert.Equal(t, "spiffe://example.com/device-1", certificateIdentity(state, IdentityURI))
+	assert.Equal(t, "device-1.example.com", certificateIdentity(state, IdentityDNSName))
+
+	f := newTLSFixture(t)
+	defer f.close()
+	state = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{f.client.cert}}}
+	assert.Equal(t, "", certificateIdentity(state, IdentityURI))
+}
+
+func TestTLSRequireCertificateClientID(t *testing.T) {
+	f := newTLSFixture(t)
+	defer f.close()
+	f.config.ClientAuth = tls.RequireAndVerifyClientCert
+	config, err := f.config.Build()
+	require.NoError(t, err)
+
+	s := NewServer()
+	s.CertificateClientID = IdentityDNSName
+	s.RequireCertificateClientID = true
+	defer s.Shutdown(context.Background())
+
+	for clientID, code := range map[string]byte{
+		"device-1.example.com": packet.ReasonCodeSuccess,
+		"device-2":             packet.ReasonCodeClientIdentifierNotValid,
+	} {
+		client := f.dial(t, s, config, true)
+		_, err = client.Write(connectPacket(clientID, 5))
+		require.NoError(t, err)
+		_, body := readRaw(t, client)
+		assert.Equal(t, code, body[1], clientID)
+		client.Close()
+	}
+
+	// The certificate is required, the handshake fails
+	client := f.dial(t, s, config, false)
+	defer client.Close()
+	require.NoError(t, client.SetDeadline(time.Now().Add(time.Second)))
+	go client.Write(connectPacket("c", 5)) // nolint: errcheck
+	_, err = client.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.False(t, isTimeout(err), "%v", err)
+}
+
+func TestTLSConfigReload(t *testing.T) {
+	f := newTLSFixture(t)
+	defer f.close()
+	f.config.ReloadInterval = time.Nanosecond
+	config, err := f.config.Build()
+	require.NoError(t, err)
+
+	serverCert := func() *x509.Certificate {
+		hello := &tls.ClientHelloInfo{}
+		current, err := config.GetConfigForClient(hello)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(current.Certificates[0].Certificate[0])
+		require.NoError(t, err)
+		return cert
+	}
+	assert.Equal(t, "broker", serverCert().Subject.CommonName)
+
+	renewed := newTestCert(t, f.ca, &x509.Certificate{Subject: pkix.Name{CommonName: "renewed"}})
+	renewed.writeFiles(t, f.config.CertFile, f.config.KeyFile)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(f.config.CertFile, later, later))
+	assert.Equal(t, "renewed", serverCert().Subject.CommonName)
+
+	// A broken file keeps the previous certificate
+	require.NoError(t, ioutil.WriteFile(f.config.KeyFile, []byte("broken"), 0600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(f.config.KeyFile, later, later))
+	assert.Equal(t, "renewed", serverCert().Subject.CommonName)
+}
+
+func TestListenTLS(t *testing.T) {
+	f := newTLSFixture(t)
+	defer f.close()
+	_, err := ListenTLS("tcp", "127.0.0.1:0", TLSConfig{CertFile: f.config.CertFile, KeyFile: f.config.KeyFile, ClientAuth: tls.RequireAndVerifyClientCert})
+	assert.Error(t, err, "client CA file missing")
+
+	l, err := ListenTLS("tcp", "127.0.0.1:0", f.config)
+	require.NoError(t, err)
+	s := NewServer()
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(f.ca.cert)
+	client, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "broker"})
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write(connectPacket("c", 4))
+	require.NoError(t, err)
+	packetType, body := readRaw(t, client)
+	assert.Equal(t, byte(packet.CONNACK), packetType)
+	assert.Equal(t, packet.ConnAckAccepted, body[1])
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
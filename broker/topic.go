@@ -0,0 +1,99 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import "strings"
+
+// validTopicName reports whether name can be used in a PUBLISH.
+func validTopicName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "+#\x00")
+}
+
+// validTopicFilter reports whether filter can be used in a SUBSCRIBE. "#"
+// must be the last level and wildcards must occupy a whole level. Shared
+// subscriptions need a valid share name and filter.
+func validTopicFilter(filter string) bool {
+	if isSharedFilter(filter) {
+		_, topicFilter, ok := parseSharedFilter(filter)
+		return ok && !isSharedFilter(topicFilter) && validTopicFilter(topicFilter)
+	}
+	if filter == "" || strings.ContainsRune(filter, 0) {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// sharedPrefix starts the topic filter of a shared subscription,
+// "$share/<group>/<filter>".
+const sharedPrefix = "$share/"
+
+// parseSharedFilter splits the topic filter of a shared subscription into
+// the share name and the filter matched against topics. ok is false if
+// filter is not a shared subscription or the share name is invalid.
+func parseSharedFilter(filter string) (group, topicFilter string, ok bool) {
+	if !strings.HasPrefix(filter, sharedPrefix) {
+		return "", "", false
+	}
+	rest := filter[len(sharedPrefix):]
+	i := strings.IndexByte(rest, '/')
+	if i <= 0 {
+		return "", "", false
+	}
+	group, topicFilter = rest[:i], rest[i+1:]
+	if strings.ContainsAny(group, "+#") {
+		return "", "", false
+	}
+	return group, topicFilter, true
+}
+
+// isSharedFilter reports whether filter is a shared subscription.
+func isSharedFilter(filter string) bool {
+	return strings.HasPrefix(filter, sharedPrefix)
+}
+
+// matchTopic reports whether the topic name matches the topic filter.
+// Topics starting with "$" are not matched by filters starting with a
+// wildcard.
+func matchTopic(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
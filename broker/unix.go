@@ -0,0 +1,195 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errPeerCredentialsUnsupported = errors.New("broker: Peer credentials are not supported on this platform")
+
+// PeerCredentials identify the process connected to a Unix domain socket.
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// ListenUnix listens on the Unix domain socket path and sets the
+// permissions of the socket file to mode. The socket is created in a private
+// directory next to path and renamed to path once it has its permissions,
+// so it can't be connected to with the default ones. A socket file left over
+// by a previous run is replaced, other files are not.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket == 0 {
+		return nil, &os.PathError{Op: "listen", Path: path, Err: errors.New("file exists and is not a socket")}
+	}
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".mqtt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The listener would remove tmp, unixListener removes path instead
+	l.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, mode); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = l.Close() // nolint: gosec
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+// unixListener is a listener created by ListenUnix, closing it removes the
+// socket file.
+type unixListener struct {
+	*net.UnixListener
+	addr   *net.UnixAddr
+	remove sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr { return l.addr }
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.remove.Do(func() {
+		_ = os.Remove(l.addr.Name) // nolint: gosec
+	})
+	return err
+}
+
+// peerCredentials returns the credentials of the peer of a Unix domain
+// socket connection, nil for other connections or if they are not
+// available.
+func (c *client) peerCredentials() *PeerCredentials {
+	conn, ok := c.conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	peer, err := unixPeerCredentials(conn)
+	if err != nil {
+		if err != errPeerCredentialsUnsupported {
+			c.server.logf("broker: Peer credentials of %v: %v", conn.RemoteAddr(), err)
+		}
+		return nil
+	}
+	return peer
+}
+
+type peerCredentialsAuthenticator struct {
+	uids     map[uint32]bool
+	fallback Authenticator
+}
+
+// NewPeerCredentialsAuthenticator returns an Authenticator accepting the
+// clients connected to a Unix domain socket by a process of one of the
+// users uids, see AuthRequest.Peer, and refusing the other clients of Unix
+// domain sockets, including those whose credentials are not available.
+// Clients of other connections are authenticated by fallback, which refuses
+// them if nil.
+func NewPeerCredentialsAuthenticator(uids []uint32, fallback Authenticator) Authenticator {
+	a := peerCredentialsAuthenticator{uids: make(map[uint32]bool, len(uids)), fallback: fallback}
+	for _, uid := range uids {
+		a.uids[uid] = true
+	}
+	return a
+}
+
+func (a peerCredentialsAuthenticator) Authenticate(req AuthRequest) error {
+	if req.Peer != nil {
+		if a.uids[req.Peer.UID] {
+			return nil
+		}
+		return ErrNotAuthorized
+	}
+	if _, ok := req.RemoteAddr.(*net.UnixAddr); ok || a.fallback == nil {
+		return ErrNotAuthorized
+	}
+	return a.fallback.Authenticate(req)
+}
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// SystemdListener is a listener passed by systemd socket activation.
+type SystemdListener struct {
+	net.Listener
+	// Name is the FileDescriptorName of the socket unit, "unknown" if it
+	// has none.
+	Name string
+}
+
+// SystemdListeners returns the listening sockets passed by systemd socket
+// activation, in the order of the socket units, or none if the process
+// hasn't been started by socket activation. The environment variables of
+// the protocol are unset, so child processes don't use the sockets.
+func SystemdListeners() ([]SystemdListener, error) {
+	defer func() {
+		for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			_ = os.Unsetenv(name) // nolint: gosec
+		}
+	}()
+	return systemdListeners(os.Getenv, os.Getpid(), listenFDsStart)
+}
+
+func systemdListeners(getenv func(string) string, pid, firstFD int) ([]SystemdListener, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, errors.New("broker: Invalid LISTEN_FDS")
+	}
+	var names []string
+	if fdNames := getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	listeners := make([]SystemdListener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(firstFD+i), name)
+		// FileListener duplicates the file descriptor
+		l, err := net.FileListener(f)
+		_ = f.Close() // nolint: gosec
+		if err != nil {
+			for _, listener := range listeners {
+				_ = listener.Close() // nolint: gosec
+			}
+			return nil, err
+		}
+		listeners = append(listeners, SystemdListener{Listener: l, Name: name})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,102 @@
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerCredentialsAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := ListenUnix(filepath.Join(dir, "mqtt.sock"), 0600)
+	require.NoError(t, err)
+
+	uid := uint32(os.Getuid())
+	peers := make(chan *PeerCredentials, 2)
+	s := NewServer()
+	s.Authenticator = authenticatorFunc(func(req AuthRequest) error {
+		peers <- req.Peer
+		return NewPeerCredentialsAuthenticator([]uint32{uid}, nil).Authenticate(req)
+	})
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	client, err := net.Dial("unix", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write(connectPacket("c", 4))
+	require.NoError(t, err)
+	_, body := readRaw(t, client)
+	assert.Equal(t, packet.ConnAckAccepted, body[1])
+	peer := <-peers
+	require.NotNil(t, peer)
+	assert.Equal(t, uid, peer.UID)
+	assert.Equal(t, int32(os.Getpid()), peer.PID)
+
+	// Other users and, without fallback, TCP clients are refused
+	other := NewPeerCredentialsAuthenticator([]uint32{uid + 1}, nil)
+	assert.Equal(t, ErrNotAuthorized, other.Authenticate(AuthRequest{Peer: peer}))
+	assert.Equal(t, ErrNotAuthorized, other.Authenticate(AuthRequest{RemoteAddr: &net.TCPAddr{}}))
+	withFallback := NewPeerCredentialsAuthenticator(nil, NewAllowAllAuthenticator())
+	assert.NoError(t, withFallback.Authenticate(AuthRequest{RemoteAddr: &net.TCPAddr{}}))
+	assert.Equal(t, ErrNotAuthorized, withFallback.Authenticate(AuthRequest{RemoteAddr: &net.UnixAddr{}}))
+}
+
+func TestSystemdListeners(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcp.Close()
+	f, err := tcp.(*net.TCPListener).File()
+	require.NoError(t, err)
+	// The file descriptor passed is closed, it must not belong to f
+	fd, err := syscall.Dup(int(f.Fd()))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	env := map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "1", "LISTEN_FDNAMES": "mqtt"}
+	getenv := func(name string) string { return env[name] }
+
+	listeners, err := systemdListeners(getenv, 41, fd)
+	require.NoError(t, err)
+	assert.Empty(t, listeners, "sockets passed to another process")
+
+	listeners, err = systemdListeners(getenv, 42, fd)
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	assert.Equal(t, "mqtt", listeners[0].Name)
+	assert.Equal(t, tcp.Addr().String(), listeners[0].Addr().String())
+
+	s := NewServer()
+	go s.Serve(listeners[0])
+	defer s.Shutdown(context.Background())
+	client, err := net.Dial("tcp", tcp.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write(connectPacket("c", 4))
+	require.NoError(t, err)
+	packetType, _ := readRaw(t, client)
+	assert.Equal(t, byte(packet.CONNACK), packetType)
+
+	env["LISTEN_FDS"] = "x"
+	_, err = systemdListeners(getenv, 42, fd)
+	assert.Error(t, err)
+
+	require.NoError(t, os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid())))
+	require.NoError(t, os.Setenv("LISTEN_FDS", "0"))
+	listeners, err = SystemdListeners()
+	assert.NoError(t, err)
+	assert.Empty(t, listeners)
+	_, set := os.LookupEnv("LISTEN_PID")
+	assert.False(t, set)
+}
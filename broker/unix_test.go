@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mqtt.sock")
+
+	// A stale socket file is replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	l, err := ListenUnix(path, 0660)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+	assert.Equal(t, path, l.Addr().String())
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "private directory removed")
+
+	s := NewServer()
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	client, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write(connectPacket("c", 4))
+	require.NoError(t, err)
+	packetType, body := readRaw(t, client)
+	assert.Equal(t, byte(packet.CONNACK), packetType)
+	assert.Equal(t, packet.ConnAckAccepted, body[1])
+
+	require.NoError(t, l.Close())
+	_, err = os.Lstat(path)
+	assert.True(t, os.IsNotExist(err), "socket file removed")
+
+	// Other files are not replaced
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	_, err = ListenUnix(path, 0660)
+	assert.Error(t, err)
+}
+
+func TestUnixPeerCredentialsFailClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := ListenUnix(filepath.Join(dir, "mqtt.sock"), 0600)
+	require.NoError(t, err)
+	defer l.Close()
+
+	client, err := net.Dial("unix", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	peer, err := unixPeerCredentials(conn.(*net.UnixConn))
+	assert.True(t, (peer == nil) != (err == nil), "either credentials or an error")
+
+	// Unix domain socket clients without credentials are refused
+	a := NewPeerCredentialsAuthenticator([]uint32{uint32(os.Getuid())}, NewAllowAllAuthenticator())
+	assert.Equal(t, ErrNotAuthorized, a.Authenticate(AuthRequest{RemoteAddr: conn.RemoteAddr()}))
+}
@@ -0,0 +1,234 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// webSocketSubprotocols are the subprotocols accepted for MQTT over
+// WebSocket, "mqttv3.1" is offered by older MQTT 3.1 clients.
+var webSocketSubprotocols = []string{"mqtt", "mqttv3.1"}
+
+var errTextMessage = errors.New("broker: WebSocket text message received, MQTT requires binary messages")
+
+// WebSocketConfig configures a WebSocket endpoint, see ServeWebSocket.
+type WebSocketConfig struct {
+	// Path is the URL path of the endpoint, "/mqtt" if empty.
+	Path string
+	// AllowedOrigins are the values of the Origin header accepted, like
+	// "https://example.com". "*" accepts all origins. If empty, only
+	// requests from the host of the endpoint are accepted. Requests without
+	// Origin header, which are not sent by browsers, are always accepted.
+	AllowedOrigins []string
+	// HandshakeTimeout limits reading the HTTP request and the WebSocket
+	// handshake, 0 means the ConnectTimeout of the Server.
+	HandshakeTimeout time.Duration
+}
+
+// ServeWebSocket serves MQTT over WebSocket on l: HTTP requests to the path
+// of config are upgraded to WebSocket connections with the subprotocol
+// "mqtt" and served like the connections accepted by Serve. For TLS, pass a
+// listener created by ListenTLS. Shutdown also closes the HTTP connections
+// that haven't been upgraded yet. ServeWebSocket always returns a non-nil
+// error, ErrServerClosed after Shutdown.
+func (s *Server) ServeWebSocket(l net.Listener, config WebSocketConfig) error {
+	if !s.trackListener(l) {
+		return ErrServerClosed
+	}
+	defer s.untrackListener(l)
+
+	path := config.Path
+	if path == "" {
+		path = "/mqtt"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, s.WebSocketHandler(config))
+	hs := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: s.webSocketHandshakeTimeout(config),
+		ErrorLog:          s.ErrorLog,
+	}
+	err := hs.Serve(l)
+	select {
+	case <-s.done:
+		// Shutdown closed l, close the connections still in the handshake
+		_ = hs.Close() // nolint: gosec
+		return ErrServerClosed
+	default:
+		return err
+	}
+}
+
+// WebSocketHandler returns an http.Handler serving MQTT over WebSocket, for
+// adding the endpoint to an existing HTTP server. The Path of config is not
+// used. The connections are closed by Shutdown, the HTTP server is not.
+func (s *Server) WebSocketHandler(config WebSocketConfig) http.Handler {
+	upgrader := &websocket.Upgrader{
+		HandshakeTimeout: s.webSocketHandshakeTimeout(config),
+		Subprotocols:     webSocketSubprotocols,
+	}
+	if len(config.AllowedOrigins) > 0 {
+		allowed := config.AllowedOrigins
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			return allowedOrigin(r.Header.Get("Origin"), allowed)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !offersMQTT(websocket.Subprotocols(r)) {
+			http.Error(w, "WebSocket subprotocol mqtt required", http.StatusBadRequest)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The Upgrader has replied with an error
+			return
+		}
+		conn := &webSocketConn{ws: ws}
+		if tlsConn, ok := ws.UnderlyingConn().(tlsConnection); ok {
+			s.ServeConn(&tlsWebSocketConn{webSocketConn: conn, tls: tlsConn})
+			return
+		}
+		s.ServeConn(conn)
+	})
+}
+
+func (s *Server) webSocketHandshakeTimeout(config WebSocketConfig) time.Duration {
+	if config.HandshakeTimeout == 0 {
+		return s.ConnectTimeout
+	}
+	return config.HandshakeTimeout
+}
+
+func offersMQTT(protocols []string) bool {
+	for _, protocol := range protocols {
+		for _, supported := range webSocketSubprotocols {
+			if protocol == supported {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func allowedOrigin(origin string, allowed []string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(a, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// webSocketConn adapts a WebSocket connection to the byte stream expected
+// by package packet. Packets may span several messages and a message may
+// contain several packets. Each Write is sent as a binary message.
+type webSocketConn struct {
+	ws *websocket.Conn
+	// r reads the current message, only used by Read
+	r io.Reader
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			messageType, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				c.closeWith(websocket.CloseUnsupportedData)
+				return 0, errTextMessage
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends a close message before closing the connection.
+func (c *webSocketConn) Close() error {
+	c.closeWith(websocket.CloseNormalClosure)
+	return c.ws.Close()
+}
+
+func (c *webSocketConn) closeWith(code int) {
+	msg := websocket.FormatCloseMessage(code, "")
+	_ = c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)) // nolint: gosec
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *webSocketConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *webSocketConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *webSocketConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
+
+// tlsConnection is a *tls.Conn or a TLS connection of a listener of
+// NewProxyListener.
+type tlsConnection interface {
+	net.Conn
+	ConnectionState() tls.ConnectionState
+}
+
+// tlsWebSocketConn is a webSocketConn over TLS, it exposes the TLS state to
+// authentication like a tls.Conn.
+type tlsWebSocketConn struct {
+	*webSocketConn
+	tls tlsConnection
+}
+
+func (c *tlsWebSocketConn) ConnectionState() tls.ConnectionState {
+	return c.tls.ConnectionState()
+}
@@ -0,0 +1,155 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveWebSocket serves s on a new local listener, l if not nil, and
+// returns the address and the channel receiving the result of
+// ServeWebSocket.
+func serveWebSocket(t *testing.T, s *Server, l net.Listener, config WebSocketConfig) (string, <-chan error) {
+	if l == nil {
+		var err error
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.ServeWebSocket(l, config) }()
+	return l.Addr().String(), served
+}
+
+func dialWebSocket(url string, dialer *websocket.Dialer, header http.Header) (*websocket.Conn, *http.Response, error) {
+	if dialer == nil {
+		dialer = &websocket.Dialer{}
+	}
+	if dialer.Subprotocols == nil {
+		dialer.Subprotocols = []string{"mqtt"}
+	}
+	return dialer.Dial(url, header)
+}
+
+func TestWebSocket(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+	addr, _ := serveWebSocket(t, s, nil, WebSocketConfig{Path: "/ws"})
+
+	ws, resp, err := dialWebSocket("ws://"+addr+"/ws", nil, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	assert.Equal(t, "mqtt", resp.Header.Get("Sec-Websocket-Protocol"))
+	client := &webSocketConn{ws: ws}
+
+	// A packet spanning two messages
+	connect := connectPacket("c", 4)
+	require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, connect[:5]))
+	require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, connect[5:]))
+	packetType, body := readRaw(t, client)
+	require.Equal(t, byte(packet.CONNACK), packetType)
+	assert.Equal(t, packet.ConnAckAccepted, body[1])
+
+	// Two packets in one message
+	publish, err := packet.BuildPublish("a", []byte("hello"), 4)
+	require.NoError(t, err)
+	msg := subscribePacket(1, "a", 0, 4)
+	var buf bytes.Buffer
+	_, err = publish.WriteTo(&buf)
+	require.NoError(t, err)
+	msg = append(msg, buf.Bytes()...)
+	require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, msg))
+	packetType, _ = readRaw(t, client)
+	assert.Equal(t, byte(packet.SUBACK), packetType)
+	received := readPublish(t, client, 4)
+	assert.Equal(t, "hello", string(received.Payload))
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+	addr, _ := serveWebSocket(t, s, nil, WebSocketConfig{AllowedOrigins: []string{"https://dashboard.example.com"}})
+	url := "ws://" + addr + "/mqtt"
+
+	_, resp, err := dialWebSocket("ws://"+addr+"/other", nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	_, resp, err = dialWebSocket(url, &websocket.Dialer{Subprotocols: []string{"wamp"}}, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	_, resp, err = dialWebSocket(url, nil, http.Header{"Origin": {"https://evil.example.com"}})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	ws, _, err := dialWebSocket(url, &websocket.Dialer{Subprotocols: []string{"mqttv3.1"}}, http.Header{"Origin": {"https://dashboard.example.com"}})
+	require.NoError(t, err)
+	defer ws.Close()
+
+	// Text messages close the connection
+	require.NoError(t, ws.WriteMessage(websocket.TextMessage, connectPacket("c", 4)))
+	_, _, err = ws.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseUnsupportedData), "%v", err)
+}
+
+func TestWebSocketShutdownClosesHandshakes(t *testing.T) {
+	s := NewServer()
+	addr, served := serveWebSocket(t, s, nil, WebSocketConfig{HandshakeTimeout: time.Minute})
+
+	// A request that never completes
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /mqtt HTTP/1.1\r\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	assert.Equal(t, ErrServerClosed, <-served)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.False(t, isTimeout(err), "connection closed by Shutdown: %v", err)
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	f := newTLSFixture(t)
+	defer f.close()
+	l, err := ListenTLS("tcp", "127.0.0.1:0", f.config)
+	require.NoError(t, err)
+
+	s := NewServer()
+	s.CertificateClientID = IdentityCommonName
+	connected := make(chan ClientInfo, 1)
+	s.Hooks.OnConnect = func(info ClientInfo) { connected <- info }
+	addr, served := serveWebSocket(t, s, l, WebSocketConfig{})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(f.ca.cert)
+	dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "broker",
+		Certificates: []tls.Certificate{f.client.tlsCertificate()},
+	}}
+	ws, _, err := dialWebSocket("wss://"+addr+"/mqtt", dialer, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	client := &webSocketConn{ws: ws}
+
+	_, err = client.Write(connectPacket("", 4))
+	require.NoError(t, err)
+	packetType, _ := readRaw(t, client)
+	assert.Equal(t, byte(packet.CONNACK), packetType)
+	assert.Equal(t, "device-1", (<-connected).ClientID)
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	assert.Equal(t, ErrServerClosed, <-served)
+}
@@ -0,0 +1,181 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// willConnectPacket builds a CONNECT with a QoS 0 will on topic "will",
+// willProps are only used for level 5.
+func willConnectPacket(clientID string, level byte, flags byte, props, willProps []byte) []byte {
+	body := append(mqttString("MQTT"), level, flags|4, 0, 0)
+	if level == 5 {
+		body = append(body, byte(len(props)))
+		body = append(body, props...)
+	}
+	body = append(body, mqttString(clientID)...)
+	if level == 5 {
+		body = append(body, byte(len(willProps)))
+		body = append(body, willProps...)
+	}
+	body = append(body, mqttString("will")...)
+	body = append(body, mqttString("gone")...)
+	return withFixedHeader(packet.CONNECT<<4, body)
+}
+
+func subscribeToWill(t *testing.T, s *Server) net.Conn {
+	watcher := connect(t, s, "watcher", 4)
+	_, err := watcher.Write(subscribePacket(1, "will", 0, 4))
+	require.NoError(t, err)
+	packetType, _ := readRaw(t, watcher)
+	require.Equal(t, byte(packet.SUBACK), packetType)
+	return watcher
+}
+
+// expectWill checks whether the will arrives before a PINGRESP.
+func expectWill(t *testing.T, watcher net.Conn, expected bool) {
+	_, err := watcher.Write([]byte{packet.PINGREQ << 4, 0})
+	require.NoError(t, err)
+	packetType, body := readRaw(t, watcher)
+	if !expected {
+		assert.Equal(t, byte(packet.PINGRESP), packetType)
+		return
+	}
+	require.Equal(t, byte(packet.PUBLISH), packetType)
+	assert.Equal(t, append(mqttString("will"), "gone"...), body)
+	packetType, _ = readRaw(t, watcher)
+	assert.Equal(t, byte(packet.PINGRESP), packetType)
+}
+
+func TestWillOnAbnormalDisconnect(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+	watcher := subscribeToWill(t, s)
+	defer watcher.Close()
+
+	client, _ := connectRaw(t, s, willConnectPacket("c", 4, 2, nil, nil))
+	require.NoError(t, client.Close())
+	waitFor(t, func() bool {
+		exists, _ := sessionState(s, "c")
+		return !exists
+	})
+	expectWill(t, watcher, true)
+}
+
+func TestWillProperties(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+	watcher := connect(t, s, "watcher", 5)
+	defer watcher.Close()
+	subscribe(t, watcher, "will", 0, 5)
+
+	willProps := []byte{packet.PAYLOAD_FORMAT_INDICATOR_ID, 1, packet.CONTENT_TYPE_ID}
+	willProps = append(willProps, mqttString("text/plain")...)
+	willProps = append(willProps, packet.RESPONSE_TOPIC_ID)
+	willProps = append(willProps, mqttString("r")...)
+	willProps = append(willProps, packet.CORRELATION_DATA_ID)
+	willProps = append(willProps, mqttString("c")...)
+	for _, v := range []string{"1", "2"} {
+		willProps = append(willProps, packet.USER_PROPERTY_ID)
+		willProps = append(willProps, mqttString("k")...)
+		willProps = append(willProps, mqttString(v)...)
+	}
+	client, _ := connectRaw(t, s, willConnectPacket("c", 5, 2, nil, willProps))
+	require.NoError(t, client.Close())
+
+	props := readPublish(t, watcher, 5).VariableHeader.PublishProperties
+	assert.Equal(t, 1, props.PayloadFormatIndicator)
+	assert.Equal(t, "text/plain", props.ContentType)
+	assert.Equal(t, "r", props.ResponseTopic)
+	assert.Equal(t, "c", props.CorrelationData)
+	assert.Equal(t, []packet.UserProperty{{Key: "k", Value: "1"}, {Key: "k", Value: "2"}}, props.UserProperties)
+}
+
+func TestWillSuppressedOnDisconnect(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+	watcher := subscribeToWill(t, s)
+	defer watcher.Close()
+
+	client, _ := connectRaw(t, s, willConnectPacket("c", 4, 2, nil, nil))
+	_, err := client.Write([]byte{packet.DISCONNECT << 4, 0})
+	require.NoError(t, err)
+	waitFor(t, func() bool {
+		exists, _ := sessionState(s, "c")
+		return !exists
+	})
+	expectWill(t, watcher, false)
+}
+
+func TestWillOnDisconnectWithWillMessage(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+	watcher := subscribeToWill(t, s)
+	defer watcher.Close()
+
+	client, _ := connectRaw(t, s, willConnectPacket("c", 5, 2, nil, nil))
+	_, err := client.Write([]byte{packet.DISCONNECT << 4, 1, packet.ReasonCodeDisconnectWithWillMessage})
+	require.NoError(t, err)
+	waitFor(t, func() bool {
+		exists, _ := sessionState(s, "c")
+		return !exists
+	})
+	expectWill(t, watcher, true)
+}
+
+func TestWillDelayCancelledByReconnect(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+	watcher := subscribeToWill(t, s)
+	defer watcher.Close()
+
+	sessionExpiry := []byte{packet.SESSION_EXPIRY_INTERVAL_ID, 0, 0, 0, 60}
+	willDelay := []byte{packet.WILL_DELAY_INTERVAL_ID, 0, 0, 0, 30}
+	client, _ := connectRaw(t, s, willConnectPacket("c", 5, 0, sessionExpiry, willDelay))
+	require.NoError(t, client.Close())
+	waitFor(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		sess, ok := s.sessions["c"]
+		return ok && sess.will != nil
+	})
+	expectWill(t, watcher, false)
+
+	client, connAck := connectRaw(t, s, connectPacketWithFlags("c", 5, 0, sessionExpiry))
+	defer client.Close()
+	assert.Equal(t, byte(1), connAck[0], "session present")
+	s.mu.Lock()
+	assert.Nil(t, s.sessions["c"].will)
+	s.mu.Unlock()
+	expectWill(t, watcher, false)
+}
+
+func TestWillDelayEndsWithSession(t *testing.T) {
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+	watcher := subscribeToWill(t, s)
+	defer watcher.Close()
+
+	sessionExpiry := []byte{packet.SESSION_EXPIRY_INTERVAL_ID, 0, 0, 0, 60}
+	willDelay := []byte{packet.WILL_DELAY_INTERVAL_ID, 0, 0, 0, 30}
+	client, _ := connectRaw(t, s, willConnectPacket("c", 5, 0, sessionExpiry, willDelay))
+	require.NoError(t, client.Close())
+	waitFor(t, func() bool {
+		exists, online := sessionState(s, "c")
+		return exists && !online
+	})
+
+	// The session expires before the Will Delay Interval has passed
+	s.mu.Lock()
+	sess := s.sessions["c"]
+	sess.expiresAt = time.Now()
+	s.mu.Unlock()
+	s.expireSession(sess)
+	expectWill(t, watcher, true)
+}
@@ -18,70 +18,131 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
 
+	"github.com/infinimesh/mqtt-go/broker"
 	"github.com/infinimesh/mqtt-go/packet"
 )
 
-//openssl req  -nodes -new -x509  -keyout server.key -out server.cert
+var (
+	addr     = flag.String("addr", "localhost:8080", "TCP listen address")
+	tlsAddr  = flag.String("tls-addr", "localhost:8883", "TLS listen address, used if -cert is set")
+	wsAddr   = flag.String("ws-addr", "", "WebSocket listen address, path /mqtt")
+	unixPath = flag.String("unix", "", "Unix domain socket path")
+	proxies  = flag.String("trusted-proxies", "", "comma separated networks of proxies sending the PROXY protocol to -addr")
+	certFile = flag.String("cert", "", "server certificate file")
+	keyFile  = flag.String("key", "", "server private key file")
+	clientCA = flag.String("client-ca", "", "CA file verifying optional client certificates")
+)
+
+// openssl req  -nodes -new -x509  -keyout server.key -out server.cert
 func main() {
-	listener, err := net.Listen("tcp", "localhost:8080")
+	flag.Parse()
+	listener, err := net.Listen("tcp", *addr)
 	if err != nil {
 		panic(err)
 	}
-
-	for {
-		conn, _ := listener.Accept() // nolint: gosec
-		go handleConn(conn)
+	if *proxies != "" {
+		networks, err := broker.ParseTrustedProxies(strings.Split(*proxies, ",")...)
+		if err != nil {
+			panic(err)
+		}
+		listener = broker.NewProxyListener(listener, broker.ProxyConfig{TrustedProxies: networks})
 	}
-}
 
-func handleConn(c net.Conn) {
-	defer fmt.Println("Exited loop of connection")
-	p, err := packet.ReadPacket(c, 0)
-	if err != nil {
-		fmt.Printf("Error while reading connect packet: %v\n", err)
-		return
+	server := broker.NewServer()
+	server.Hooks = broker.Hooks{
+		OnConnect: func(info broker.ClientInfo) {
+			fmt.Printf("Client with ID %v connected from %v!\n", info.ClientID, info.RemoteAddr)
+		},
+		OnDisconnect: func(info broker.ClientInfo, err error) {
+			fmt.Printf("Client with ID %v disconnected: %v\n", info.ClientID, err)
+		},
+		OnPublish: func(info broker.ClientInfo, p *packet.PublishControlPacket) {
+			fmt.Println("Received Publish with payload:", string(p.Payload))
+		},
 	}
 
-	connectPacket, ok := p.(*packet.ConnectControlPacket)
-	if !ok {
-		fmt.Println("Got wrong packet as first packjet..need connect!")
-		return
-	}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt)
+		<-signals
 
-	id := connectPacket.ConnectPayload.ClientID
-	fmt.Printf("Client with ID %v connected!\n", id)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			fmt.Printf("Error during shutdown: %v\n", err)
+		}
+	}()
 
-	resp := packet.ConnAckControlPacket{
-		FixedHeader: packet.FixedHeader{
-			ControlPacketType: packet.CONNACK,
-		},
-		VariableHeader: packet.ConnAckVariableHeader{},
+	if *certFile != "" {
+		config := broker.TLSConfig{
+			CertFile:       *certFile,
+			KeyFile:        *keyFile,
+			ReloadInterval: time.Minute,
+		}
+		if *clientCA != "" {
+			config.ClientCAFile = *clientCA
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+			server.CertificateClientID = broker.IdentityCommonName
+		}
+		tlsListener, err := broker.ListenTLS("tcp", *tlsAddr, config)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			if err := server.Serve(tlsListener); err != broker.ErrServerClosed {
+				panic(err)
+			}
+		}()
 	}
 
-	_, err = resp.WriteTo(c)
+	// Sockets passed by systemd socket activation are served as plain TCP
+	// or Unix domain sockets, in addition to the flags
+	activated, err := broker.SystemdListeners()
 	if err != nil {
-		fmt.Println("Failed to write ConnAck. Closing connection.")
-		return
+		panic(err)
 	}
-
-	for {
-		p, err := packet.ReadPacket(c, connectPacket.VariableHeader.ProtocolLevel)
+	extra := make([]net.Listener, 0, len(activated)+1)
+	for _, l := range activated {
+		extra = append(extra, l)
+	}
+	if *unixPath != "" {
+		unixListener, err := broker.ListenUnix(*unixPath, 0660)
 		if err != nil {
-			fmt.Printf("Error while reading packet in client loop: %v. Disconnecting client.\n", err)
-			err := c.Close()
-			if err != nil {
-				fmt.Printf("Error when closing connection: %v\n", err)
-			}
-			break
+			panic(err)
 		}
+		extra = append(extra, unixListener)
+	}
+	for _, l := range extra {
+		go func(l net.Listener) {
+			if err := server.Serve(l); err != broker.ErrServerClosed {
+				panic(err)
+			}
+		}(l)
+	}
 
-		switch p := p.(type) {
-		case packet.ConnectControlPacket:
-		case *packet.PublishControlPacket:
-			println("Received Publish with payload:", string(p.Payload))
+	if *wsAddr != "" {
+		wsListener, err := net.Listen("tcp", *wsAddr)
+		if err != nil {
+			panic(err)
 		}
+		go func() {
+			if err := server.ServeWebSocket(wsListener, broker.WebSocketConfig{}); err != broker.ErrServerClosed {
+				panic(err)
+			}
+		}()
+	}
+
+	if err := server.Serve(listener); err != broker.ErrServerClosed {
+		panic(err)
 	}
 }
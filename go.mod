@@ -2,6 +2,8 @@ module github.com/infinimesh/mqtt-go
 
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/gorilla/websocket v1.4.0
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.2.2
+	golang.org/x/crypto v0.0.0-20180904163835-0709b304e793
 )
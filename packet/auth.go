@@ -0,0 +1,132 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// AuthControlPacket is used for MQTT 5 enhanced authentication.
+type AuthControlPacket struct {
+	FixedHeader    FixedHeader
+	VariableHeader AuthVariableHeader
+}
+
+type AuthVariableHeader struct {
+	ReasonCode     byte
+	AuthProperties AuthProperties
+}
+
+type AuthProperties struct {
+	AuthenticationMethod string
+	AuthenticationData   []byte
+	ReasonString         string
+}
+
+func readAuthVariableHeader(r io.Reader, remainingLength int) (vh AuthVariableHeader, err error) {
+	if remainingLength == 0 {
+		return
+	}
+	b := make([]byte, 1)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	vh.ReasonCode = b[0]
+	if remainingLength == 1 {
+		return
+	}
+
+	props, _, err := readProperties(r)
+	if err != nil {
+		return
+	}
+	for _, prop := range props {
+		switch prop.ID {
+		case AUTHENTICATION_METHOD_ID:
+			vh.AuthProperties.AuthenticationMethod = string(prop.Data)
+		case AUTHENTICATION_DATA_ID:
+			vh.AuthProperties.AuthenticationData = prop.Data
+		case REASON_STRING_ID:
+			vh.AuthProperties.ReasonString = string(prop.Data)
+		}
+	}
+	return
+}
+
+func NewAuth(reasonCode byte, method string, data []byte) *AuthControlPacket {
+	return &AuthControlPacket{
+		FixedHeader: FixedHeader{
+			ControlPacketType: AUTH,
+		},
+		VariableHeader: AuthVariableHeader{
+			ReasonCode: reasonCode,
+			AuthProperties: AuthProperties{
+				AuthenticationMethod: method,
+				AuthenticationData:   data,
+			},
+		},
+	}
+}
+
+func (props *AuthProperties) serialize() []byte {
+	var b propertyBuffer
+	if props.AuthenticationMethod != "" {
+		b.writeStringProperty(AUTHENTICATION_METHOD_ID, props.AuthenticationMethod)
+	}
+	if props.AuthenticationData != nil {
+		b.writeBinaryProperty(AUTHENTICATION_DATA_ID, props.AuthenticationData)
+	}
+	if props.ReasonString != "" {
+		b.writeStringProperty(REASON_STRING_ID, props.ReasonString)
+	}
+	return b.Bytes()
+}
+
+// WriteTo writes the packet, a Success without properties is written with a
+// remaining length of 0.
+func (p *AuthControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	var body []byte
+	props := p.VariableHeader.AuthProperties.serialize()
+	if p.VariableHeader.ReasonCode != ReasonCodeSuccess || len(props) > 0 {
+		buf := &bytes.Buffer{}
+		buf.WriteByte(p.VariableHeader.ReasonCode)
+		if _, err = writeProperties(buf, props); err != nil {
+			return
+		}
+		body = buf.Bytes()
+	}
+	p.FixedHeader.RemainingLength = len(body)
+
+	n, err = p.FixedHeader.WriteTo(w)
+	if err != nil {
+		return
+	}
+	written, err := w.Write(body)
+	n += int64(written)
+	return
+}
+
+func (p *AuthControlPacket) String() string {
+	return summarize(AUTH,
+		fmt.Sprintf("reasonCode=0x%02x", p.VariableHeader.ReasonCode),
+		fmt.Sprintf("method=%q", p.VariableHeader.AuthProperties.AuthenticationMethod),
+		fmt.Sprintf("data=%dB", len(p.VariableHeader.AuthProperties.AuthenticationData)),
+	)
+}
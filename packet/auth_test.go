@@ -0,0 +1,61 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := NewAuth(ReasonCodeContinueAuthentication, "SCRAM-SHA-256", []byte("r=nonce")).WriteTo(&buf)
+	require.NoError(t, err)
+
+	p, err := ReadPacket(&buf, 5)
+	require.NoError(t, err)
+	auth, ok := p.(*AuthControlPacket)
+	require.True(t, ok)
+	assert.Equal(t, ReasonCodeContinueAuthentication, auth.VariableHeader.ReasonCode)
+	assert.Equal(t, "SCRAM-SHA-256", auth.VariableHeader.AuthProperties.AuthenticationMethod)
+	assert.Equal(t, []byte("r=nonce"), auth.VariableHeader.AuthProperties.AuthenticationData)
+}
+
+func TestWriteAuthSuccess(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := NewAuth(ReasonCodeSuccess, "", nil).WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xf0, 0}, buf.Bytes())
+}
+
+func TestWriteConnAckAuthentication(t *testing.T) {
+	connAck := NewConnAck(5, false, ReasonCodeSuccess)
+	connAck.VariableHeader.ConnAckProperties.AuthenticationMethod = "M"
+	connAck.VariableHeader.ConnAckProperties.AuthenticationData = []byte{1}
+
+	var buf bytes.Buffer
+	_, err := connAck.WriteTo(&buf)
+	require.NoError(t, err)
+	expected := []byte{0x20, 11, 0, 0, 8,
+		AUTHENTICATION_METHOD_ID, 0, 1, 'M',
+		AUTHENTICATION_DATA_ID, 0, 1, 1}
+	assert.Equal(t, expected, buf.Bytes())
+}
@@ -18,18 +18,41 @@
 package packet
 
 import (
+	"fmt"
 	"io"
 )
 
+// MQTT 3.1.1 CONNACK return codes, MQTT 5 uses the reason codes instead
+const (
+	ConnAckAccepted                    byte = 0x00
+	ConnAckUnacceptableProtocolVersion byte = 0x01
+	ConnAckIdentifierRejected          byte = 0x02
+	ConnAckServerUnavailable           byte = 0x03
+	ConnAckBadUserNameOrPassword       byte = 0x04
+	ConnAckNotAuthorized               byte = 0x05
+)
+
 type ConnAckProperties struct {
-	PropertiesLength int
-	RecieveMaximum   uint16
-	AssignedClientID string
+	PropertiesLength      int
+	ReceiveMaximum        uint16
+	MaximumPacketSize     uint32 // not sent if 0, which means no limit
+	AssignedClientID      string
+	SessionExpiryInterval *int // nil if the CONNECT value is accepted
+	ServerKeepAlive       *int // nil if the CONNECT value is accepted
+	// SharedSubscriptionAvailable is not sent if nil, which means available
+	SharedSubscriptionAvailable *bool
+	// AuthenticationMethod and AuthenticationData conclude an enhanced
+	// authentication.
+	AuthenticationMethod string
+	AuthenticationData   []byte
 }
 
 type ConnAckControlPacket struct {
 	FixedHeader    FixedHeader
 	VariableHeader ConnAckVariableHeader
+	// ProtocolLevel selects the encoding used by WriteTo, properties are
+	// only written for level 5.
+	ProtocolLevel byte
 }
 
 type ConnAckVariableHeader struct {
@@ -38,80 +61,123 @@ type ConnAckVariableHeader struct {
 	ConnAckProperties ConnAckProperties
 }
 
+func NewConnAck(protocolLevel byte, sessionPresent bool, reasonCode byte) *ConnAckControlPacket {
+	return &ConnAckControlPacket{
+		FixedHeader: FixedHeader{
+			ControlPacketType: CONNACK,
+		},
+		VariableHeader: ConnAckVariableHeader{
+			SessionPresent: sessionPresent,
+			ReasonCode:     reasonCode,
+		},
+		ProtocolLevel: protocolLevel,
+	}
+}
+
+func (props *ConnAckProperties) serialize() []byte {
+	var b propertyBuffer
+	if props.SessionExpiryInterval != nil {
+		b.writeUint32Property(SESSION_EXPIRY_INTERVAL_ID, uint32(*props.SessionExpiryInterval))
+	}
+	if props.ReceiveMaximum > 0 {
+		b.writeUint16Property(RECEIVE_MAXIMUM_ID, props.ReceiveMaximum)
+	}
+	if props.MaximumPacketSize > 0 {
+		b.writeUint32Property(MAXIMUM_PACKET_SIZE_ID, props.MaximumPacketSize)
+	}
+	if props.AssignedClientID != "" {
+		b.writeStringProperty(ASSIGNED_CLIENT_ID, props.AssignedClientID)
+	}
+	if props.ServerKeepAlive != nil {
+		b.writeUint16Property(SERVER_KEEP_ALIVE_ID, uint16(*props.ServerKeepAlive))
+	}
+	if props.SharedSubscriptionAvailable != nil {
+		var available byte
+		if *props.SharedSubscriptionAvailable {
+			available = 1
+		}
+		b.writeByteProperty(SHARED_SUBSCRIPTION_AVAILABLE_ID, available)
+	}
+	if props.AuthenticationMethod != "" {
+		b.writeStringProperty(AUTHENTICATION_METHOD_ID, props.AuthenticationMethod)
+	}
+	if props.AuthenticationData != nil {
+		b.writeBinaryProperty(AUTHENTICATION_DATA_ID, props.AuthenticationData)
+	}
+	return b.Bytes()
+}
+
 func (p *ConnAckControlPacket) WriteTo(w io.Writer) (n int64, err error) {
-	if len(p.VariableHeader.ConnAckProperties.AssignedClientID) > 0 {
-		p.FixedHeader.RemainingLength = 3 + len(p.VariableHeader.ConnAckProperties.AssignedClientID) + 3
-	} else {
-		p.FixedHeader.RemainingLength = 3
+	withProperties := int(p.ProtocolLevel) == 5
+	var props []byte
+	p.FixedHeader.RemainingLength = 2
+	if withProperties {
+		props = p.VariableHeader.ConnAckProperties.serialize()
+		p.VariableHeader.ConnAckProperties.PropertiesLength = len(props)
+		p.FixedHeader.RemainingLength += propertiesSize(props)
 	}
+
 	var nWritten int64
 	nWritten, err = p.FixedHeader.WriteTo(w)
 	n += nWritten
 	if err != nil {
 		return n, err
 	}
-	nWritten, err = p.VariableHeader.WriteTo(w)
+	nWritten, err = p.VariableHeader.writeTo(w, props, withProperties)
 	n += nWritten
 	return n, err
 }
 
-func (c *ConnAckVariableHeader) WriteTo(w io.Writer) (n int64, err error) {
+func (c *ConnAckVariableHeader) writeTo(w io.Writer, props []byte, withProperties bool) (n int64, err error) {
 	buf := make([]byte, 2)
+	if c.SessionPresent {
+		buf[0] = 1
+	}
 	buf[1] = c.ReasonCode
 
 	bytesWritten, err := w.Write(buf)
 	n += int64(bytesWritten)
-	if err != nil {
+	if err != nil || !withProperties {
 		return
 	}
-	if len(c.ConnAckProperties.AssignedClientID) > 0 {
-		c.ConnAckProperties.PropertiesLength = 3 + len(c.ConnAckProperties.AssignedClientID)
-		buf = make([]byte, 1)
-		buf[0] = byte(c.ConnAckProperties.PropertiesLength)
-		bytesWritten, err = w.Write(buf)
-		n += int64(bytesWritten)
-		if err != nil {
-			return
-		}
-		buf = make([]byte, 1)
-		buf[0] = byte(ASSIGNED_CLIENT_ID)
-		bytesWritten, err = w.Write(buf)
-		n += int64(bytesWritten)
-		if err != nil {
-			return
-		}
-		buf = make([]byte, 2)
-		buf[1] = byte(len(c.ConnAckProperties.AssignedClientID))
-		bytesWritten, err = w.Write(buf)
-		n += int64(bytesWritten)
-		if err != nil {
-			return
-		}
-		buf = make([]byte, len(c.ConnAckProperties.AssignedClientID))
-		buf = []byte(c.ConnAckProperties.AssignedClientID)
-		bytesWritten, err = w.Write(buf)
-		n += int64(bytesWritten)
-		if err != nil {
-			return
-		}
-	} else {
-		c.ConnAckProperties.PropertiesLength = 0
-		buf = make([]byte, 1)
-		buf[0] = byte(c.ConnAckProperties.PropertiesLength)
-		bytesWritten, err = w.Write(buf)
-		n += int64(bytesWritten)
-		if err != nil {
-			return
-		}
-	}
-	/*
-		buf = make([]byte, 1)
-		buf[0] = byte(c.ConnAckProperties.RecieveMaximum.RecieveMaximumID)
-		bytesWritten, err = w.Write(buf)
-
-		buf = make([]byte, 2)
-		binary.BigEndian.PutUint16(buf, c.ConnAckProperties.RecieveMaximum.RecieveMaximumValue)
-		bytesWritten, err = w.Write(buf)
-	*/
+	propsWritten, err := writeProperties(w, props)
+	n += propsWritten
 	return
 }
+
+func (p *ConnAckControlPacket) String() string {
+	vh := p.VariableHeader
+	fields := []string{
+		fmt.Sprintf("sessionPresent=%t", vh.SessionPresent),
+		fmt.Sprintf("reasonCode=0x%02x", vh.ReasonCode),
+	}
+	var names []string
+	if vh.ConnAckProperties.SessionExpiryInterval != nil {
+		names = append(names, "SessionExpiryInterval")
+	}
+	if vh.ConnAckProperties.ReceiveMaximum > 0 {
+		names = append(names, "ReceiveMaximum")
+	}
+	if vh.ConnAckProperties.MaximumPacketSize > 0 {
+		names = append(names, "MaximumPacketSize")
+	}
+	if vh.ConnAckProperties.AssignedClientID != "" {
+		names = append(names, "AssignedClientIdentifier")
+	}
+	if vh.ConnAckProperties.ServerKeepAlive != nil {
+		names = append(names, "ServerKeepAlive")
+	}
+	if vh.ConnAckProperties.SharedSubscriptionAvailable != nil {
+		names = append(names, "SharedSubscriptionAvailable")
+	}
+	if vh.ConnAckProperties.AuthenticationMethod != "" {
+		names = append(names, "AuthenticationMethod")
+	}
+	if vh.ConnAckProperties.AuthenticationData != nil {
+		names = append(names, "AuthenticationData")
+	}
+	if len(names) > 0 {
+		fields = append(fields, propertyNames(names))
+	}
+	return summarize(CONNACK, fields...)
+}
@@ -18,6 +18,7 @@
 package packet
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -25,20 +26,22 @@ import (
 )
 
 type ConnectProperties struct {
-	PropertyLength         int //variable header properties length
-	RecieveMaximumValue    int //limits the number of QoS 1 and QoS 2 Pub at Client - default 65,535
-	MaximumPacketSize      int //represents max packet size client accepts
-	SessionExpiryInterval  int //sesion expiry interval
-	TopicAliasMaximumValue int //max num of topic alias accepted by client
-	RequestResponseInfo    int //0 = no response info in CONNACK
-	RequestProblemInfo     int //0 = no reason string in CONNACK
+	PropertyLength         int  //variable header properties length
+	ReceiveMaximumValue    *int //limits the number of QoS 1 and QoS 2 Pub at Client - nil means 65,535
+	MaximumPacketSize      int  //represents max packet size client accepts
+	SessionExpiryInterval  int  //sesion expiry interval
+	TopicAliasMaximumValue int  //max num of topic alias accepted by client
+	RequestResponseInfo    int  //0 = no response info in CONNACK
+	RequestProblemInfo     int  //0 = no reason string in CONNACK
+	AuthenticationMethod   string
+	AuthenticationData     []byte
 }
 
 type ConnectFlags struct {
 	UserName   bool
 	Password   bool
 	WillRetain bool
-	WillQoS    int // 2 bytes actually
+	WillQoS    int
 	WillFlag   bool
 	CleanStart bool
 }
@@ -57,8 +60,27 @@ type ConnectVariableHeader struct {
 	ConnectProperties ConnectProperties
 }
 
+// WillProperties are the MQTT 5 properties of the will message.
+type WillProperties struct {
+	WillDelayInterval      int //seconds to wait before publishing the will
+	PayloadFormatIndicator int
+	MessageExpiryInterval  int
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	UserProperties         []UserProperty
+}
+
 type ConnectPayload struct {
 	ClientID string
+	// Only set if the will flag is set
+	WillProperties WillProperties
+	WillTopic      string
+	WillPayload    []byte
+	// Only set if the user name and password flags are set. The password is
+	// left out of JSON, like it is of String, to keep it out of logs.
+	UserName string
+	Password []byte `json:"-"`
 }
 
 func getConnectVariableHeader(r io.Reader) (hdr ConnectVariableHeader, len int, err error) {
@@ -94,11 +116,18 @@ func getConnectVariableHeader(r io.Reader) (hdr ConnectVariableHeader, len int,
 		return
 	}
 
-	hdr.ConnectFlags.UserName = connectFlagsByte[0]&128 == 1
-	hdr.ConnectFlags.Password = connectFlagsByte[0]&64 == 1
-	hdr.ConnectFlags.WillRetain = connectFlagsByte[0]&32 == 1
-	hdr.ConnectFlags.WillFlag = connectFlagsByte[0]&4 == 1
-	hdr.ConnectFlags.CleanStart = connectFlagsByte[0]&2 == 1
+	if connectFlagsByte[0]&1 > 0 {
+		return hdr, len, &ProtocolError{ReasonCode: ReasonCodeMalformedPacket, Message: "Reserved connect flag is set"}
+	}
+	hdr.ConnectFlags.UserName = connectFlagsByte[0]&128 > 0
+	hdr.ConnectFlags.Password = connectFlagsByte[0]&64 > 0
+	hdr.ConnectFlags.WillRetain = connectFlagsByte[0]&32 > 0
+	hdr.ConnectFlags.WillQoS = int(connectFlagsByte[0]>>3) & 3
+	hdr.ConnectFlags.WillFlag = connectFlagsByte[0]&4 > 0
+	hdr.ConnectFlags.CleanStart = connectFlagsByte[0]&2 > 0
+	if hdr.ConnectFlags.WillQoS == 3 {
+		return hdr, len, &ProtocolError{ReasonCode: ReasonCodeMalformedPacket, Message: "Invalid will QoS"}
+	}
 
 	keepAliveByte := make([]byte, 2)
 	n, err = r.Read(keepAliveByte)
@@ -112,86 +141,43 @@ func getConnectVariableHeader(r io.Reader) (hdr ConnectVariableHeader, len int,
 
 	hdr.KeepAlive = int(binary.BigEndian.Uint16(keepAliveByte))
 
-	// TODO Will QoS
-	if connectFlagsByte[0]&16 == 1 && connectFlagsByte[0]&8 == 1 {
-		hdr.ConnectFlags.WillQoS = 3
-	} else if connectFlagsByte[0]&8 == 1 {
-		hdr.ConnectFlags.WillQoS = 2
-	} else {
-		hdr.ConnectFlags.WillQoS = 1
-	}
-
-	fmt.Printf("ProtoLevel %v, %v\n", hdr.ProtocolLevel, int(hdr.ProtocolLevel))
 	if int(hdr.ProtocolLevel) == 5 {
-		//reading variable header properties length
-		propertiesLength := make([]byte, 1)
-		n, err = r.Read(propertiesLength)
-		len += n
+		props, propertiesLength, err := readProperties(r)
+		len += varIntSize(propertiesLength) + propertiesLength
 		if err != nil {
-			return hdr, len, errors.New("Could not read properties length")
-		}
-		hdr.ConnectProperties.PropertyLength = int(propertiesLength[0])
-		if hdr.ConnectProperties.PropertyLength == 0 {
-			fmt.Printf("No optional properties added")
-		} else {
-			len += hdr.ConnectProperties.PropertyLength
-			hdr, _ = readConnectProperties(r, hdr)
+			return hdr, len, err
 		}
+		hdr.ConnectProperties.PropertyLength = propertiesLength
+		setConnectProperties(&hdr.ConnectProperties, props)
 	}
 	return
 }
 
-func readConnectProperties(r io.Reader, hdr ConnectVariableHeader) (ConnectVariableHeader, error) {
-	connectProperties := make([]byte, hdr.ConnectProperties.PropertyLength)
-	propertiesLength, err := io.ReadFull(r, connectProperties)
-	if err != nil {
-		return hdr, err
-	}
-	if propertiesLength != hdr.ConnectProperties.PropertyLength {
-		return hdr, errors.New("Connect Properties length incorrect")
-	}
-	for propertiesLength > 1 {
-		connectPropertyID := int(connectProperties[0])
-		if connectPropertyID == RECIEVE_MAXIMUM_ID {
-			recieveMaximum := connectProperties[1 : RECIEVE_MAXIMUM_LENGTH+1]
-			hdr.ConnectProperties.RecieveMaximumValue = int(binary.BigEndian.Uint16(recieveMaximum))
-			connectProperties = connectProperties[RECIEVE_MAXIMUM_LENGTH+1 : propertiesLength]
-			propertiesLength -= RECIEVE_MAXIMUM_LENGTH + 1
-		} else if connectPropertyID == MAXIMUM_PACKET_SIZE_ID {
-			maxPacketSize := connectProperties[1 : MAXIMUM_PACKET_SIZE_LENGTH+1]
-			hdr.ConnectProperties.MaximumPacketSize = int(binary.BigEndian.Uint64(maxPacketSize))
-			connectProperties = connectProperties[MAXIMUM_PACKET_SIZE_LENGTH+1 : propertiesLength]
-			propertiesLength -= MAXIMUM_PACKET_SIZE_LENGTH + 1
-		} else if connectPropertyID == SESSION_EXPIRY_INTERVAL_ID {
-			SessionExpiryInterval := connectProperties[1 : SESSION_EXPIRY_INTERVAL_LENGTH+1]
-			hdr.ConnectProperties.SessionExpiryInterval = int(binary.BigEndian.Uint64(SessionExpiryInterval))
-			connectProperties = connectProperties[SESSION_EXPIRY_INTERVAL_LENGTH+1 : propertiesLength]
-			propertiesLength -= SESSION_EXPIRY_INTERVAL_LENGTH + 1
-		} else if connectPropertyID == TOPIC_ALIAS_MAXIMUM_ID {
-			topicAliasMaximum := connectProperties[1 : TOPIC_ALIAS_MAXIMUM_LENGTH+1]
-			hdr.ConnectProperties.TopicAliasMaximumValue = int(binary.BigEndian.Uint16(topicAliasMaximum))
-			connectProperties = connectProperties[TOPIC_ALIAS_MAXIMUM_LENGTH+1 : propertiesLength]
-			propertiesLength -= TOPIC_ALIAS_MAXIMUM_LENGTH + 1
-		} else if connectPropertyID == REQUEST_RESPONSE_INFORMATION_ID {
-			resquestResponseInfo := connectProperties[1]
-			hdr.ConnectProperties.RequestResponseInfo = int(resquestResponseInfo)
-			connectProperties = connectProperties[REQUEST_RESPONSE_INFORMATION_LENGTH:propertiesLength]
-			propertiesLength -= REQUEST_RESPONSE_INFORMATION_LENGTH + 1
-		} else if connectPropertyID == REQUEST_PROBLEM_INFORMATION_ID {
-			resquestResponseInfo := connectProperties[1]
-			hdr.ConnectProperties.RequestResponseInfo = int(resquestResponseInfo)
-			connectProperties = connectProperties[REQUEST_PROBLEM_INFORMATION_LENGTH:propertiesLength]
-			propertiesLength -= REQUEST_PROBLEM_INFORMATION_LENGTH + 1
-		} else {
-			fmt.Printf("%v Connect Property is not supported yet..", connectProperties[0])
-			propertiesLength = 0
+func setConnectProperties(cp *ConnectProperties, props []property) {
+	for _, prop := range props {
+		switch prop.ID {
+		case RECEIVE_MAXIMUM_ID:
+			receiveMaximum := prop.Int
+			cp.ReceiveMaximumValue = &receiveMaximum
+		case MAXIMUM_PACKET_SIZE_ID:
+			cp.MaximumPacketSize = prop.Int
+		case SESSION_EXPIRY_INTERVAL_ID:
+			cp.SessionExpiryInterval = prop.Int
+		case TOPIC_ALIAS_MAXIMUM_ID:
+			cp.TopicAliasMaximumValue = prop.Int
+		case REQUEST_RESPONSE_INFORMATION_ID:
+			cp.RequestResponseInfo = prop.Int
+		case REQUEST_PROBLEM_INFORMATION_ID:
+			cp.RequestProblemInfo = prop.Int
+		case AUTHENTICATION_METHOD_ID:
+			cp.AuthenticationMethod = string(prop.Data)
+		case AUTHENTICATION_DATA_ID:
+			cp.AuthenticationData = prop.Data
 		}
 	}
-
-	return hdr, nil
 }
 
-func readConnectPayload(r io.Reader, len int) (ConnectPayload, error) {
+func readConnectPayload(r io.Reader, len int, flags ConnectFlags, protocolLevel byte) (ConnectPayload, error) {
 	payloadBytes := make([]byte, len)
 	n, err := io.ReadFull(r, payloadBytes)
 	// TODO set upper limit for payload
@@ -203,21 +189,136 @@ func readConnectPayload(r io.Reader, len int) (ConnectPayload, error) {
 		return ConnectPayload{}, errors.New("Payload length incorrect")
 	}
 
-	// CONNECT MUST have the client id
-	// REGEX 0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ
-	// MAY allow more than that, but this must be possible
+	// Client Identifier, Will Properties, Will Topic, Will Payload, User
+	// Name, Password
+	payload := bytes.NewReader(payloadBytes)
+	var cp ConnectPayload
+	clientID, err := readBinaryField(payload)
+	if err != nil {
+		return cp, err
+	}
+	cp.ClientID = string(clientID)
 
-	// Client Identifier, Will Topic, Will Message, User Name, Password
+	if flags.WillFlag {
+		if int(protocolLevel) == 5 {
+			props, _, err := readProperties(payload)
+			if err != nil {
+				return cp, err
+			}
+			setWillProperties(&cp.WillProperties, props)
+		}
+		willTopic, err := readBinaryField(payload)
+		if err != nil {
+			return cp, err
+		}
+		cp.WillTopic = string(willTopic)
+		if cp.WillPayload, err = readBinaryField(payload); err != nil {
+			return cp, err
+		}
+	} else if flags.WillQoS != 0 || flags.WillRetain {
+		return cp, &ProtocolError{ReasonCode: ReasonCodeMalformedPacket, Message: "Will QoS or retain set without will flag"}
+	}
 
-	// TODO am besten so viel einlesen wie moeglich, und dann reslicen / reader zusammenstecken
+	// MQTT 5 allows a password without user name
+	if flags.Password && !flags.UserName && int(protocolLevel) != 5 {
+		return cp, &ProtocolError{ReasonCode: ReasonCodeMalformedPacket, Message: "Password set without user name"}
+	}
+	if flags.UserName {
+		userName, err := readBinaryField(payload)
+		if err != nil {
+			return cp, err
+		}
+		cp.UserName = string(userName)
+	}
+	if flags.Password {
+		if cp.Password, err = readBinaryField(payload); err != nil {
+			return cp, err
+		}
+	}
+	return cp, nil
+}
 
-	clientIDLengthBytes := payloadBytes[:2]
-	//clientIDLength := int(clientIDLengthBytes[0])
-	//clientID := string(payloadBytes[1 : 1+clientIDLength])
-	clientIDLength := int(binary.BigEndian.Uint16(clientIDLengthBytes))
-	clientID := string(payloadBytes[2 : 2+clientIDLength])
-	return ConnectPayload{
-		ClientID: clientID,
-	}, nil
+// readBinaryField reads a string or binary data prefixed by its two byte
+// length.
+func readBinaryField(r io.Reader) ([]byte, error) {
+	lengthBytes := make([]byte, 2)
+	if _, err := io.ReadFull(r, lengthBytes); err != nil {
+		return nil, &ProtocolError{ReasonCode: ReasonCodeMalformedPacket, Message: "Payload too short"}
+	}
+	data := make([]byte, binary.BigEndian.Uint16(lengthBytes))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, &ProtocolError{ReasonCode: ReasonCodeMalformedPacket, Message: "Payload too short"}
+	}
+	return data, nil
+}
+
+func setWillProperties(wp *WillProperties, props []property) {
+	for _, prop := range props {
+		switch prop.ID {
+		case WILL_DELAY_INTERVAL_ID:
+			wp.WillDelayInterval = prop.Int
+		case PAYLOAD_FORMAT_INDICATOR_ID:
+			wp.PayloadFormatIndicator = prop.Int
+		case MESSAGE_EXPIRY_INTERVAL_ID:
+			wp.MessageExpiryInterval = prop.Int
+		case CONTENT_TYPE_ID:
+			wp.ContentType = string(prop.Data)
+		case RESPONSE_TOPIC_ID:
+			wp.ResponseTopic = string(prop.Data)
+		case CORRELATION_DATA_ID:
+			wp.CorrelationData = prop.Data
+		case USER_PROPERTY_ID:
+			wp.UserProperties = append(wp.UserProperties, UserProperty{Key: string(prop.Data), Value: string(prop.Value)})
+		}
+	}
+}
+
+func (p *ConnectControlPacket) String() string {
+	vh := p.VariableHeader
+	flags := vh.ConnectFlags
+	fields := []string{
+		fmt.Sprintf("protocol=%s/%d", vh.ProtocolName, vh.ProtocolLevel),
+		fmt.Sprintf("clientID=%q", p.ConnectPayload.ClientID),
+		fmt.Sprintf("keepAlive=%d", vh.KeepAlive),
+		fmt.Sprintf("cleanStart=%t", flags.CleanStart),
+	}
+	if flags.WillFlag {
+		fields = append(fields, fmt.Sprintf("willTopic=%q willQoS=%d willRetain=%t", p.ConnectPayload.WillTopic, flags.WillQoS, flags.WillRetain))
+	}
+	// The password is never shown
+	if flags.UserName {
+		fields = append(fields, fmt.Sprintf("userName=%q", p.ConnectPayload.UserName))
+	}
+	if int(vh.ProtocolLevel) == 5 {
+		fields = append(fields, propertyNames(vh.ConnectProperties.names()))
+	}
+	return summarize(CONNECT, fields...)
+}
 
+func (props *ConnectProperties) names() (names []string) {
+	if props.SessionExpiryInterval > 0 {
+		names = append(names, "SessionExpiryInterval")
+	}
+	if props.ReceiveMaximumValue != nil {
+		names = append(names, "ReceiveMaximum")
+	}
+	if props.MaximumPacketSize > 0 {
+		names = append(names, "MaximumPacketSize")
+	}
+	if props.TopicAliasMaximumValue > 0 {
+		names = append(names, "TopicAliasMaximum")
+	}
+	if props.RequestResponseInfo > 0 {
+		names = append(names, "RequestResponseInformation")
+	}
+	if props.RequestProblemInfo > 0 {
+		names = append(names, "RequestProblemInformation")
+	}
+	if props.AuthenticationMethod != "" {
+		names = append(names, "AuthenticationMethod")
+	}
+	if props.AuthenticationData != nil {
+		names = append(names, "AuthenticationData")
+	}
+	return
 }
@@ -0,0 +1,120 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadConnectWill(t *testing.T) {
+	raw := []byte{
+		0x10, 39,
+		0, 4, 'M', 'Q', 'T', 'T', 5,
+		0x2e, // will retain, will QoS 1, will flag, clean start
+		0, 60,
+		0, // properties
+		0, 2, 'i', 'd',
+		5, WILL_DELAY_INTERVAL_ID, 0, 0, 0, 30, // will properties
+		0, 7, 's', 't', 'a', 't', 'u', 's', '/',
+		0, 7, 'o', 'f', 'f', 'l', 'i', 'n', 'e',
+	}
+	p, err := ReadPacket(bytes.NewReader(raw), 0)
+	require.NoError(t, err)
+	connect, ok := p.(*ConnectControlPacket)
+	require.True(t, ok)
+
+	flags := connect.VariableHeader.ConnectFlags
+	assert.True(t, flags.WillFlag)
+	assert.True(t, flags.WillRetain)
+	assert.Equal(t, 1, flags.WillQoS)
+	assert.True(t, flags.CleanStart)
+	assert.Equal(t, "id", connect.ConnectPayload.ClientID)
+	assert.Equal(t, "status/", connect.ConnectPayload.WillTopic)
+	assert.Equal(t, []byte("offline"), connect.ConnectPayload.WillPayload)
+	assert.Equal(t, 30, connect.ConnectPayload.WillProperties.WillDelayInterval)
+}
+
+func TestReadConnectInvalidWillFlags(t *testing.T) {
+	raw := []byte{
+		0x10, 14,
+		0, 4, 'M', 'Q', 'T', 'T', 4,
+		0x0a, // will QoS 1 without will flag
+		0, 60,
+		0, 2, 'i', 'd',
+	}
+	_, err := ReadPacket(bytes.NewReader(raw), 0)
+	protocolErr, ok := err.(*ProtocolError)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, ReasonCodeMalformedPacket, protocolErr.ReasonCode)
+}
+
+func TestReadConnectEmptyClientID(t *testing.T) {
+	raw := []byte{
+		0x10, 12,
+		0, 4, 'M', 'Q', 'T', 'T', 4,
+		0x02, // clean session
+		0, 60,
+		0, 0, // empty client ID
+	}
+	p, err := ReadPacket(bytes.NewReader(raw), 0)
+	require.NoError(t, err)
+	connect, ok := p.(*ConnectControlPacket)
+	require.True(t, ok)
+	assert.Equal(t, "", connect.ConnectPayload.ClientID)
+}
+
+func TestReadConnectCredentials(t *testing.T) {
+	raw := []byte{
+		0x10, 25,
+		0, 4, 'M', 'Q', 'T', 'T', 4,
+		0xc2, // user name, password, clean session
+		0, 60,
+		0, 2, 'i', 'd',
+		0, 4, 'u', 's', 'e', 'r',
+		0, 3, 'p', 'w', 0,
+	}
+	p, err := ReadPacket(bytes.NewReader(raw), 0)
+	require.NoError(t, err)
+	connect, ok := p.(*ConnectControlPacket)
+	require.True(t, ok)
+	assert.Equal(t, "user", connect.ConnectPayload.UserName)
+	assert.Equal(t, []byte{'p', 'w', 0}, connect.ConnectPayload.Password)
+	assert.NotContains(t, connect.String(), "pw")
+	marshalled, err := json.Marshal(connect)
+	require.NoError(t, err)
+	assert.Contains(t, string(marshalled), `"UserName":"user"`)
+	assert.NotContains(t, string(marshalled), `"Password":"`)
+	assert.NotContains(t, string(marshalled), "cHcA") // base64 of the password
+
+	// MQTT 3.1.1 doesn't allow a password without user name
+	raw = []byte{
+		0x10, 17,
+		0, 4, 'M', 'Q', 'T', 'T', 4,
+		0x42, // password, clean session
+		0, 60,
+		0, 2, 'i', 'd',
+		0, 1, 'p',
+	}
+	_, err = ReadPacket(bytes.NewReader(raw), 0)
+	assert.Error(t, err)
+}
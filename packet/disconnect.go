@@ -0,0 +1,148 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+type DisconnectControlPacket struct {
+	FixedHeader    FixedHeader
+	VariableHeader DisconnectVariableHeader
+	// ProtocolLevel selects the encoding used by WriteTo. Only MQTT 5 has a
+	// reason code and properties.
+	ProtocolLevel byte
+}
+
+type DisconnectVariableHeader struct {
+	ReasonCode           byte // MQTT 5 only
+	DisconnectProperties DisconnectProperties
+}
+
+type DisconnectProperties struct {
+	SessionExpiryInterval *int // nil if the CONNECT value stays in effect
+	ReasonString          string
+	ServerReference       string
+}
+
+// readDisconnectVariableHeader reads the MQTT 5 reason code and properties.
+// A remaining length of 0 means normal disconnection, which is the only
+// form MQTT 3.1.1 knows.
+func readDisconnectVariableHeader(r io.Reader, remainingLength int) (vh DisconnectVariableHeader, err error) {
+	if remainingLength == 0 {
+		return
+	}
+	b := make([]byte, 1)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	vh.ReasonCode = b[0]
+	if remainingLength == 1 {
+		return
+	}
+
+	props, _, err := readProperties(r)
+	if err != nil {
+		return
+	}
+	for _, prop := range props {
+		switch prop.ID {
+		case SESSION_EXPIRY_INTERVAL_ID:
+			interval := prop.Int
+			vh.DisconnectProperties.SessionExpiryInterval = &interval
+		case REASON_STRING_ID:
+			vh.DisconnectProperties.ReasonString = string(prop.Data)
+		case SERVER_REFERENCE_ID:
+			vh.DisconnectProperties.ServerReference = string(prop.Data)
+		}
+	}
+	return
+}
+
+func NewDisconnect(protocolLevel byte, reasonCode byte) *DisconnectControlPacket {
+	return &DisconnectControlPacket{
+		FixedHeader: FixedHeader{
+			ControlPacketType: DISCONNECT,
+		},
+		VariableHeader: DisconnectVariableHeader{
+			ReasonCode: reasonCode,
+		},
+		ProtocolLevel: protocolLevel,
+	}
+}
+
+func (props *DisconnectProperties) serialize() []byte {
+	var b propertyBuffer
+	if props.SessionExpiryInterval != nil {
+		b.writeUint32Property(SESSION_EXPIRY_INTERVAL_ID, uint32(*props.SessionExpiryInterval))
+	}
+	if props.ReasonString != "" {
+		b.writeStringProperty(REASON_STRING_ID, props.ReasonString)
+	}
+	if props.ServerReference != "" {
+		b.writeStringProperty(SERVER_REFERENCE_ID, props.ServerReference)
+	}
+	return b.Bytes()
+}
+
+func (p *DisconnectControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	var body []byte
+	if int(p.ProtocolLevel) == 5 {
+		props := p.VariableHeader.DisconnectProperties.serialize()
+		if p.VariableHeader.ReasonCode != ReasonCodeNormalDisconnection || len(props) > 0 {
+			buf := &bytes.Buffer{}
+			buf.WriteByte(p.VariableHeader.ReasonCode)
+			if len(props) > 0 {
+				if _, err = writeProperties(buf, props); err != nil {
+					return
+				}
+			}
+			body = buf.Bytes()
+		}
+	}
+	p.FixedHeader.RemainingLength = len(body)
+
+	n, err = p.FixedHeader.WriteTo(w)
+	if err != nil {
+		return
+	}
+	written, err := w.Write(body)
+	n += int64(written)
+	return
+}
+
+func (p *DisconnectControlPacket) String() string {
+	fields := []string{fmt.Sprintf("reasonCode=0x%02x", p.VariableHeader.ReasonCode)}
+	var names []string
+	props := p.VariableHeader.DisconnectProperties
+	if props.SessionExpiryInterval != nil {
+		names = append(names, "SessionExpiryInterval")
+	}
+	if props.ReasonString != "" {
+		names = append(names, "ReasonString")
+	}
+	if props.ServerReference != "" {
+		names = append(names, "ServerReference")
+	}
+	if len(names) > 0 {
+		fields = append(fields, propertyNames(names))
+	}
+	return summarize(DISCONNECT, fields...)
+}
@@ -0,0 +1,211 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Handler receives the packets a client sends to a server. The Dispatcher
+// calls the methods sequentially from a single goroutine. A returned error
+// stops the Dispatcher and is returned by Serve.
+type Handler interface {
+	OnConnect(p *ConnectControlPacket) error
+	OnPublish(p *PublishControlPacket) error
+	OnPubAck(p *PubackControlPacket) error
+	OnPubRec(p *PubRecControlPacket) error
+	OnPubRel(p *PubRelControlPacket) error
+	OnPubComp(p *PubCompControlPacket) error
+	OnSubscribe(p *SubscribeControlPacket) error
+	OnUnsubscribe(p *UnsubscribeControlPacket) error
+	OnPingReq(p *PingReqControlPacket) error
+	OnDisconnect(p *DisconnectControlPacket) error
+	OnAuth(p *AuthControlPacket) error
+}
+
+type dispatcherState int
+
+const (
+	stateAwaitingConnect dispatcherState = iota
+	stateAuthenticating
+	stateConnected
+)
+
+// Dispatcher reads packets from a connection, enforces the packet ordering
+// rules and routes the packets to a Handler.
+type Dispatcher struct {
+	Conn    net.Conn
+	Handler Handler
+
+	// ConnectTimeouts are used to read the CONNECT packet, Timeouts for all
+	// packets after it.
+	ConnectTimeouts ReadTimeouts
+	// MaxPacketSize is the size in bytes of the largest packet accepted,
+	// larger packets end Serve with a *ProtocolError before they are read.
+	// 0 means no limit.
+	MaxPacketSize int
+
+	mu            sync.Mutex
+	timeouts      ReadTimeouts
+	state         dispatcherState
+	protocolLevel byte
+	enhancedAuth  bool
+}
+
+// NewDispatcher creates a Dispatcher for the connection c.
+func NewDispatcher(c net.Conn, h Handler, connectTimeouts ReadTimeouts) *Dispatcher {
+	return &Dispatcher{
+		Conn:            c,
+		Handler:         h,
+		ConnectTimeouts: connectTimeouts,
+	}
+}
+
+// SetTimeouts changes the read timeouts for the packets after CONNECT, e.g.
+// once the keep alive is known.
+func (d *Dispatcher) SetTimeouts(t ReadTimeouts) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.timeouts = t
+}
+
+// ProtocolLevel returns the protocol level of the CONNECT packet, or 0 if it
+// hasn't been received yet.
+func (d *Dispatcher) ProtocolLevel() byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.protocolLevel
+}
+
+// Authenticated ends an enhanced authentication exchange started by a
+// CONNECT with Authentication Method. Handlers call it when they send the
+// CONNACK, after that all packets are accepted again.
+func (d *Dispatcher) Authenticated() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state == stateAuthenticating {
+		d.state = stateConnected
+	}
+}
+
+func (d *Dispatcher) readTimeouts() ReadTimeouts {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state == stateAwaitingConnect {
+		return d.ConnectTimeouts
+	}
+	return d.timeouts
+}
+
+// Serve dispatches packets until the client disconnects, an error occurs or
+// ctx is done. A DISCONNECT packet ends Serve with a nil error. Packets
+// violating the ordering rules end it with a *ProtocolError.
+func (d *Dispatcher) Serve(ctx context.Context) error {
+	for {
+		p, err := readPacketContext(ctx, d.Conn, d.ProtocolLevel(), d.readTimeouts(), d.MaxPacketSize)
+		if err != nil {
+			return err
+		}
+
+		if err = d.checkOrder(p); err != nil {
+			return err
+		}
+
+		if err = d.dispatch(p); err != nil {
+			return err
+		}
+
+		if _, ok := p.(*DisconnectControlPacket); ok {
+			return nil
+		}
+	}
+}
+
+func (d *Dispatcher) checkOrder(p ControlPacket) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch p := p.(type) {
+	case *ConnectControlPacket:
+		if d.state != stateAwaitingConnect {
+			return &ProtocolError{ReasonCode: ReasonCodeProtocolError, Message: "Received second CONNECT packet"}
+		}
+		d.protocolLevel = p.VariableHeader.ProtocolLevel
+		d.state = stateConnected
+		if int(d.protocolLevel) == 5 && p.VariableHeader.ConnectProperties.AuthenticationMethod != "" {
+			d.enhancedAuth = true
+			d.state = stateAuthenticating
+		}
+		return nil
+	case *AuthControlPacket:
+		if d.state == stateAwaitingConnect {
+			break
+		}
+		// AUTH, including re-authentication, is only allowed if the CONNECT
+		// started enhanced authentication. The Handler checks the method.
+		if !d.enhancedAuth {
+			return &ProtocolError{ReasonCode: ReasonCodeProtocolError, Message: "Received AUTH without enhanced authentication"}
+		}
+		return nil
+	}
+
+	switch d.state {
+	case stateAwaitingConnect:
+		return &ProtocolError{ReasonCode: ReasonCodeProtocolError, Message: fmt.Sprintf("Expected CONNECT as first packet, got %v", p)}
+	case stateAuthenticating:
+		// Either side may end the exchange with DISCONNECT
+		if _, ok := p.(*DisconnectControlPacket); ok {
+			return nil
+		}
+		return &ProtocolError{ReasonCode: ReasonCodeProtocolError, Message: fmt.Sprintf("Expected AUTH during authentication, got %v", p)}
+	}
+	return nil
+}
+
+// nolint: gocyclo
+func (d *Dispatcher) dispatch(p ControlPacket) error {
+	switch p := p.(type) {
+	case *ConnectControlPacket:
+		return d.Handler.OnConnect(p)
+	case *PublishControlPacket:
+		return d.Handler.OnPublish(p)
+	case *PubackControlPacket:
+		return d.Handler.OnPubAck(p)
+	case *PubRecControlPacket:
+		return d.Handler.OnPubRec(p)
+	case *PubRelControlPacket:
+		return d.Handler.OnPubRel(p)
+	case *PubCompControlPacket:
+		return d.Handler.OnPubComp(p)
+	case *SubscribeControlPacket:
+		return d.Handler.OnSubscribe(p)
+	case *UnsubscribeControlPacket:
+		return d.Handler.OnUnsubscribe(p)
+	case *PingReqControlPacket:
+		return d.Handler.OnPingReq(p)
+	case *DisconnectControlPacket:
+		return d.Handler.OnDisconnect(p)
+	case *AuthControlPacket:
+		return d.Handler.OnAuth(p)
+	default:
+		return &ProtocolError{ReasonCode: ReasonCodeProtocolError, Message: fmt.Sprintf("Unexpected packet %v", p)}
+	}
+}
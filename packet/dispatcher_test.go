@@ -0,0 +1,115 @@
+package packet
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	rawConnect    = []byte{CONNECT << 4, 13, 0, 4, 'M', 'Q', 'T', 'T', 4, 2, 0, 60, 0, 1, 'c'}
+	rawPingReq    = []byte{PINGREQ << 4, 0}
+	rawDisconnect = []byte{DISCONNECT << 4, 0}
+	rawAuth       = []byte{AUTH << 4, 0}
+	// rawAuthConnect starts enhanced authentication with method "M"
+	rawAuthConnect = []byte{CONNECT << 4, 18, 0, 4, 'M', 'Q', 'T', 'T', 5, 2, 0, 60,
+		4, AUTHENTICATION_METHOD_ID, 0, 1, 'M', 0, 1, 'c'}
+)
+
+type recordingHandler struct {
+	packets []ControlPacket
+}
+
+func (h *recordingHandler) record(p ControlPacket) error {
+	h.packets = append(h.packets, p)
+	return nil
+}
+
+func (h *recordingHandler) OnConnect(p *ConnectControlPacket) error         { return h.record(p) }
+func (h *recordingHandler) OnPublish(p *PublishControlPacket) error         { return h.record(p) }
+func (h *recordingHandler) OnPubAck(p *PubackControlPacket) error           { return h.record(p) }
+func (h *recordingHandler) OnPubRec(p *PubRecControlPacket) error           { return h.record(p) }
+func (h *recordingHandler) OnPubRel(p *PubRelControlPacket) error           { return h.record(p) }
+func (h *recordingHandler) OnPubComp(p *PubCompControlPacket) error         { return h.record(p) }
+func (h *recordingHandler) OnSubscribe(p *SubscribeControlPacket) error     { return h.record(p) }
+func (h *recordingHandler) OnUnsubscribe(p *UnsubscribeControlPacket) error { return h.record(p) }
+func (h *recordingHandler) OnPingReq(p *PingReqControlPacket) error         { return h.record(p) }
+func (h *recordingHandler) OnDisconnect(p *DisconnectControlPacket) error   { return h.record(p) }
+func (h *recordingHandler) OnAuth(p *AuthControlPacket) error               { return h.record(p) }
+
+func serveRaw(t *testing.T, packets ...[]byte) (*recordingHandler, error) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		for _, p := range packets {
+			if _, err := client.Write(p); err != nil {
+				return
+			}
+		}
+	}()
+
+	h := &recordingHandler{}
+	err := NewDispatcher(server, h, ReadTimeouts{}).Serve(context.Background())
+	return h, err
+}
+
+func TestDispatcher(t *testing.T) {
+	h, err := serveRaw(t, rawConnect, rawPingReq, rawDisconnect)
+	assert.NoError(t, err)
+	assert.Len(t, h.packets, 3)
+	assert.IsType(t, &ConnectControlPacket{}, h.packets[0])
+	assert.IsType(t, &PingReqControlPacket{}, h.packets[1])
+	assert.IsType(t, &DisconnectControlPacket{}, h.packets[2])
+}
+
+func TestDispatcherOrdering(t *testing.T) {
+	for name, packets := range map[string][][]byte{
+		"packet before CONNECT": {rawPingReq},
+		"second CONNECT":        {rawConnect, rawConnect},
+		"AUTH without method":   {rawConnect, rawAuth},
+		"PINGREQ during AUTH":   {rawAuthConnect, rawPingReq},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := serveRaw(t, packets...)
+			protocolErr, ok := err.(*ProtocolError)
+			assert.True(t, ok)
+			if ok {
+				assert.Equal(t, ReasonCodeProtocolError, protocolErr.ReasonCode)
+			}
+		})
+	}
+}
+
+func TestDispatcherDisconnectDuringAuth(t *testing.T) {
+	h, err := serveRaw(t, rawAuthConnect, rawAuth, rawDisconnect)
+	assert.NoError(t, err)
+	assert.Len(t, h.packets, 3)
+	assert.IsType(t, &DisconnectControlPacket{}, h.packets[2])
+}
+
+func TestDispatcherMaxPacketSize(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		// Only the fixed header of a 203 byte PUBLISH is sent, the limit
+		// must be checked without waiting for the rest
+		_, _ = client.Write(rawConnect)
+		_, _ = client.Write([]byte{PUBLISH << 4, 200, 1})
+	}()
+
+	h := &recordingHandler{}
+	d := NewDispatcher(server, h, ReadTimeouts{})
+	d.MaxPacketSize = 202
+	err := d.Serve(context.Background())
+	protocolErr, ok := err.(*ProtocolError)
+	if assert.True(t, ok) {
+		assert.Equal(t, ReasonCodePacketTooLarge, protocolErr.ReasonCode)
+	}
+	assert.Len(t, h.packets, 1)
+}
@@ -0,0 +1,158 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// summarize formats the one-line representation used by the String methods
+// of the control packets, e.g. PUBLISH(id=1 qos=1 topic="a/b").
+func summarize(t ControlPacketType, fields ...string) string {
+	return t.String() + "(" + strings.Join(fields, " ") + ")"
+}
+
+func propertyNames(names []string) string {
+	return "props=[" + strings.Join(names, ",") + "]"
+}
+
+// Segment is an annotated byte range of a serialized control packet.
+type Segment struct {
+	Name   string
+	Offset int
+	Length int
+}
+
+// Segments splits a serialized control packet into fixed header, variable
+// header, properties and payload byte ranges. Empty ranges are omitted.
+// nolint: gocyclo
+func Segments(raw []byte, protocolLevel byte) ([]Segment, error) {
+	r := bytes.NewReader(raw)
+	fh, err := getFixedHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	fhLen := len(raw) - r.Len()
+	if fhLen+fh.RemainingLength > len(raw) {
+		return nil, errors.New("short read")
+	}
+	body := raw[fhLen : fhLen+fh.RemainingLength]
+
+	// Length of the variable header without the properties
+	vhLen := 0
+	withProperties := int(protocolLevel) == 5
+	switch fh.ControlPacketType {
+	case CONNECT:
+		if len(body) < 2 {
+			return nil, errors.New("short read")
+		}
+		vhLen = 2 + int(binary.BigEndian.Uint16(body)) + 4
+		if vhLen <= len(body) {
+			withProperties = body[vhLen-4] == 5
+		}
+	case CONNACK, PUBACK, PUBREC, PUBREL, PUBCOMP:
+		vhLen = 2
+		if fh.ControlPacketType != CONNACK && withProperties && len(body) > 2 {
+			vhLen = 3 // reason code
+		}
+		withProperties = withProperties && len(body) > vhLen
+	case PUBLISH:
+		if len(body) < 2 {
+			return nil, errors.New("short read")
+		}
+		vhLen = 2 + int(binary.BigEndian.Uint16(body))
+		if fh.Flags&6 > 0 {
+			vhLen += 2
+		}
+	case SUBSCRIBE, SUBACK, UNSUBSCRIBE, UNSUBACK:
+		vhLen = 2
+	case DISCONNECT, AUTH:
+		if withProperties && len(body) > 0 {
+			vhLen = 1 // reason code
+		}
+		withProperties = withProperties && len(body) > vhLen
+	default:
+		withProperties = false
+	}
+	if vhLen > len(body) {
+		return nil, errors.New("Variable header exceeds remaining length")
+	}
+
+	propsLen := 0
+	if withProperties {
+		pr := bytes.NewReader(body[vhLen:])
+		l, err := getRemainingLength(pr)
+		if err != nil {
+			return nil, err
+		}
+		propsLen = len(body[vhLen:]) - pr.Len() + l
+		if vhLen+propsLen > len(body) {
+			return nil, errors.New("Properties exceed remaining length")
+		}
+	}
+
+	segments := []Segment{{Name: "fixed header", Offset: 0, Length: fhLen}}
+	offset := fhLen
+	for _, s := range []Segment{
+		{Name: "variable header", Length: vhLen},
+		{Name: "properties", Length: propsLen},
+		{Name: "payload", Length: len(body) - vhLen - propsLen},
+	} {
+		if s.Length == 0 {
+			continue
+		}
+		s.Offset = offset
+		offset += s.Length
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+// HexDump returns a hexdump of a serialized control packet, annotated with
+// the byte ranges returned by Segments.
+func HexDump(raw []byte, protocolLevel byte) (string, error) {
+	segments, err := Segments(raw, protocolLevel)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	for _, s := range segments {
+		fmt.Fprintf(&b, "%s [%d:%d]\n", s.Name, s.Offset, s.Offset+s.Length)
+		for row := s.Offset; row < s.Offset+s.Length; row += 16 {
+			end := row + 16
+			if end > s.Offset+s.Length {
+				end = s.Offset + s.Length
+			}
+			var hexPart, asciiPart bytes.Buffer
+			for _, c := range raw[row:end] {
+				fmt.Fprintf(&hexPart, "%02x ", c)
+				if c >= 32 && c < 127 {
+					asciiPart.WriteByte(c)
+				} else {
+					asciiPart.WriteByte('.')
+				}
+			}
+			fmt.Fprintf(&b, "  %08x  %-48s |%s|\n", row, hexPart.String(), asciiPart.String())
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,54 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishString(t *testing.T) {
+	p, err := BuildPublish("a/b", []byte("hi"), 5, WithQoS(QoSLevelAtLeastOnce), WithPacketID(7),
+		WithPublishProperties(PublishProperties{MessageExpiryInterval: 10}))
+	assert.NoError(t, err)
+	assert.Equal(t, `PUBLISH(flags=0x2 qos=1 id=7 retain=false dup=false topic="a/b" payload=2B props=[MessageExpiryInterval])`, p.String())
+}
+
+func TestPacketJSON(t *testing.T) {
+	p, err := BuildPublish("a/b", []byte("hi"), 4)
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(p)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"ControlPacketType":"PUBLISH"`)
+	assert.Contains(t, string(b), `"Topic":"a/b"`)
+
+	var decoded PublishControlPacket
+	assert.NoError(t, json.Unmarshal(b, &decoded))
+	assert.Equal(t, ControlPacketType(PUBLISH), decoded.FixedHeader.ControlPacketType)
+}
+
+func TestSegments(t *testing.T) {
+	p, err := BuildPublish("a", []byte("xyz"), 5, WithQoS(QoSLevelAtLeastOnce), WithPacketID(1),
+		WithPublishProperties(PublishProperties{TopicAlias: 3}))
+	assert.NoError(t, err)
+	buf := &bytes.Buffer{}
+	_, err = p.WriteTo(buf)
+	assert.NoError(t, err)
+
+	segments, err := Segments(buf.Bytes(), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []Segment{
+		{Name: "fixed header", Offset: 0, Length: 2},
+		{Name: "variable header", Offset: 2, Length: 5},
+		{Name: "properties", Offset: 7, Length: 4},
+		{Name: "payload", Offset: 11, Length: 3},
+	}, segments)
+
+	dump, err := HexDump(buf.Bytes(), 5)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(dump, "fixed header [0:2]\n  00000000  32 0c"))
+	assert.Contains(t, dump, "|xyz|")
+}
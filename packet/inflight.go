@@ -0,0 +1,305 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrNoPacketIDAvailable    = errors.New("All packet IDs are in use")
+	ErrReceiveMaximumExceeded = errors.New("Receive maximum exceeded")
+	ErrPacketIDNotFound       = errors.New("Packet ID not found")
+	ErrPacketIDInUse          = errors.New("Packet ID is already in use")
+	ErrUnexpectedAck          = errors.New("Acknowledgement does not match the state of the message")
+	ErrQoS0NotTracked         = errors.New("QoS 0 messages are not acknowledged")
+)
+
+// PacketIDAllocator hands out packet identifiers. It never returns 0 or an
+// identifier that is still in use.
+type PacketIDAllocator struct {
+	mu    sync.Mutex
+	last  uint16
+	inUse map[uint16]struct{}
+}
+
+func NewPacketIDAllocator() *PacketIDAllocator {
+	return &PacketIDAllocator{
+		inUse: make(map[uint16]struct{}),
+	}
+}
+
+// Allocate returns the next free packet identifier.
+func (a *PacketIDAllocator) Allocate() (uint16, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := 0; i < 65535; i++ {
+		a.last++
+		if a.last == 0 {
+			a.last = 1
+		}
+		if _, ok := a.inUse[a.last]; !ok {
+			a.inUse[a.last] = struct{}{}
+			return a.last, nil
+		}
+	}
+	return 0, ErrNoPacketIDAvailable
+}
+
+// Reserve marks id as used, e.g. when restoring a session. It returns false
+// if id is 0 or already in use.
+func (a *PacketIDAllocator) Reserve(id uint16) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.inUse[id]; ok || id == 0 {
+		return false
+	}
+	a.inUse[id] = struct{}{}
+	return true
+}
+
+// Release makes id available again.
+func (a *PacketIDAllocator) Release(id uint16) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.inUse, id)
+}
+
+// InflightState is the acknowledgement a QoS 1 or QoS 2 message waits for.
+type InflightState int
+
+const (
+	// AwaitingPubAck: outbound QoS 1, PUBLISH sent
+	AwaitingPubAck InflightState = iota + 1
+	// AwaitingPubRec: outbound QoS 2, PUBLISH sent
+	AwaitingPubRec
+	// AwaitingPubComp: outbound QoS 2, PUBREL sent
+	AwaitingPubComp
+	// AwaitingPubRel: inbound QoS 2, PUBREC sent
+	AwaitingPubRel
+)
+
+func (s InflightState) String() string {
+	switch s {
+	case AwaitingPubAck:
+		return "AwaitingPubAck"
+	case AwaitingPubRec:
+		return "AwaitingPubRec"
+	case AwaitingPubComp:
+		return "AwaitingPubComp"
+	case AwaitingPubRel:
+		return "AwaitingPubRel"
+	}
+	return "Unknown"
+}
+
+type InflightMessage struct {
+	PacketID uint16
+	State    InflightState
+	Publish  *PublishControlPacket
+
+	seq uint64
+}
+
+// InflightTracker keeps track of unacknowledged QoS 1 and QoS 2 messages of
+// one connection in both directions. Outbound messages get their packet ID
+// from the tracker, inbound ones keep the ID chosen by the peer.
+//
+// The number of outbound messages is limited by the Receive Maximum of the
+// peer, the number of inbound messages by our own Receive Maximum.
+type InflightTracker struct {
+	mu            sync.Mutex
+	ids           *PacketIDAllocator
+	sendWindow    int
+	receiveWindow int
+	seq           uint64
+	outbound      map[uint16]*InflightMessage
+	inbound       map[uint16]*InflightMessage
+}
+
+// receiveWindow returns the number of messages a Receive Maximum allows in
+// flight, 0 means the protocol default of 65535.
+func receiveWindow(receiveMaximum uint16) int {
+	if receiveMaximum == 0 {
+		return 65535
+	}
+	return int(receiveMaximum)
+}
+
+// NewInflightTracker creates a tracker. A Receive Maximum of 0 means the
+// protocol default of 65535.
+func NewInflightTracker(peerReceiveMaximum, receiveMaximum uint16) *InflightTracker {
+	return &InflightTracker{
+		ids:           NewPacketIDAllocator(),
+		sendWindow:    receiveWindow(peerReceiveMaximum),
+		receiveWindow: receiveWindow(receiveMaximum),
+		outbound:      make(map[uint16]*InflightMessage),
+		inbound:       make(map[uint16]*InflightMessage),
+	}
+}
+
+// SetReceiveMaximum changes both windows, e.g. when a session is resumed
+// by a new connection. Messages already in flight are kept even if they
+// exceed the new windows.
+func (t *InflightTracker) SetReceiveMaximum(peerReceiveMaximum, receiveMaximum uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sendWindow = receiveWindow(peerReceiveMaximum)
+	t.receiveWindow = receiveWindow(receiveMaximum)
+}
+
+// Send assigns a packet ID to an outbound QoS 1 or QoS 2 PUBLISH and tracks
+// it until it is acknowledged. It fails with ErrQoS0NotTracked for QoS 0
+// and with ErrReceiveMaximumExceeded if the peer's window is full.
+func (t *InflightTracker) Send(p *PublishControlPacket) (uint16, error) {
+	if p.FixedHeaderFlags.QoS == QoSLevelNone {
+		return 0, ErrQoS0NotTracked
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.outbound) >= t.sendWindow {
+		return 0, ErrReceiveMaximumExceeded
+	}
+	id, err := t.ids.Allocate()
+	if err != nil {
+		return 0, err
+	}
+	p.VariableHeader.PacketID = id
+
+	state := AwaitingPubAck
+	if p.FixedHeaderFlags.QoS == QoSLevelExactlyOnce {
+		state = AwaitingPubRec
+	}
+	t.seq++
+	t.outbound[id] = &InflightMessage{PacketID: id, State: state, Publish: p, seq: t.seq}
+	return id, nil
+}
+
+// Resend tracks an outbound PUBLISH that already has a packet ID, e.g. when
+// a session is resumed. Like Send it fails with ErrReceiveMaximumExceeded
+// if the peer's window is full.
+func (t *InflightTracker) Resend(msg InflightMessage) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.outbound) >= t.sendWindow {
+		return ErrReceiveMaximumExceeded
+	}
+	if !t.ids.Reserve(msg.PacketID) {
+		return ErrPacketIDInUse
+	}
+	t.seq++
+	msg.seq = t.seq
+	t.outbound[msg.PacketID] = &msg
+	return nil
+}
+
+// Receive tracks an inbound QoS 2 PUBLISH until the PUBREL arrives. It
+// reports duplicate if the packet ID is already awaiting a PUBREL, in which
+// case the message must not be delivered again.
+func (t *InflightTracker) Receive(p *PublishControlPacket) (duplicate bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := p.VariableHeader.PacketID
+	if _, ok := t.inbound[id]; ok {
+		return true, nil
+	}
+	if len(t.inbound) >= t.receiveWindow {
+		return false, ErrReceiveMaximumExceeded
+	}
+	t.seq++
+	t.inbound[id] = &InflightMessage{PacketID: id, State: AwaitingPubRel, Publish: p, seq: t.seq}
+	return false, nil
+}
+
+// PubAck completes an outbound QoS 1 message and releases its packet ID.
+func (t *InflightTracker) PubAck(id uint16) (*InflightMessage, error) {
+	return t.advance(t.outbound, id, AwaitingPubAck, 0)
+}
+
+// PubRec moves an outbound QoS 2 message on to wait for the PUBCOMP.
+func (t *InflightTracker) PubRec(id uint16) (*InflightMessage, error) {
+	return t.advance(t.outbound, id, AwaitingPubRec, AwaitingPubComp)
+}
+
+// PubComp completes an outbound QoS 2 message and releases its packet ID.
+func (t *InflightTracker) PubComp(id uint16) (*InflightMessage, error) {
+	return t.advance(t.outbound, id, AwaitingPubComp, 0)
+}
+
+// PubRel completes an inbound QoS 2 message.
+func (t *InflightTracker) PubRel(id uint16) (*InflightMessage, error) {
+	return t.advance(t.inbound, id, AwaitingPubRel, 0)
+}
+
+// advance moves a message from state from to state to, 0 completes it.
+func (t *InflightTracker) advance(messages map[uint16]*InflightMessage, id uint16, from, to InflightState) (*InflightMessage, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	msg, ok := messages[id]
+	if !ok {
+		return nil, ErrPacketIDNotFound
+	}
+	if msg.State != from {
+		return nil, ErrUnexpectedAck
+	}
+	if to == 0 {
+		delete(messages, id)
+		// Inbound packet IDs are chosen by the peer
+		if from != AwaitingPubRel {
+			t.ids.Release(id)
+		}
+		return msg, nil
+	}
+	msg.State = to
+	return msg, nil
+}
+
+// Outbound returns the unacknowledged outbound messages in the order they
+// were sent.
+func (t *InflightTracker) Outbound() []InflightMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return sortedMessages(t.outbound)
+}
+
+// Inbound returns the inbound messages awaiting a PUBREL.
+func (t *InflightTracker) Inbound() []InflightMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return sortedMessages(t.inbound)
+}
+
+// Len returns the number of outbound and inbound messages in flight.
+func (t *InflightTracker) Len() (outbound, inbound int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.outbound), len(t.inbound)
+}
+
+func sortedMessages(messages map[uint16]*InflightMessage) []InflightMessage {
+	result := make([]InflightMessage, 0, len(messages))
+	for _, msg := range messages {
+		result = append(result, *msg)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].seq < result[j].seq
+	})
+	return result
+}
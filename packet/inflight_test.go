@@ -0,0 +1,133 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketIDAllocator(t *testing.T) {
+	a := NewPacketIDAllocator()
+	seen := make(map[uint16]bool)
+	for i := 0; i < 65535; i++ {
+		id, err := a.Allocate()
+		assert.NoError(t, err)
+		assert.NotEqual(t, uint16(0), id)
+		assert.False(t, seen[id])
+		seen[id] = true
+	}
+	_, err := a.Allocate()
+	assert.Equal(t, ErrNoPacketIDAvailable, err)
+
+	a.Release(42)
+	id, err := a.Allocate()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(42), id)
+}
+
+func TestInflightTrackerOutbound(t *testing.T) {
+	tracker := NewInflightTracker(2, 0)
+
+	qos1 := NewPublish("a", 0, nil, 4)
+	qos1.FixedHeaderFlags.QoS = QoSLevelAtLeastOnce
+	qos2 := NewPublish("b", 0, nil, 4)
+	qos2.FixedHeaderFlags.QoS = QoSLevelExactlyOnce
+
+	id1, err := tracker.Send(qos1)
+	assert.NoError(t, err)
+	id2, err := tracker.Send(qos2)
+	assert.NoError(t, err)
+	assert.Equal(t, id2, qos2.VariableHeader.PacketID)
+
+	qos1 = NewPublish("c", 0, nil, 4)
+	qos1.FixedHeaderFlags.QoS = QoSLevelAtLeastOnce
+	_, err = tracker.Send(qos1)
+	assert.Equal(t, ErrReceiveMaximumExceeded, err)
+
+	_, err = tracker.PubComp(id2)
+	assert.Equal(t, ErrUnexpectedAck, err)
+
+	_, err = tracker.PubAck(id1)
+	assert.NoError(t, err)
+	msg, err := tracker.PubRec(id2)
+	assert.NoError(t, err)
+	assert.Equal(t, AwaitingPubComp, msg.State)
+	assert.Equal(t, []InflightMessage{*msg}, tracker.Outbound())
+
+	_, err = tracker.PubComp(id2)
+	assert.NoError(t, err)
+	_, err = tracker.PubAck(id1)
+	assert.Equal(t, ErrPacketIDNotFound, err)
+}
+
+func TestInflightTrackerInbound(t *testing.T) {
+	tracker := NewInflightTracker(0, 1)
+
+	p, err := BuildPublish("a", nil, 4, WithQoS(QoSLevelExactlyOnce), WithPacketID(7))
+	assert.NoError(t, err)
+
+	duplicate, err := tracker.Receive(p)
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+	duplicate, err = tracker.Receive(p)
+	assert.NoError(t, err)
+	assert.True(t, duplicate)
+
+	other, err := BuildPublish("a", nil, 4, WithQoS(QoSLevelExactlyOnce), WithPacketID(8))
+	assert.NoError(t, err)
+	_, err = tracker.Receive(other)
+	assert.Equal(t, ErrReceiveMaximumExceeded, err)
+
+	_, err = tracker.PubRel(7)
+	assert.NoError(t, err)
+	_, inbound := tracker.Len()
+	assert.Equal(t, 0, inbound)
+}
+
+func TestInflightTrackerSetReceiveMaximum(t *testing.T) {
+	tracker := NewInflightTracker(1, 0)
+	qos1 := NewPublish("a", 0, nil, 4)
+	qos1.FixedHeaderFlags.QoS = QoSLevelAtLeastOnce
+	_, err := tracker.Send(qos1)
+	assert.NoError(t, err)
+	qos1 = NewPublish("b", 0, nil, 4)
+	qos1.FixedHeaderFlags.QoS = QoSLevelAtLeastOnce
+	_, err = tracker.Send(qos1)
+	assert.Equal(t, ErrReceiveMaximumExceeded, err)
+
+	tracker.SetReceiveMaximum(2, 0)
+	_, err = tracker.Send(qos1)
+	assert.NoError(t, err)
+	outbound, _ := tracker.Len()
+	assert.Equal(t, 2, outbound)
+}
+
+func TestInflightTrackerSendQoS0(t *testing.T) {
+	tracker := NewInflightTracker(0, 0)
+	_, err := tracker.Send(NewPublish("a", 0, nil, 4))
+	assert.Equal(t, ErrQoS0NotTracked, err)
+	outbound, _ := tracker.Len()
+	assert.Equal(t, 0, outbound)
+}
+
+func TestInflightTrackerResend(t *testing.T) {
+	tracker := NewInflightTracker(1, 0)
+	qos1 := NewPublish("a", 0, nil, 4)
+	qos1.FixedHeaderFlags.QoS = QoSLevelAtLeastOnce
+
+	assert.NoError(t, tracker.Resend(InflightMessage{PacketID: 3, State: AwaitingPubAck, Publish: qos1}))
+	err := tracker.Resend(InflightMessage{PacketID: 3, State: AwaitingPubAck, Publish: qos1})
+	assert.Equal(t, ErrReceiveMaximumExceeded, err)
+	err = tracker.Resend(InflightMessage{PacketID: 4, State: AwaitingPubAck, Publish: qos1})
+	assert.Equal(t, ErrReceiveMaximumExceeded, err)
+
+	tracker.SetReceiveMaximum(2, 0)
+	err = tracker.Resend(InflightMessage{PacketID: 3, State: AwaitingPubAck, Publish: qos1})
+	assert.Equal(t, ErrPacketIDInUse, err)
+	assert.NoError(t, tracker.Resend(InflightMessage{PacketID: 4, State: AwaitingPubAck, Publish: qos1}))
+
+	_, err = tracker.PubAck(3)
+	assert.NoError(t, err)
+	outbound, _ := tracker.Len()
+	assert.Equal(t, 1, outbound)
+}
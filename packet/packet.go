@@ -52,33 +52,90 @@ const (
 	PINGREQ     = 12
 	PINGRESP    = 13
 	DISCONNECT  = 14
+	AUTH        = 15
 )
 const (
-	ASSIGNED_CLIENT_ID                  = 18
-	SESSION_EXPIRY_INTERVAL_ID          = 17
-	SESSION_EXPIRY_INTERVAL_LENGTH      = 4
-	RECIEVE_MAXIMUM_ID                  = 33
-	RECIEVE_MAXIMUM_LENGTH              = 2
-	MAXIMUM_PACKET_SIZE_ID              = 39
-	MAXIMUM_PACKET_SIZE_LENGTH          = 4
-	TOPIC_ALIAS_MAXIMUM_ID              = 34
-	TOPIC_ALIAS_MAXIMUM_LENGTH          = 2
-	REQUEST_RESPONSE_INFORMATION_ID     = 25
-	REQUEST_RESPONSE_INFORMATION_LENGTH = 1
-	REQUEST_PROBLEM_INFORMATION_ID      = 23
-	REQUEST_PROBLEM_INFORMATION_LENGTH  = 1
-	TOPIC_ALIAS_ID                      = 35
-	TOPIC_ALIAS_LENGTH                  = 2
-	MESSAGE_EXPIRY_INTERVAL_ID          = 2
-	MESSAGE_EXPIRY_INTERVAL_LENGTH      = 4
-	RESPONSE_TOPIC_ID                   = 8
-	RESPONSE_TOPIC_LENGTH               = 1
-	CORRELATION_DATA_ID                 = 9
-	CORRELATION_DATA_LENGTH             = 1
-	USER_PROPERTY_ID                    = 38
-	USER_PROPERTY_LENGTH                = 1
+	ASSIGNED_CLIENT_ID                   = 18
+	SESSION_EXPIRY_INTERVAL_ID           = 17
+	SESSION_EXPIRY_INTERVAL_LENGTH       = 4
+	RECEIVE_MAXIMUM_ID                   = 33
+	RECEIVE_MAXIMUM_LENGTH               = 2
+	MAXIMUM_PACKET_SIZE_ID               = 39
+	MAXIMUM_PACKET_SIZE_LENGTH           = 4
+	TOPIC_ALIAS_MAXIMUM_ID               = 34
+	TOPIC_ALIAS_MAXIMUM_LENGTH           = 2
+	REQUEST_RESPONSE_INFORMATION_ID      = 25
+	REQUEST_RESPONSE_INFORMATION_LENGTH  = 1
+	REQUEST_PROBLEM_INFORMATION_ID       = 23
+	REQUEST_PROBLEM_INFORMATION_LENGTH   = 1
+	TOPIC_ALIAS_ID                       = 35
+	TOPIC_ALIAS_LENGTH                   = 2
+	MESSAGE_EXPIRY_INTERVAL_ID           = 2
+	MESSAGE_EXPIRY_INTERVAL_LENGTH       = 4
+	RESPONSE_TOPIC_ID                    = 8
+	RESPONSE_TOPIC_LENGTH                = 1
+	CORRELATION_DATA_ID                  = 9
+	CORRELATION_DATA_LENGTH              = 1
+	USER_PROPERTY_ID                     = 38
+	USER_PROPERTY_LENGTH                 = 1
+	PAYLOAD_FORMAT_INDICATOR_ID          = 1
+	CONTENT_TYPE_ID                      = 3
+	SUBSCRIPTION_IDENTIFIER_ID           = 11
+	SERVER_KEEP_ALIVE_ID                 = 19
+	AUTHENTICATION_METHOD_ID             = 21
+	AUTHENTICATION_DATA_ID               = 22
+	WILL_DELAY_INTERVAL_ID               = 24
+	RESPONSE_INFORMATION_ID              = 26
+	SERVER_REFERENCE_ID                  = 28
+	REASON_STRING_ID                     = 31
+	MAXIMUM_QOS_ID                       = 36
+	RETAIN_AVAILABLE_ID                  = 37
+	WILDCARD_SUBSCRIPTION_AVAILABLE_ID   = 40
+	SUBSCRIPTION_IDENTIFIER_AVAILABLE_ID = 41
+	SHARED_SUBSCRIPTION_AVAILABLE_ID     = 42
 )
 
+var controlPacketTypeNames = map[ControlPacketType]string{
+	CONNECT:     "CONNECT",
+	CONNACK:     "CONNACK",
+	PUBLISH:     "PUBLISH",
+	PUBACK:      "PUBACK",
+	PUBREC:      "PUBREC",
+	PUBREL:      "PUBREL",
+	PUBCOMP:     "PUBCOMP",
+	SUBSCRIBE:   "SUBSCRIBE",
+	SUBACK:      "SUBACK",
+	UNSUBSCRIBE: "UNSUBSCRIBE",
+	UNSUBACK:    "UNSUBACK",
+	PINGREQ:     "PINGREQ",
+	PINGRESP:    "PINGRESP",
+	DISCONNECT:  "DISCONNECT",
+	AUTH:        "AUTH",
+}
+
+func (t ControlPacketType) String() string {
+	if name, ok := controlPacketTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", byte(t))
+}
+
+// MarshalText encodes the packet type by name, so JSON shows "PUBLISH"
+// instead of 3.
+func (t ControlPacketType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *ControlPacketType) UnmarshalText(text []byte) error {
+	for packetType, name := range controlPacketTypeNames {
+		if name == string(text) {
+			*t = packetType
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown control packet type: %s", text)
+}
+
 // FixedHeader is contained in every packet (thus, fixed). It consists of the
 // Packet Type, Packet-specific Flags and the length of the rest of the message.
 type FixedHeader struct {
@@ -87,6 +144,15 @@ type FixedHeader struct {
 	RemainingLength   int
 }
 
+// size returns the size of the whole packet including the fixed header.
+func (fh FixedHeader) size() int {
+	size := 2 + fh.RemainingLength
+	for l := fh.RemainingLength; l >= 128; l /= 128 {
+		size++
+	}
+	return size
+}
+
 type ControlPacket interface {
 }
 
@@ -151,16 +217,19 @@ func ReadPacket(r io.Reader, protocolLevel byte) (ControlPacket, error) {
 	if err != nil {
 		return nil, err
 	}
+	return readRemaining(r, fh, protocolLevel)
+}
 
+func readRemaining(r io.Reader, fh FixedHeader, protocolLevel byte) (ControlPacket, error) {
 	// Ensure that we always read the remaining bytes
 	bufRemaining := make([]byte, fh.RemainingLength)
 	n, err := io.ReadFull(r, bufRemaining)
-	if n != fh.RemainingLength {
-		return nil, errors.New("short read")
-	}
 	if err != nil {
 		return nil, err
 	}
+	if n != fh.RemainingLength {
+		return nil, errors.New("short read")
+	}
 
 	remainingReader := bytes.NewBuffer(bufRemaining)
 
@@ -177,7 +246,7 @@ func parseToConcretePacket(remainingReader io.Reader, fh FixedHeader, protocolLe
 		}
 		payloadLength := fh.RemainingLength - variableHeaderSize
 
-		cp, err := readConnectPayload(remainingReader, payloadLength)
+		cp, err := readConnectPayload(remainingReader, payloadLength, vh.ConnectFlags, vh.ProtocolLevel)
 		if err != nil {
 			return nil, err
 		}
@@ -201,7 +270,6 @@ func parseToConcretePacket(remainingReader io.Reader, fh FixedHeader, protocolLe
 		}
 
 		payload, err := readPublishPayload(remainingReader, fh.RemainingLength-vhLength)
-		fmt.Printf("Publish payload :%v\n", payload)
 		if err != nil {
 			return nil, err
 		}
@@ -211,6 +279,7 @@ func parseToConcretePacket(remainingReader io.Reader, fh FixedHeader, protocolLe
 			FixedHeaderFlags: flags,
 			VariableHeader:   vh,
 			Payload:          payload,
+			ProtocolLevel:    protocolLevel,
 		}
 		return packet, nil
 	case SUBSCRIBE:
@@ -219,7 +288,7 @@ func parseToConcretePacket(remainingReader io.Reader, fh FixedHeader, protocolLe
 			return nil, err
 		}
 
-		_, payload, err := readSubscribePayload(remainingReader, fh.RemainingLength-vhLen)
+		_, payload, err := readSubscribePayload(remainingReader, fh.RemainingLength-vhLen, protocolLevel)
 		if err != nil {
 			return nil, err
 		}
@@ -248,11 +317,58 @@ func parseToConcretePacket(remainingReader io.Reader, fh FixedHeader, protocolLe
 			VariableHeader: vh,
 			Payload:        payload,
 		}
-		fmt.Printf("Client has unsubscribed %v", fh.ControlPacketType)
 		return packet, nil
+	case PUBACK:
+		packetID, reasonCode, err := readAckVariableHeader(remainingReader, fh.RemainingLength)
+		if err != nil {
+			return nil, err
+		}
+		return &PubackControlPacket{
+			FixedHeader:    fh,
+			VariableHeader: PubAckVariableHeader{PacketID: packetID, ReasonCode: reasonCode},
+		}, nil
+	case PUBREC:
+		packetID, reasonCode, err := readAckVariableHeader(remainingReader, fh.RemainingLength)
+		if err != nil {
+			return nil, err
+		}
+		return &PubRecControlPacket{
+			FixedHeader:    fh,
+			VariableHeader: PubRecVariableHeader{PacketID: packetID, ReasonCode: reasonCode},
+		}, nil
+	case PUBREL:
+		if fh.Flags != 2 {
+			return nil, &ProtocolError{ReasonCode: ReasonCodeMalformedPacket, Message: "Invalid PUBREL flags"}
+		}
+		packetID, reasonCode, err := readAckVariableHeader(remainingReader, fh.RemainingLength)
+		if err != nil {
+			return nil, err
+		}
+		return &PubRelControlPacket{
+			FixedHeader:    fh,
+			VariableHeader: PubRelVariableHeader{PacketID: packetID, ReasonCode: reasonCode},
+		}, nil
+	case PUBCOMP:
+		packetID, reasonCode, err := readAckVariableHeader(remainingReader, fh.RemainingLength)
+		if err != nil {
+			return nil, err
+		}
+		return &PubCompControlPacket{
+			FixedHeader:    fh,
+			VariableHeader: PubCompVariableHeader{PacketID: packetID, ReasonCode: reasonCode},
+		}, nil
 	case DISCONNECT:
-		fmt.Println("Client disconnected")
-		return nil, errors.New("Client disconnected")
+		vh, err := readDisconnectVariableHeader(remainingReader, fh.RemainingLength)
+		if err != nil {
+			return nil, err
+		}
+		return &DisconnectControlPacket{FixedHeader: fh, VariableHeader: vh}, nil
+	case AUTH:
+		vh, err := readAuthVariableHeader(remainingReader, fh.RemainingLength)
+		if err != nil {
+			return nil, err
+		}
+		return &AuthControlPacket{FixedHeader: fh, VariableHeader: vh}, nil
 	default:
 		return nil, fmt.Errorf("Unknown control packet type: %v", fh.ControlPacketType)
 	}
@@ -3,3 +3,7 @@ package packet
 type PingReqControlPacket struct {
 	FixedHeader FixedHeader
 }
+
+func (p *PingReqControlPacket) String() string {
+	return summarize(PINGREQ)
+}
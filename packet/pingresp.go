@@ -17,3 +17,7 @@ func NewPingRespControlPacket() *PingRespControlPacket {
 		},
 	}
 }
+
+func (p *PingRespControlPacket) String() string {
+	return summarize(PINGRESP)
+}
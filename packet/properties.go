@@ -0,0 +1,234 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// propertyBuffer collects encoded MQTT 5 properties. The property length
+// prefix is not part of the buffer, it is written by writeProperties.
+type propertyBuffer struct {
+	bytes.Buffer
+}
+
+func (b *propertyBuffer) writeByteProperty(id byte, v byte) {
+	b.WriteByte(id)
+	b.WriteByte(v)
+}
+
+func (b *propertyBuffer) writeUint16Property(id byte, v uint16) {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, v)
+	b.WriteByte(id)
+	b.Write(buf)
+}
+
+func (b *propertyBuffer) writeUint32Property(id byte, v uint32) {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+	b.WriteByte(id)
+	b.Write(buf)
+}
+
+func (b *propertyBuffer) writeStringProperty(id byte, s string) {
+	b.writeBinaryProperty(id, []byte(s))
+}
+
+func (b *propertyBuffer) writeBinaryProperty(id byte, data []byte) {
+	b.WriteByte(id)
+	b.writeBinary(data)
+}
+
+func (b *propertyBuffer) writeStringPairProperty(id byte, key, value string) {
+	b.WriteByte(id)
+	b.writeBinary([]byte(key))
+	b.writeBinary([]byte(value))
+}
+
+func (b *propertyBuffer) writeBinary(data []byte) {
+	l := make([]byte, 2)
+	binary.BigEndian.PutUint16(l, uint16(len(data)))
+	b.Write(l)
+	b.Write(data)
+}
+
+// varIntSize returns the number of bytes needed to encode v as a variable
+// byte integer, like the remaining length.
+func varIntSize(v int) int {
+	size := 1
+	for v >= 128 {
+		v /= 128
+		size++
+	}
+	return size
+}
+
+// propertiesSize returns the number of bytes the properties occupy on the
+// wire, including the length prefix.
+func propertiesSize(props []byte) int {
+	return varIntSize(len(props)) + len(props)
+}
+
+// writeProperties writes the property length followed by the properties.
+func writeProperties(w io.Writer, props []byte) (n int64, err error) {
+	written, err := serializeRemainingLength(w, len(props))
+	n += int64(written)
+	if err != nil || len(props) == 0 {
+		return
+	}
+	written, err = w.Write(props)
+	n += int64(written)
+	return
+}
+
+type propertyType int
+
+const (
+	propertyTypeByte propertyType = iota
+	propertyTypeUint16
+	propertyTypeUint32
+	propertyTypeVarInt
+	propertyTypeString
+	propertyTypeBinary
+	propertyTypeStringPair
+)
+
+var propertyTypes = map[byte]propertyType{
+	PAYLOAD_FORMAT_INDICATOR_ID:          propertyTypeByte,
+	MESSAGE_EXPIRY_INTERVAL_ID:           propertyTypeUint32,
+	CONTENT_TYPE_ID:                      propertyTypeString,
+	RESPONSE_TOPIC_ID:                    propertyTypeString,
+	CORRELATION_DATA_ID:                  propertyTypeBinary,
+	SUBSCRIPTION_IDENTIFIER_ID:           propertyTypeVarInt,
+	SESSION_EXPIRY_INTERVAL_ID:           propertyTypeUint32,
+	ASSIGNED_CLIENT_ID:                   propertyTypeString,
+	SERVER_KEEP_ALIVE_ID:                 propertyTypeUint16,
+	AUTHENTICATION_METHOD_ID:             propertyTypeString,
+	AUTHENTICATION_DATA_ID:               propertyTypeBinary,
+	REQUEST_PROBLEM_INFORMATION_ID:       propertyTypeByte,
+	WILL_DELAY_INTERVAL_ID:               propertyTypeUint32,
+	REQUEST_RESPONSE_INFORMATION_ID:      propertyTypeByte,
+	RESPONSE_INFORMATION_ID:              propertyTypeString,
+	SERVER_REFERENCE_ID:                  propertyTypeString,
+	REASON_STRING_ID:                     propertyTypeString,
+	RECEIVE_MAXIMUM_ID:                   propertyTypeUint16,
+	TOPIC_ALIAS_MAXIMUM_ID:               propertyTypeUint16,
+	TOPIC_ALIAS_ID:                       propertyTypeUint16,
+	MAXIMUM_QOS_ID:                       propertyTypeByte,
+	RETAIN_AVAILABLE_ID:                  propertyTypeByte,
+	USER_PROPERTY_ID:                     propertyTypeStringPair,
+	MAXIMUM_PACKET_SIZE_ID:               propertyTypeUint32,
+	WILDCARD_SUBSCRIPTION_AVAILABLE_ID:   propertyTypeByte,
+	SUBSCRIPTION_IDENTIFIER_AVAILABLE_ID: propertyTypeByte,
+	SHARED_SUBSCRIPTION_AVAILABLE_ID:     propertyTypeByte,
+}
+
+// property is a single decoded MQTT 5 property. Integer properties are
+// stored in Int, strings and binary data in Data. User properties use Data
+// for the key and Value for the value.
+type property struct {
+	ID    byte
+	Int   int
+	Data  []byte
+	Value []byte
+}
+
+// readProperties reads the property length and the properties following
+// it. The number of bytes consumed is varIntSize(length) + length.
+func readProperties(r io.Reader) (props []property, length int, err error) {
+	length, err = getRemainingLength(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, length)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, length, err
+	}
+	props, err = parseProperties(buf)
+	return props, length, err
+}
+
+// nolint: gocyclo
+func parseProperties(buf []byte) (props []property, err error) {
+	errMalformed := &ProtocolError{ReasonCode: ReasonCodeMalformedPacket, Message: "Malformed properties"}
+	readBinary := func() ([]byte, bool) {
+		if len(buf) < 2 {
+			return nil, false
+		}
+		l := int(binary.BigEndian.Uint16(buf))
+		if len(buf) < 2+l {
+			return nil, false
+		}
+		data := buf[2 : 2+l]
+		buf = buf[2+l:]
+		return data, true
+	}
+
+	for len(buf) > 0 {
+		p := property{ID: buf[0]}
+		buf = buf[1:]
+		t, ok := propertyTypes[p.ID]
+		if !ok {
+			return nil, &ProtocolError{ReasonCode: ReasonCodeMalformedPacket, Message: fmt.Sprintf("Unknown property %v", p.ID)}
+		}
+		switch t {
+		case propertyTypeByte:
+			if len(buf) < 1 {
+				return nil, errMalformed
+			}
+			p.Int = int(buf[0])
+			buf = buf[1:]
+		case propertyTypeUint16:
+			if len(buf) < 2 {
+				return nil, errMalformed
+			}
+			p.Int = int(binary.BigEndian.Uint16(buf))
+			buf = buf[2:]
+		case propertyTypeUint32:
+			if len(buf) < 4 {
+				return nil, errMalformed
+			}
+			p.Int = int(binary.BigEndian.Uint32(buf))
+			buf = buf[4:]
+		case propertyTypeVarInt:
+			r := bytes.NewReader(buf)
+			p.Int, err = getRemainingLength(r)
+			if err != nil {
+				return nil, errMalformed
+			}
+			buf = buf[len(buf)-r.Len():]
+		case propertyTypeString, propertyTypeBinary:
+			if p.Data, ok = readBinary(); !ok {
+				return nil, errMalformed
+			}
+		case propertyTypeStringPair:
+			if p.Data, ok = readBinary(); !ok {
+				return nil, errMalformed
+			}
+			if p.Value, ok = readBinary(); !ok {
+				return nil, errMalformed
+			}
+		}
+		props = append(props, p)
+	}
+	return props, nil
+}
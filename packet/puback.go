@@ -19,6 +19,7 @@ package packet
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
@@ -28,23 +29,64 @@ type PubackControlPacket struct {
 }
 
 type PubAckVariableHeader struct {
-	PacketID uint16
+	PacketID   uint16
+	ReasonCode byte // MQTT 5 only
 }
 
-func (vh *PubAckVariableHeader) WriteTo(w io.Writer) (n int64, err error) {
-	packetID := make([]byte, 2)
-	binary.BigEndian.PutUint16(packetID, vh.PacketID)
+// readAckVariableHeader reads the variable header shared by PUBACK, PUBREC,
+// PUBREL and PUBCOMP. MQTT 3.1.1 only has the packet ID, MQTT 5 may omit the
+// reason code (success) and the properties.
+func readAckVariableHeader(r io.Reader, remainingLength int) (packetID uint16, reasonCode byte, err error) {
+	id, err := readUint16(r)
+	if err != nil {
+		return
+	}
+	packetID = uint16(id)
+	if remainingLength > 2 {
+		b := make([]byte, 1)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return
+		}
+		reasonCode = b[0]
+	}
+	if remainingLength > 3 {
+		_, _, err = readProperties(r)
+	}
+	return
+}
 
-	bytesWritten, err := w.Write(packetID)
-	n += int64(bytesWritten)
+// ackBody encodes the variable header shared by PUBACK, PUBREC, PUBREL and
+// PUBCOMP. The reason code is omitted on success, which is the only encoding
+// MQTT 3.1.1 knows.
+func ackBody(packetID uint16, reasonCode byte) []byte {
+	body := make([]byte, 2, 3)
+	binary.BigEndian.PutUint16(body, packetID)
+	if reasonCode != ReasonCodeSuccess {
+		body = append(body, reasonCode)
+	}
+	return body
+}
+
+// writeAck writes a PUBACK, PUBREC, PUBREL or PUBCOMP packet.
+func writeAck(w io.Writer, fh *FixedHeader, packetID uint16, reasonCode byte) (n int64, err error) {
+	body := ackBody(packetID, reasonCode)
+	fh.RemainingLength = len(body)
+	n, err = fh.WriteTo(w)
 	if err != nil {
 		return
 	}
+	bytesWritten, err := w.Write(body)
+	n += int64(bytesWritten)
 	return
 }
 
+func (vh *PubAckVariableHeader) WriteTo(w io.Writer) (n int64, err error) {
+	bytesWritten, err := w.Write(ackBody(vh.PacketID, vh.ReasonCode))
+	return int64(bytesWritten), err
+}
+
 func (p *PubackControlPacket) WriteTo(w io.Writer) (n int64, err error) {
-	return p.VariableHeader.WriteTo(w)
+	return writeAck(w, &p.FixedHeader, p.VariableHeader.PacketID, p.VariableHeader.ReasonCode)
 }
 
 func NewPubAckControlPacket(packetID uint16) *PubackControlPacket {
@@ -58,3 +100,10 @@ func NewPubAckControlPacket(packetID uint16) *PubackControlPacket {
 		},
 	}
 }
+
+func (p *PubackControlPacket) String() string {
+	return summarize(PUBACK,
+		fmt.Sprintf("id=%d", p.VariableHeader.PacketID),
+		fmt.Sprintf("reasonCode=0x%02x", p.VariableHeader.ReasonCode),
+	)
+}
@@ -0,0 +1,60 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAcks(t *testing.T) {
+	pubRec := NewPubRecControlPacket(7)
+	pubRec.VariableHeader.ReasonCode = ReasonCodeNotAuthorized
+
+	for _, tc := range []struct {
+		packet   io.WriterTo
+		expected []byte
+	}{
+		{NewPubAckControlPacket(0x0102), []byte{0x40, 2, 1, 2}},
+		{pubRec, []byte{0x50, 3, 0, 7, ReasonCodeNotAuthorized}},
+		{NewPubRelControlPacket(7), []byte{0x62, 2, 0, 7}},
+		{NewPubCompControlPacket(7), []byte{0x70, 2, 0, 7}},
+	} {
+		var buf bytes.Buffer
+		n, err := tc.packet.WriteTo(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(tc.expected)), n)
+		assert.Equal(t, tc.expected, buf.Bytes())
+	}
+}
+
+func TestPubRelRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := NewPubRelControlPacket(42).WriteTo(&buf)
+	require.NoError(t, err)
+
+	p, err := ReadPacket(&buf, 5)
+	require.NoError(t, err)
+	pubRel, ok := p.(*PubRelControlPacket)
+	require.True(t, ok)
+	assert.Equal(t, uint16(42), pubRel.VariableHeader.PacketID)
+}
@@ -0,0 +1,56 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"fmt"
+	"io"
+)
+
+type PubCompControlPacket struct {
+	FixedHeader    FixedHeader
+	VariableHeader PubCompVariableHeader
+}
+
+type PubCompVariableHeader struct {
+	PacketID   uint16
+	ReasonCode byte // MQTT 5 only
+}
+
+func (p *PubCompControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeAck(w, &p.FixedHeader, p.VariableHeader.PacketID, p.VariableHeader.ReasonCode)
+}
+
+func NewPubCompControlPacket(packetID uint16) *PubCompControlPacket {
+	return &PubCompControlPacket{
+		FixedHeader: FixedHeader{
+			ControlPacketType: PUBCOMP,
+			RemainingLength:   2,
+		},
+		VariableHeader: PubCompVariableHeader{
+			PacketID: packetID,
+		},
+	}
+}
+
+func (p *PubCompControlPacket) String() string {
+	return summarize(PUBCOMP,
+		fmt.Sprintf("id=%d", p.VariableHeader.PacketID),
+		fmt.Sprintf("reasonCode=0x%02x", p.VariableHeader.ReasonCode),
+	)
+}
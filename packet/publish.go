@@ -23,25 +23,31 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
 type UserProperty struct {
-	key   string
-	value string
+	Key   string
+	Value string
 }
 type PublishProperties struct {
-	PropertyLength        int    //1 byte
-	MessageExpiryInterval int    //4 bytes
-	TopicAlias            int    //2 byte
-	ResponseTopic         string //
-	CorrelationData       string
-	UserProperty          UserProperty
+	PropertyLength         int //1 byte
+	PayloadFormatIndicator int //1 byte, 1 for UTF-8 payloads
+	MessageExpiryInterval  int //4 bytes
+	TopicAlias             int //2 byte
+	ResponseTopic          string
+	CorrelationData        string
+	ContentType            string
+	UserProperties         []UserProperty
 }
 type PublishControlPacket struct {
 	FixedHeader      FixedHeader
 	FixedHeaderFlags PublishHeaderFlags
 	VariableHeader   PublishVariableHeader
 	Payload          []byte
+	// ProtocolLevel selects the encoding used by WriteTo, properties are
+	// only written for level 5.
+	ProtocolLevel byte
 }
 
 type PublishHeaderFlags struct {
@@ -52,7 +58,7 @@ type PublishHeaderFlags struct {
 
 type PublishVariableHeader struct {
 	Topic             string
-	PacketID          int
+	PacketID          uint16
 	PublishProperties PublishProperties
 }
 
@@ -90,100 +96,110 @@ func readPublishVariableHeader(r io.Reader, flags PublishHeaderFlags, protoLevel
 	vh.Topic = string(bufTopic)
 
 	if flags.QoS == QoSLevelAtLeastOnce || flags.QoS == QoSLevelExactlyOnce {
-		vh.PacketID, err = readUint16(r)
+		var packetID int
+		packetID, err = readUint16(r)
 		if err != nil {
 			return
 		}
+		vh.PacketID = uint16(packetID)
 		len += 2
 	}
 
 	if int(protoLevel) == 5 {
-		propertyLength := make([]byte, 1)
-		n, err = r.Read(propertyLength)
-		len += n
+		var (
+			props            []property
+			propertiesLength int
+		)
+		props, propertiesLength, err = readProperties(r)
+		len += varIntSize(propertiesLength) + propertiesLength
 		if err != nil {
 			return
 		}
-		vh.PublishProperties.PropertyLength = int(propertyLength[0])
-		if vh.PublishProperties.PropertyLength == 0 {
-			fmt.Printf("No optional publish properties added")
-		} else {
-			len += vh.PublishProperties.PropertyLength
-			vh, _ = readPublishProperties(r, vh)
+		vh.PublishProperties.PropertyLength = propertiesLength
+		for _, prop := range props {
+			switch prop.ID {
+			case PAYLOAD_FORMAT_INDICATOR_ID:
+				vh.PublishProperties.PayloadFormatIndicator = prop.Int
+			case MESSAGE_EXPIRY_INTERVAL_ID:
+				vh.PublishProperties.MessageExpiryInterval = prop.Int
+			case TOPIC_ALIAS_ID:
+				vh.PublishProperties.TopicAlias = prop.Int
+			case RESPONSE_TOPIC_ID:
+				vh.PublishProperties.ResponseTopic = string(prop.Data)
+			case CORRELATION_DATA_ID:
+				vh.PublishProperties.CorrelationData = string(prop.Data)
+			case CONTENT_TYPE_ID:
+				vh.PublishProperties.ContentType = string(prop.Data)
+			case USER_PROPERTY_ID:
+				vh.PublishProperties.UserProperties = append(vh.PublishProperties.UserProperties, UserProperty{Key: string(prop.Data), Value: string(prop.Value)})
+			}
 		}
 	}
 	return
 }
 
-func readPublishProperties(r io.Reader, vh PublishVariableHeader) (PublishVariableHeader, error) {
-	publishProperties := make([]byte, vh.PublishProperties.PropertyLength)
-	propertiesLength, err := io.ReadFull(r, publishProperties)
-	if err != nil {
-		return vh, err
-	}
-	if propertiesLength != vh.PublishProperties.PropertyLength {
-		return vh, errors.New("Connect Properties length incorrect")
-	}
-	for propertiesLength > 1 {
-		if propertiesLength > 1 && int(publishProperties[0]) == TOPIC_ALIAS_MAXIMUM_ID {
-			topicAlias := publishProperties[1 : TOPIC_ALIAS_MAXIMUM_LENGTH+1]
-			vh.PublishProperties.TopicAlias = int(binary.BigEndian.Uint16(topicAlias))
-			propertiesLength -= TOPIC_ALIAS_LENGTH + 1
-			publishProperties = publishProperties[TOPIC_ALIAS_MAXIMUM_LENGTH+1:]
-		}
-		if propertiesLength > 1 && int(publishProperties[0]) == MESSAGE_EXPIRY_INTERVAL_ID {
-			messageExpiryInterval := publishProperties[1 : MESSAGE_EXPIRY_INTERVAL_LENGTH+1]
-			vh.PublishProperties.MessageExpiryInterval = int(binary.BigEndian.Uint16(messageExpiryInterval))
-			propertiesLength -= MESSAGE_EXPIRY_INTERVAL_LENGTH + 1
-			publishProperties = publishProperties[MESSAGE_EXPIRY_INTERVAL_LENGTH+1:]
-		}
-		if propertiesLength > 1 && int(publishProperties[0]) == RESPONSE_TOPIC_ID {
-			responseTopic := publishProperties[1 : RESPONSE_TOPIC_LENGTH+1]
-			vh.PublishProperties.ResponseTopic = string(responseTopic)
-			propertiesLength -= RESPONSE_TOPIC_LENGTH + 1
-			publishProperties = publishProperties[RESPONSE_TOPIC_LENGTH+1:]
-		}
-		if propertiesLength > 1 && publishProperties[0] == USER_PROPERTY_ID {
-			publishProperties = publishProperties[1:]
-			userPropertyKeyLength := int(binary.BigEndian.Uint16(publishProperties[0:2]))
-			publishProperties = publishProperties[2:]
-
-			vh.PublishProperties.UserProperty.key = string(publishProperties[0:userPropertyKeyLength])
-			publishProperties = publishProperties[userPropertyKeyLength:]
-			fmt.Printf("pubProp key: %v", vh.PublishProperties.UserProperty.key)
-
-			userPropertyValueLength := int(binary.BigEndian.Uint16(publishProperties[0:2]))
-			publishProperties = publishProperties[2:]
-
-			vh.PublishProperties.UserProperty.value = string(publishProperties[0:userPropertyValueLength])
-			publishProperties = publishProperties[userPropertyValueLength:]
-			fmt.Printf("pubProp value: %v", vh.PublishProperties.UserProperty.value)
-			propertiesLength -= (4 + userPropertyKeyLength + userPropertyValueLength)
-		}
-		propertiesLength = 0
-		fmt.Printf("No additional Publish Properties added or supported")
-	}
-	return vh, nil
-}
 func readPublishPayload(r io.Reader, len int) (buf []byte, err error) {
 	buf = make([]byte, len)
 	_, err = io.ReadFull(r, buf)
 	return
 }
 
+func (flags PublishHeaderFlags) serialize() (b byte) {
+	if flags.Retain {
+		b |= 1
+	}
+	b |= byte(flags.QoS) << 1
+	if flags.Dup {
+		b |= 8
+	}
+	return
+}
+
+func (props *PublishProperties) serialize() []byte {
+	var b propertyBuffer
+	if props.PayloadFormatIndicator > 0 {
+		b.writeByteProperty(PAYLOAD_FORMAT_INDICATOR_ID, byte(props.PayloadFormatIndicator))
+	}
+	if props.MessageExpiryInterval > 0 {
+		b.writeUint32Property(MESSAGE_EXPIRY_INTERVAL_ID, uint32(props.MessageExpiryInterval))
+	}
+	if props.TopicAlias > 0 {
+		b.writeUint16Property(TOPIC_ALIAS_ID, uint16(props.TopicAlias))
+	}
+	if props.ResponseTopic != "" {
+		b.writeStringProperty(RESPONSE_TOPIC_ID, props.ResponseTopic)
+	}
+	if props.CorrelationData != "" {
+		b.writeBinaryProperty(CORRELATION_DATA_ID, []byte(props.CorrelationData))
+	}
+	if props.ContentType != "" {
+		b.writeStringProperty(CONTENT_TYPE_ID, props.ContentType)
+	}
+	for _, up := range props.UserProperties {
+		b.writeStringPairProperty(USER_PROPERTY_ID, up.Key, up.Value)
+	}
+	return b.Bytes()
+}
+
 func (p *PublishControlPacket) WriteTo(w io.Writer) (n int64, err error) {
 	var nWritten int64
 
-	// Calc Variable Header + Payload
-	p.FixedHeader.RemainingLength = 2 + len(p.VariableHeader.Topic) + len(p.Payload)
-
-	if p.VariableHeader.PublishProperties.PropertyLength > 0 {
-		p.FixedHeader.RemainingLength += p.VariableHeader.PublishProperties.PropertyLength
+	var props []byte
+	if int(p.ProtocolLevel) == 5 {
+		props = p.VariableHeader.PublishProperties.serialize()
+		p.VariableHeader.PublishProperties.PropertyLength = len(props)
 	}
+	hasPacketID := p.FixedHeaderFlags.QoS == QoSLevelAtLeastOnce || p.FixedHeaderFlags.QoS == QoSLevelExactlyOnce
 
-	if p.FixedHeaderFlags.QoS == QoSLevelAtLeastOnce || p.FixedHeaderFlags.QoS == QoSLevelExactlyOnce {
+	// Calc Variable Header + Payload
+	p.FixedHeader.Flags = p.FixedHeaderFlags.serialize()
+	p.FixedHeader.RemainingLength = 2 + len(p.VariableHeader.Topic) + len(p.Payload)
+	if hasPacketID {
 		p.FixedHeader.RemainingLength += 2
 	}
+	if int(p.ProtocolLevel) == 5 {
+		p.FixedHeader.RemainingLength += propertiesSize(props)
+	}
 
 	nWritten, err = p.FixedHeader.WriteTo(w)
 	n += nWritten
@@ -191,7 +207,7 @@ func (p *PublishControlPacket) WriteTo(w io.Writer) (n int64, err error) {
 		return n, err
 	}
 
-	nWritten, err = p.VariableHeader.WriteTo(w)
+	nWritten, err = p.VariableHeader.writeTo(w, hasPacketID, props, int(p.ProtocolLevel) == 5)
 	n += nWritten
 	if err != nil {
 		return n, err
@@ -202,7 +218,18 @@ func (p *PublishControlPacket) WriteTo(w io.Writer) (n int64, err error) {
 	return n, err
 }
 
+// WriteTo writes the variable header: the topic, the packet ID unless it is
+// 0 as for QoS 0, and the MQTT 5 properties if PropertyLength is set.
 func (c *PublishVariableHeader) WriteTo(w io.Writer) (n int64, err error) {
+	withProperties := c.PublishProperties.PropertyLength > 0
+	var props []byte
+	if withProperties {
+		props = c.PublishProperties.serialize()
+	}
+	return c.writeTo(w, c.PacketID != 0, props, withProperties)
+}
+
+func (c *PublishVariableHeader) writeTo(w io.Writer, hasPacketID bool, props []byte, withProperties bool) (n int64, err error) {
 	b := make([]byte, 2)
 	binary.BigEndian.PutUint16(b, uint16(len(c.Topic)))
 
@@ -217,15 +244,19 @@ func (c *PublishVariableHeader) WriteTo(w io.Writer) (n int64, err error) {
 	if err != nil {
 		return
 	}
-	if c.PublishProperties.PropertyLength > 0 {
-		b := make([]byte, 2)
-		binary.BigEndian.PutUint16(b, uint16(0))
-		written, err = w.Write(b[:1])
+	if hasPacketID {
+		binary.BigEndian.PutUint16(b, c.PacketID)
+		written, err = w.Write(b)
 		n += int64(written)
 		if err != nil {
 			return
 		}
 	}
+	if withProperties {
+		var propsWritten int64
+		propsWritten, err = writeProperties(w, props)
+		n += propsWritten
+	}
 	return
 }
 
@@ -236,22 +267,134 @@ func NewPublish(topic string, packetID uint16, payload []byte, protocolLevel byt
 	}
 	vh := PublishVariableHeader{
 		Topic:    topic,
-		PacketID: int(packetID),
-	}
-	if int(protocolLevel) == 5 {
-		vh.PublishProperties = PublishProperties{
-			PropertyLength: 1,
-		}
+		PacketID: packetID,
 	}
 	flags := PublishHeaderFlags{
-		QoS:    QoSLevelNone, // TODO
-		Dup:    false,        // TODO
-		Retain: false,        // TODO
+		QoS:    QoSLevelNone,
+		Dup:    false,
+		Retain: false,
 	}
 	return &PublishControlPacket{
 		FixedHeader:      fh,
 		FixedHeaderFlags: flags,
 		VariableHeader:   vh,
 		Payload:          payload,
+		ProtocolLevel:    protocolLevel,
+	}
+}
+
+// PublishOption configures a PUBLISH packet created by BuildPublish.
+type PublishOption func(p *PublishControlPacket)
+
+// WithQoS sets the QoS level of the PUBLISH packet.
+func WithQoS(qos QosLevel) PublishOption {
+	return func(p *PublishControlPacket) {
+		p.FixedHeaderFlags.QoS = qos
+	}
+}
+
+// WithRetain sets the RETAIN flag of the PUBLISH packet.
+func WithRetain(retain bool) PublishOption {
+	return func(p *PublishControlPacket) {
+		p.FixedHeaderFlags.Retain = retain
+	}
+}
+
+// WithDup sets the DUP flag of the PUBLISH packet. Only valid for QoS > 0.
+func WithDup(dup bool) PublishOption {
+	return func(p *PublishControlPacket) {
+		p.FixedHeaderFlags.Dup = dup
+	}
+}
+
+// WithPacketID sets the packet identifier. Required for QoS > 0, forbidden
+// for QoS 0.
+func WithPacketID(packetID uint16) PublishOption {
+	return func(p *PublishControlPacket) {
+		p.VariableHeader.PacketID = packetID
+	}
+}
+
+// WithPublishProperties sets the MQTT 5 publish properties. They are ignored
+// for other protocol levels.
+func WithPublishProperties(props PublishProperties) PublishOption {
+	return func(p *PublishControlPacket) {
+		p.VariableHeader.PublishProperties = props
+	}
+}
+
+// BuildPublish creates a PUBLISH packet and validates the combination of the
+// given options.
+func BuildPublish(topic string, payload []byte, protocolLevel byte, opts ...PublishOption) (*PublishControlPacket, error) {
+	p := NewPublish(topic, 0, payload, protocolLevel)
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.FixedHeaderFlags.QoS < QoSLevelNone || p.FixedHeaderFlags.QoS > QoSLevelExactlyOnce {
+		return nil, fmt.Errorf("Invalid QoS level: %v", p.FixedHeaderFlags.QoS)
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return nil, errors.New("Topic name of a PUBLISH must not contain wildcards")
 	}
+	if p.FixedHeaderFlags.QoS == QoSLevelNone {
+		if p.VariableHeader.PacketID != 0 {
+			return nil, errors.New("Packet ID is not allowed for QoS 0")
+		}
+		if p.FixedHeaderFlags.Dup {
+			return nil, errors.New("DUP flag must not be set for QoS 0")
+		}
+	} else if p.VariableHeader.PacketID == 0 {
+		return nil, errors.New("Packet ID is required for QoS > 0")
+	}
+	if topic == "" && p.VariableHeader.PublishProperties.TopicAlias == 0 {
+		return nil, errors.New("Topic name is required without topic alias")
+	}
+	return p, nil
+}
+
+func (p *PublishControlPacket) String() string {
+	flags := p.FixedHeaderFlags
+	fields := []string{
+		fmt.Sprintf("flags=0x%x", flags.serialize()),
+		fmt.Sprintf("qos=%d", flags.QoS),
+	}
+	if flags.QoS != QoSLevelNone {
+		fields = append(fields, fmt.Sprintf("id=%d", p.VariableHeader.PacketID))
+	}
+	fields = append(fields,
+		fmt.Sprintf("retain=%t", flags.Retain),
+		fmt.Sprintf("dup=%t", flags.Dup),
+		fmt.Sprintf("topic=%q", p.VariableHeader.Topic),
+		fmt.Sprintf("payload=%dB", len(p.Payload)),
+	)
+	if int(p.ProtocolLevel) == 5 {
+		fields = append(fields, propertyNames(p.VariableHeader.PublishProperties.names()))
+	}
+	return summarize(PUBLISH, fields...)
+}
+
+func (props *PublishProperties) names() (names []string) {
+	if props.PayloadFormatIndicator > 0 {
+		names = append(names, "PayloadFormatIndicator")
+	}
+	if props.MessageExpiryInterval > 0 {
+		names = append(names, "MessageExpiryInterval")
+	}
+	if props.TopicAlias > 0 {
+		names = append(names, "TopicAlias")
+	}
+	if props.ResponseTopic != "" {
+		names = append(names, "ResponseTopic")
+	}
+	if props.CorrelationData != "" {
+		names = append(names, "CorrelationData")
+	}
+	if props.ContentType != "" {
+		names = append(names, "ContentType")
+	}
+	if len(props.UserProperties) > 0 {
+		names = append(names, "UserProperty")
+	}
+	return
 }
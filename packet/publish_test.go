@@ -1,7 +1,11 @@
 package packet
 
-import "testing"
-import "github.com/stretchr/testify/assert"
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func TestInterpretHeaderFlags(t *testing.T) {
 	input := byte(11)
@@ -11,3 +15,80 @@ func TestInterpretHeaderFlags(t *testing.T) {
 	assert.True(t, hdr.Retain)
 	assert.Equal(t, QoSLevelAtLeastOnce, hdr.QoS, "Expected at least once")
 }
+
+func TestBuildPublish(t *testing.T) {
+	p, err := BuildPublish("a/b", []byte("hi"), 4, WithQoS(QoSLevelAtLeastOnce), WithRetain(true), WithPacketID(10))
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	_, err = p.WriteTo(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x33, 9, 0, 3, 'a', '/', 'b', 0, 10, 'h', 'i'}, buf.Bytes())
+}
+
+func TestBuildPublishProperties(t *testing.T) {
+	p, err := BuildPublish("a", nil, 5, WithPublishProperties(PublishProperties{
+		MessageExpiryInterval: 300,
+		UserProperties:        []UserProperty{{Key: "k", Value: "v"}},
+	}))
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	_, err = p.WriteTo(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x30, 16, 0, 1, 'a', 12, 2, 0, 0, 1, 44, 38, 0, 1, 'k', 0, 1, 'v'}, buf.Bytes())
+	assert.Equal(t, buf.Len()-2, p.FixedHeader.RemainingLength)
+}
+
+func TestPublishVariableHeaderWriteTo(t *testing.T) {
+	vh := PublishVariableHeader{Topic: "a", PacketID: 7}
+	buf := &bytes.Buffer{}
+	n, err := vh.WriteTo(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, []byte{0, 1, 'a', 0, 7}, buf.Bytes())
+
+	vh = PublishVariableHeader{Topic: "a", PublishProperties: PublishProperties{PropertyLength: 3, TopicAlias: 2}}
+	buf.Reset()
+	_, err = vh.WriteTo(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 'a', 3, TOPIC_ALIAS_ID, 0, 2}, buf.Bytes())
+}
+
+func TestBuildPublishValidation(t *testing.T) {
+	_, err := BuildPublish("a", nil, 4, WithQoS(QoSLevelExactlyOnce))
+	assert.Error(t, err, "QoS 2 without packet ID")
+
+	_, err = BuildPublish("a", nil, 4, WithPacketID(1))
+	assert.Error(t, err, "QoS 0 with packet ID")
+
+	_, err = BuildPublish("a", nil, 4, WithDup(true))
+	assert.Error(t, err, "QoS 0 with DUP")
+
+	_, err = BuildPublish("a/#", nil, 4)
+	assert.Error(t, err, "wildcard in topic name")
+}
+
+func TestReadPublishProperties(t *testing.T) {
+	p, err := BuildPublish("a", []byte("x"), 5, WithPublishProperties(PublishProperties{
+		TopicAlias:             3,
+		MessageExpiryInterval:  100000,
+		PayloadFormatIndicator: 1,
+		ContentType:            "text/plain",
+		UserProperties:         []UserProperty{{Key: "k", Value: "1"}, {Key: "k", Value: "2"}},
+	}))
+	assert.NoError(t, err)
+	buf := &bytes.Buffer{}
+	_, err = p.WriteTo(buf)
+	assert.NoError(t, err)
+
+	read, err := ReadPacket(buf, 5)
+	assert.NoError(t, err)
+	props := read.(*PublishControlPacket).VariableHeader.PublishProperties
+	assert.Equal(t, 100000, props.MessageExpiryInterval)
+	assert.Equal(t, 3, props.TopicAlias)
+	assert.Equal(t, 1, props.PayloadFormatIndicator)
+	assert.Equal(t, "text/plain", props.ContentType)
+	assert.Equal(t, []UserProperty{{Key: "k", Value: "1"}, {Key: "k", Value: "2"}}, props.UserProperties)
+	assert.Equal(t, []byte("x"), read.(*PublishControlPacket).Payload)
+}
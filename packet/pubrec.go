@@ -0,0 +1,56 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"fmt"
+	"io"
+)
+
+type PubRecControlPacket struct {
+	FixedHeader    FixedHeader
+	VariableHeader PubRecVariableHeader
+}
+
+type PubRecVariableHeader struct {
+	PacketID   uint16
+	ReasonCode byte // MQTT 5 only
+}
+
+func (p *PubRecControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeAck(w, &p.FixedHeader, p.VariableHeader.PacketID, p.VariableHeader.ReasonCode)
+}
+
+func NewPubRecControlPacket(packetID uint16) *PubRecControlPacket {
+	return &PubRecControlPacket{
+		FixedHeader: FixedHeader{
+			ControlPacketType: PUBREC,
+			RemainingLength:   2,
+		},
+		VariableHeader: PubRecVariableHeader{
+			PacketID: packetID,
+		},
+	}
+}
+
+func (p *PubRecControlPacket) String() string {
+	return summarize(PUBREC,
+		fmt.Sprintf("id=%d", p.VariableHeader.PacketID),
+		fmt.Sprintf("reasonCode=0x%02x", p.VariableHeader.ReasonCode),
+	)
+}
@@ -0,0 +1,57 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"fmt"
+	"io"
+)
+
+type PubRelControlPacket struct {
+	FixedHeader    FixedHeader
+	VariableHeader PubRelVariableHeader
+}
+
+type PubRelVariableHeader struct {
+	PacketID   uint16
+	ReasonCode byte // MQTT 5 only
+}
+
+func (p *PubRelControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeAck(w, &p.FixedHeader, p.VariableHeader.PacketID, p.VariableHeader.ReasonCode)
+}
+
+func NewPubRelControlPacket(packetID uint16) *PubRelControlPacket {
+	return &PubRelControlPacket{
+		FixedHeader: FixedHeader{
+			ControlPacketType: PUBREL,
+			Flags:             2,
+			RemainingLength:   2,
+		},
+		VariableHeader: PubRelVariableHeader{
+			PacketID: packetID,
+		},
+	}
+}
+
+func (p *PubRelControlPacket) String() string {
+	return summarize(PUBREL,
+		fmt.Sprintf("id=%d", p.VariableHeader.PacketID),
+		fmt.Sprintf("reasonCode=0x%02x", p.VariableHeader.ReasonCode),
+	)
+}
@@ -0,0 +1,153 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ReadTimeouts limits how long ReadPacketContext waits for each phase of a
+// packet. A zero value disables the respective timeout.
+type ReadTimeouts struct {
+	// FixedHeader bounds the wait for the fixed header, i.e. the time a
+	// connection may stay idle. Servers use it for the connect and the
+	// keep-alive timeout.
+	FixedHeader time.Duration
+	// Remaining bounds reading the rest of the packet once the fixed header
+	// has arrived, which protects against clients trickling in bytes.
+	Remaining time.Duration
+}
+
+// IdleTimeoutError is returned by ReadPacketContext if no packet started
+// within ReadTimeouts.FixedHeader. Like other timeouts it is a net.Error
+// with Timeout() == true, servers use it to tell a keep-alive timeout apart
+// from a slow packet.
+type IdleTimeoutError struct {
+	Err error
+}
+
+func (e *IdleTimeoutError) Error() string   { return "Idle timeout: " + e.Err.Error() }
+func (e *IdleTimeoutError) Timeout() bool   { return true }
+func (e *IdleTimeoutError) Temporary() bool { return false }
+func (e *IdleTimeoutError) Unwrap() error   { return e.Err }
+
+// aLongTimeAgo is used as read deadline to unblock pending reads.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// deadlineSetter guards the read deadline of a connection so that a
+// cancelled context can't be overwritten by the deadline of the next phase.
+type deadlineSetter struct {
+	mu        sync.Mutex
+	conn      net.Conn
+	cancelled bool
+}
+
+func (d *deadlineSetter) set(ctx context.Context, timeout time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancelled {
+		return nil
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+	return d.conn.SetReadDeadline(deadline)
+}
+
+func (d *deadlineSetter) cancel() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cancelled = true
+	_ = d.conn.SetReadDeadline(aLongTimeAgo) // nolint: gosec
+}
+
+// ReadPacketContext reads a control packet like ReadPacket, but gives up when
+// ctx is done or a phase exceeds its timeout. The read deadline of c is
+// reset before returning. If ctx ended the read, ctx.Err() is returned,
+// otherwise timeouts are reported as net.Error with Timeout() == true.
+func ReadPacketContext(ctx context.Context, c net.Conn, protocolLevel byte, timeouts ReadTimeouts) (ControlPacket, error) {
+	return readPacketContext(ctx, c, protocolLevel, timeouts, 0)
+}
+
+// readPacketContext is ReadPacketContext refusing packets larger than
+// maxSize bytes, 0 means no limit.
+func readPacketContext(ctx context.Context, c net.Conn, protocolLevel byte, timeouts ReadTimeouts, maxSize int) (ControlPacket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Registered first, so it runs after the watcher below has stopped
+	defer func() {
+		_ = c.SetReadDeadline(time.Time{}) // nolint: gosec
+	}()
+
+	d := &deadlineSetter{conn: c}
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				d.cancel()
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+
+	p, err := readPacketPhases(ctx, c, d, protocolLevel, timeouts, maxSize)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return p, err
+}
+
+func readPacketPhases(ctx context.Context, c net.Conn, d *deadlineSetter, protocolLevel byte, timeouts ReadTimeouts, maxSize int) (ControlPacket, error) {
+	if err := d.set(ctx, timeouts.FixedHeader); err != nil {
+		return nil, err
+	}
+	fh, err := getFixedHeader(c)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil, &IdleTimeoutError{Err: err}
+		}
+		return nil, err
+	}
+	// Checked before the rest of the packet is read into memory
+	if maxSize > 0 && fh.size() > maxSize {
+		return nil, &ProtocolError{ReasonCode: ReasonCodePacketTooLarge, Message: fmt.Sprintf("Packet of %d bytes exceeds the maximum packet size of %d bytes", fh.size(), maxSize)}
+	}
+
+	if err := d.set(ctx, timeouts.Remaining); err != nil {
+		return nil, err
+	}
+	return readRemaining(c, fh, protocolLevel)
+}
@@ -0,0 +1,62 @@
+package packet
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPacketContext(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		_, _ = client.Write([]byte{PINGREQ << 4, 0})
+	}()
+
+	p, err := ReadPacketContext(context.Background(), server, 4, ReadTimeouts{FixedHeader: time.Second})
+	assert.NoError(t, err)
+	assert.IsType(t, &PingReqControlPacket{}, p)
+}
+
+func TestReadPacketContextCancel(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := ReadPacketContext(ctx, server, 4, ReadTimeouts{})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestReadPacketContextTimeouts(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	_, err := ReadPacketContext(context.Background(), server, 4, ReadTimeouts{FixedHeader: 10 * time.Millisecond})
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, netErr.Timeout())
+	assert.IsType(t, &IdleTimeoutError{}, err)
+
+	// Fixed header arrives, the rest never does
+	go func() {
+		_, _ = client.Write([]byte{PUBLISH << 4, 10})
+	}()
+	_, err = ReadPacketContext(context.Background(), server, 4, ReadTimeouts{Remaining: 10 * time.Millisecond})
+	netErr, ok = err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, netErr.Timeout())
+	_, idle := err.(*IdleTimeoutError)
+	assert.False(t, idle)
+}
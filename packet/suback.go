@@ -3,6 +3,7 @@ package packet
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
@@ -104,3 +105,10 @@ func (p *SubAckControlPacket) WriteTo(w io.Writer) (n int64, err error) {
 	}
 	return
 }
+
+func (p *SubAckControlPacket) String() string {
+	return summarize(SUBACK,
+		fmt.Sprintf("id=%d", p.VariableHeader.PacketID),
+		fmt.Sprintf("returnCodes=%v", p.Payload.ReturnCodes),
+	)
+}
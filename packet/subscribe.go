@@ -1,15 +1,14 @@
 package packet
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 )
 
 type SubscribeUserProperty struct {
-	key   string
-	value string
+	Key   string
+	Value string
 }
 
 type SubscribeProperties struct {
@@ -25,7 +24,7 @@ type SubscribeControlPacket struct {
 }
 
 type SubscribeVariableHeader struct {
-	PacketID            int // int16
+	PacketID            uint16
 	SubscribeProperties SubscribeProperties
 }
 
@@ -36,6 +35,10 @@ type SubscribePayload struct {
 type Subscription struct {
 	Topic string
 	QoS   QosLevel
+	// MQTT 5 subscription options
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
 }
 
 func readSubscribeVariableHeader(r io.Reader, protocolLevel byte) (n int, vh SubscribeVariableHeader, err error) {
@@ -45,57 +48,25 @@ func readSubscribeVariableHeader(r io.Reader, protocolLevel byte) (n int, vh Sub
 	if err != nil {
 		return 0, SubscribeVariableHeader{}, err
 	}
-	vh.PacketID = packetID
+	vh.PacketID = uint16(packetID)
 	if int(protocolLevel) == 5 {
-		propertyLength := make([]byte, 1)
-		n, err = r.Read(propertyLength)
-		len += n
+		props, propertiesLength, err := readProperties(r)
+		len += varIntSize(propertiesLength) + propertiesLength
 		if err != nil {
-			return
+			return len, vh, err
 		}
-		vh.SubscribeProperties.PropertyLength = int(propertyLength[0])
-		if vh.SubscribeProperties.PropertyLength == 0 {
-			fmt.Printf("No optional subscribe properties added")
-		} else {
-			len += vh.SubscribeProperties.PropertyLength
-			vh, _ = readSubscribeProperties(r, vh)
+		vh.SubscribeProperties.PropertyLength = propertiesLength
+		for _, prop := range props {
+			if prop.ID == USER_PROPERTY_ID {
+				vh.SubscribeProperties.UserProperty.Key = string(prop.Data)
+				vh.SubscribeProperties.UserProperty.Value = string(prop.Value)
+			}
 		}
 	}
 	return len, vh, nil
 }
 
-func readSubscribeProperties(r io.Reader, vh SubscribeVariableHeader) (SubscribeVariableHeader, error) {
-	subscribeProperties := make([]byte, vh.SubscribeProperties.PropertyLength)
-	propertiesLength, err := io.ReadFull(r, subscribeProperties)
-	if err != nil {
-		return vh, err
-	}
-	if propertiesLength != vh.SubscribeProperties.PropertyLength {
-		return vh, errors.New("Subscribe Properties length incorrect")
-	}
-	for propertiesLength > 1 {
-		if subscribeProperties[0] == USER_PROPERTY_ID {
-			subscribeProperties = subscribeProperties[1:]
-			userPropertyKeyLength := int(binary.BigEndian.Uint16(subscribeProperties[0:2]))
-			subscribeProperties = subscribeProperties[2:]
-
-			vh.SubscribeProperties.UserProperty.key = string(subscribeProperties[0:userPropertyKeyLength])
-			subscribeProperties = subscribeProperties[userPropertyKeyLength:]
-
-			userPropertyValueLength := int(binary.BigEndian.Uint16(subscribeProperties[0:2]))
-			subscribeProperties = subscribeProperties[2:]
-
-			vh.SubscribeProperties.UserProperty.value = string(subscribeProperties[0:userPropertyValueLength])
-			subscribeProperties = subscribeProperties[userPropertyValueLength:]
-		} else {
-			propertiesLength = 0
-			fmt.Printf("No additional subscribe properties added or supported")
-		}
-	}
-	return vh, nil
-}
-
-func readSubscribePayload(r io.Reader, remainingLength int) (n int, payload SubscribePayload, err error) {
+func readSubscribePayload(r io.Reader, remainingLength int, protocolLevel byte) (n int, payload SubscribePayload, err error) {
 	for n < remainingLength {
 		topicLength, err := readUint16(r)
 		n += 2 // TODO get this info from readUint16, in case of errors it's maybe not exactly 2
@@ -120,7 +91,18 @@ func readSubscribePayload(r io.Reader, remainingLength int) (n int, payload Subs
 		sub := Subscription{}
 		sub.Topic = string(topic)
 
-		if qos[0]&252 > 0 {
+		reserved := byte(252)
+		if int(protocolLevel) == 5 {
+			// Bits 2-5 are the subscription options
+			reserved = 192
+			sub.NoLocal = qos[0]&4 > 0
+			sub.RetainAsPublished = qos[0]&8 > 0
+			sub.RetainHandling = (qos[0] >> 4) & 3
+			if sub.RetainHandling == 3 {
+				return n, SubscribePayload{}, errors.New("Invalid Subscribe payload. Retain Handling 3 is reserved")
+			}
+		}
+		if qos[0]&reserved > 0 {
 			return n, SubscribePayload{}, errors.New("Invalid Subscribe payload. Reserved bits of QoS are non-zero")
 		}
 
@@ -139,3 +121,14 @@ func readSubscribePayload(r io.Reader, remainingLength int) (n int, payload Subs
 	}
 	return
 }
+
+func (p *SubscribeControlPacket) String() string {
+	fields := []string{fmt.Sprintf("id=%d", p.VariableHeader.PacketID)}
+	for _, sub := range p.Payload.Subscriptions {
+		fields = append(fields, fmt.Sprintf("topic=%q qos=%d", sub.Topic, sub.QoS))
+	}
+	if p.VariableHeader.SubscribeProperties.UserProperty.Key != "" {
+		fields = append(fields, propertyNames([]string{"UserProperty"}))
+	}
+	return summarize(SUBSCRIBE, fields...)
+}
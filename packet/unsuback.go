@@ -3,6 +3,7 @@ package packet
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
@@ -91,3 +92,10 @@ func (p *UnSubAckControlPacket) WriteTo(w io.Writer) (n int64, err error) {
 	}
 	return
 }
+
+func (p *UnSubAckControlPacket) String() string {
+	return summarize(UNSUBACK,
+		fmt.Sprintf("id=%d", p.VariableHeader.PacketID),
+		fmt.Sprintf("returnCodes=%v", p.Payload.ReturnCodes),
+	)
+}
@@ -8,8 +8,8 @@ import (
 )
 
 type UnsubscribeUserProperty struct {
-	key   string
-	value string
+	Key   string
+	Value string
 }
 
 type UnsubscribeProperties struct {
@@ -26,7 +26,7 @@ type UnsubscribeControlPacket struct {
 }
 
 type UnsubscribeVariableHeader struct {
-	PacketID              int // int16
+	PacketID              uint16
 	UnsubscribeProperties UnsubscribeProperties
 }
 
@@ -36,7 +36,6 @@ type UnsubscribePayload struct {
 
 type Unsubscription struct {
 	Topic string
-	QoS   QosLevel
 }
 
 func readUnsubscribeVariableHeader(r io.Reader, protocolLevel byte) (n int, vh UnsubscribeVariableHeader, err error) {
@@ -46,7 +45,7 @@ func readUnsubscribeVariableHeader(r io.Reader, protocolLevel byte) (n int, vh U
 	if err != nil {
 		return 0, UnsubscribeVariableHeader{}, err
 	}
-	vh.PacketID = packetID
+	vh.PacketID = uint16(packetID)
 
 	if int(protocolLevel) == 5 {
 		propertyLength := make([]byte, 1)
@@ -56,9 +55,7 @@ func readUnsubscribeVariableHeader(r io.Reader, protocolLevel byte) (n int, vh U
 			return
 		}
 		vh.UnsubscribeProperties.PropertyLength = int(propertyLength[0])
-		if vh.UnsubscribeProperties.PropertyLength == 0 {
-			fmt.Printf("No optional unsubscribe properties added")
-		} else {
+		if vh.UnsubscribeProperties.PropertyLength > 0 {
 			len += vh.UnsubscribeProperties.PropertyLength
 			vh, _ = readUnsubscribeProperties(r, vh)
 		}
@@ -81,17 +78,17 @@ func readUnsubscribeProperties(r io.Reader, vh UnsubscribeVariableHeader) (Unsub
 			userPropertyKeyLength := int(binary.BigEndian.Uint16(unSubscribeProperties[0:2]))
 			unSubscribeProperties = unSubscribeProperties[2:]
 
-			vh.UnsubscribeProperties.UserProperty.key = string(unSubscribeProperties[0:userPropertyKeyLength])
+			vh.UnsubscribeProperties.UserProperty.Key = string(unSubscribeProperties[0:userPropertyKeyLength])
 			unSubscribeProperties = unSubscribeProperties[userPropertyKeyLength:]
 
 			userPropertyValueLength := int(binary.BigEndian.Uint16(unSubscribeProperties[0:2]))
 			unSubscribeProperties = unSubscribeProperties[2:]
 
-			vh.UnsubscribeProperties.UserProperty.value = string(unSubscribeProperties[0:userPropertyValueLength])
+			vh.UnsubscribeProperties.UserProperty.Value = string(unSubscribeProperties[0:userPropertyValueLength])
 			unSubscribeProperties = unSubscribeProperties[userPropertyValueLength:]
 		} else {
+			// Only User Property is supported; stop at anything else.
 			propertiesLength = 0
-			fmt.Printf("No additional Unsubscribe properties added or supported")
 		}
 	}
 	return vh, nil
@@ -112,32 +109,18 @@ func readUnsubscribePayload(r io.Reader, remainingLength int) (n int, payload Un
 			return n, UnsubscribePayload{}, err
 		}
 
-		qos := make([]byte, 1)
-		bytesRead, err = io.ReadFull(r, qos)
-		n += bytesRead
-		if err != nil {
-			return n, UnsubscribePayload{}, err
-		}
-
-		unSub := Unsubscription{}
-		unSub.Topic = string(topic)
-
-		if qos[0]&252 > 0 {
-			return n, UnsubscribePayload{}, errors.New("Invalid Unsubscribe payload. Reserved bits of QoS are non-zero")
-		}
-
-		if qos[0]&1 > 0 && qos[0]&2 > 0 {
-			return n, UnsubscribePayload{}, errors.New("Invalid QoS level in payload. It is not allowed to set both bits")
-		}
-
-		if qos[0]&1 > 0 {
-			unSub.QoS = QoSLevelAtLeastOnce
-		} else if qos[0]&2 > 0 {
-			unSub.QoS = QoSLevelExactlyOnce
-		} else {
-			unSub.QoS = QoSLevelNone
-		}
-		payload.UnSubscriptions = append(payload.UnSubscriptions, unSub)
+		payload.UnSubscriptions = append(payload.UnSubscriptions, Unsubscription{Topic: string(topic)})
 	}
 	return
 }
+
+func (p *UnsubscribeControlPacket) String() string {
+	fields := []string{fmt.Sprintf("id=%d", p.VariableHeader.PacketID)}
+	for _, unsub := range p.Payload.UnSubscriptions {
+		fields = append(fields, fmt.Sprintf("topic=%q", unsub.Topic))
+	}
+	if p.VariableHeader.UnsubscribeProperties.UserProperty.Key != "" {
+		fields = append(fields, propertyNames([]string{"UserProperty"}))
+	}
+	return summarize(UNSUBSCRIBE, fields...)
+}
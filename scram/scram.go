@@ -0,0 +1,438 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package scram implements the SCRAM-SHA-256 SASL mechanism (RFC 5802 and
+// RFC 7677) for MQTT 5 enhanced authentication. Channel binding is not
+// supported and user names and passwords are used as given, without
+// SASLprep.
+package scram
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Method is the MQTT authentication method of SCRAM-SHA-256.
+const Method = "SCRAM-SHA-256"
+
+// DefaultIterations is the iteration count used by NewCredentials if none
+// is given, the minimum recommended by RFC 7677.
+const DefaultIterations = 4096
+
+var (
+	// ErrMalformedMessage is returned for messages not following RFC 5802.
+	ErrMalformedMessage = errors.New("scram: Malformed message")
+	// ErrUnknownUser is returned by the ServerConversation for user names
+	// without credentials. It is only returned by ServerFinal, ServerFirst
+	// answers as for a known user so that user names can't be probed.
+	ErrUnknownUser = errors.New("scram: Unknown user")
+	// ErrInvalidProof is returned by the ServerConversation if the client
+	// doesn't know the password, and by the ClientConversation if the
+	// server doesn't know the credentials.
+	ErrInvalidProof = errors.New("scram: Invalid proof")
+	// ErrOutOfOrder is returned if a conversation is continued in the
+	// wrong order.
+	ErrOutOfOrder = errors.New("scram: Conversation out of order")
+)
+
+// gs2Header is the GS2 header of clients that don't support channel binding
+// and don't request an authorization identity.
+const gs2Header = "n,,"
+
+const (
+	saltSize  = 16
+	nonceSize = 18
+)
+
+// Credentials are the salted form of a password stored by the server, the
+// password itself can't be recovered from them.
+type Credentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewCredentials derives the Credentials of password with a random salt.
+// An iterations value of 0 means DefaultIterations.
+func NewCredentials(password string, iterations int) (Credentials, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return Credentials{}, err
+	}
+	if iterations == 0 {
+		iterations = DefaultIterations
+	}
+	return DeriveCredentials(password, salt, iterations), nil
+}
+
+// DeriveCredentials derives the Credentials of password with the given salt
+// and iteration count.
+func DeriveCredentials(password string, salt []byte, iterations int) Credentials {
+	clientKey, serverKey := keys(saltedPassword(password, salt, iterations))
+	storedKey := sha256.Sum256(clientKey)
+	return Credentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  serverKey,
+	}
+}
+
+// ParseCredentials parses Credentials in the format of String.
+func ParseCredentials(s string) (Credentials, error) {
+	var c Credentials
+	if !strings.HasPrefix(s, Method+"$") {
+		return c, errors.New("scram: Credentials don't start with " + Method + "$")
+	}
+	fields := strings.Split(s[len(Method)+1:], "$")
+	if len(fields) != 2 {
+		return c, errors.New("scram: Malformed credentials")
+	}
+	i := strings.IndexByte(fields[0], ':')
+	j := strings.IndexByte(fields[1], ':')
+	if i < 0 || j < 0 {
+		return c, errors.New("scram: Malformed credentials")
+	}
+	var err error
+	if c.Iterations, err = strconv.Atoi(fields[0][:i]); err != nil || c.Iterations <= 0 {
+		return c, errors.New("scram: Malformed iteration count")
+	}
+	if c.Salt, err = base64.StdEncoding.DecodeString(fields[0][i+1:]); err != nil {
+		return c, errors.New("scram: Malformed salt")
+	}
+	c.StoredKey, err = base64.StdEncoding.DecodeString(fields[1][:j])
+	if err != nil || len(c.StoredKey) != sha256.Size {
+		return c, errors.New("scram: Malformed stored key")
+	}
+	c.ServerKey, err = base64.StdEncoding.DecodeString(fields[1][j+1:])
+	if err != nil || len(c.ServerKey) != sha256.Size {
+		return c, errors.New("scram: Malformed server key")
+	}
+	return c, nil
+}
+
+// String returns the Credentials in the format of RFC 5803:
+// "SCRAM-SHA-256$<iterations>:<salt>$<stored key>:<server key>" with base64
+// encoded salt and keys.
+func (c Credentials) String() string {
+	return fmt.Sprintf("%s$%d:%s$%s:%s", Method, c.Iterations,
+		base64.StdEncoding.EncodeToString(c.Salt),
+		base64.StdEncoding.EncodeToString(c.StoredKey),
+		base64.StdEncoding.EncodeToString(c.ServerKey))
+}
+
+// ClientConversation is the client side of an authentication:
+// ClientFirst, ClientFinal and Verify have to be called in this order.
+type ClientConversation struct {
+	userName        string
+	password        string
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// NewClientConversation starts the authentication of userName.
+func NewClientConversation(userName, password string) (*ClientConversation, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	return &ClientConversation{userName: userName, password: password, nonce: nonce}, nil
+}
+
+// ClientFirst returns the client-first-message, the Authentication Data of
+// the CONNECT.
+func (c *ClientConversation) ClientFirst() []byte {
+	c.clientFirstBare = "n=" + escapeName(c.userName) + ",r=" + c.nonce
+	return []byte(gs2Header + c.clientFirstBare)
+}
+
+// ClientFinal takes the server-first-message and returns the
+// client-final-message proving that the client knows the password.
+func (c *ClientConversation) ClientFinal(serverFirst []byte) ([]byte, error) {
+	if c.clientFirstBare == "" || c.serverSignature != nil {
+		return nil, ErrOutOfOrder
+	}
+	attrs, err := parseAttributes(string(serverFirst), "r", "s", "i")
+	if err != nil {
+		return nil, err
+	}
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return nil, ErrMalformedMessage
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, ErrMalformedMessage
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations <= 0 {
+		return nil, ErrMalformedMessage
+	}
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(gs2Header)) + ",r=" + nonce
+	authMessage := c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	clientKey, serverKey := keys(saltedPassword(c.password, salt, iterations))
+	storedKey := sha256.Sum256(clientKey)
+	proof := xor(clientKey, computeHMAC(storedKey[:], authMessage))
+	c.serverSignature = computeHMAC(serverKey, authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Verify checks the server-final-message, the Authentication Data of the
+// CONNACK, proving that the server knows the credentials.
+func (c *ClientConversation) Verify(serverFinal []byte) error {
+	if c.serverSignature == nil {
+		return ErrOutOfOrder
+	}
+	if strings.HasPrefix(string(serverFinal), "e=") {
+		return fmt.Errorf("scram: Server error %q", serverFinal[2:])
+	}
+	attrs, err := parseAttributes(string(serverFinal), "v")
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return ErrMalformedMessage
+	}
+	if !hmac.Equal(signature, c.serverSignature) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// ServerConversation is the server side of an authentication: ServerFirst
+// and ServerFinal have to be called in this order.
+type ServerConversation struct {
+	credentials     func(userName string) (Credentials, bool)
+	userName        string
+	nonce           string
+	clientFirstBare string
+	serverFirst     string
+	stored          Credentials
+	unknown         bool // stored are made up, see fakeCredentials
+	done            bool
+}
+
+// NewServerConversation starts an authentication looking up the Credentials
+// of users with credentials.
+func NewServerConversation(credentials func(userName string) (Credentials, bool)) *ServerConversation {
+	return &ServerConversation{credentials: credentials}
+}
+
+// UserName returns the user name sent by the client.
+func (s *ServerConversation) UserName() string {
+	return s.userName
+}
+
+// ServerFirst takes the client-first-message and returns the
+// server-first-message with the salt and iteration count of the user. Users
+// without credentials get a salt made up from their name, which stays the
+// same while the process runs, and DefaultIterations.
+func (s *ServerConversation) ServerFirst(clientFirst []byte) ([]byte, error) {
+	if s.serverFirst != "" {
+		return nil, ErrOutOfOrder
+	}
+	msg := string(clientFirst)
+	if !strings.HasPrefix(msg, gs2Header) {
+		// Channel binding and authorization identities are not supported
+		return nil, ErrMalformedMessage
+	}
+	s.clientFirstBare = msg[len(gs2Header):]
+	attrs, err := parseAttributes(s.clientFirstBare, "n", "r")
+	if err != nil {
+		return nil, err
+	}
+	if s.userName, err = unescapeName(attrs["n"]); err != nil {
+		return nil, err
+	}
+	if attrs["r"] == "" {
+		return nil, ErrMalformedMessage
+	}
+
+	var ok bool
+	if s.stored, ok = s.credentials(s.userName); !ok {
+		s.unknown = true
+		if s.stored, err = fakeCredentials(s.userName); err != nil {
+			return nil, err
+		}
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	s.nonce = attrs["r"] + nonce
+	s.serverFirst = "r=" + s.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(s.stored.Salt) +
+		",i=" + strconv.Itoa(s.stored.Iterations)
+	return []byte(s.serverFirst), nil
+}
+
+// ServerFinal takes the client-final-message and checks the proof of the
+// client. If it is valid, the server-final-message is returned.
+func (s *ServerConversation) ServerFinal(clientFinal []byte) ([]byte, error) {
+	if s.serverFirst == "" || s.done {
+		return nil, ErrOutOfOrder
+	}
+	s.done = true
+	msg := string(clientFinal)
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, ErrMalformedMessage
+	}
+	withoutProof := msg[:i]
+	attrs, err := parseAttributes(withoutProof, "c", "r")
+	if err != nil {
+		return nil, err
+	}
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(gs2Header)) || attrs["r"] != s.nonce {
+		return nil, ErrMalformedMessage
+	}
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, ErrMalformedMessage
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	clientKey := xor(proof, computeHMAC(s.stored.StoredKey, authMessage))
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], s.stored.StoredKey) != 1 || s.unknown {
+		if s.unknown {
+			return nil, ErrUnknownUser
+		}
+		return nil, ErrInvalidProof
+	}
+	signature := computeHMAC(s.stored.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+var (
+	fakeSecretOnce sync.Once
+	fakeSecret     []byte
+	fakeSecretErr  error
+)
+
+// fakeCredentials returns Credentials for a user name without credentials,
+// derived from it with a random secret of the process. No password matches
+// them.
+func fakeCredentials(userName string) (Credentials, error) {
+	fakeSecretOnce.Do(func() {
+		fakeSecret = make([]byte, sha256.Size)
+		_, fakeSecretErr = rand.Read(fakeSecret)
+	})
+	if fakeSecretErr != nil {
+		return Credentials{}, fakeSecretErr
+	}
+	return Credentials{
+		Salt:       computeHMAC(fakeSecret, "salt:"+userName)[:saltSize],
+		Iterations: DefaultIterations,
+		StoredKey:  computeHMAC(fakeSecret, "stored key:"+userName),
+		ServerKey:  computeHMAC(fakeSecret, "server key:"+userName),
+	}, nil
+}
+
+func saltedPassword(password string, salt []byte, iterations int) []byte {
+	return pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+}
+
+// keys returns the client and server key derived from the salted password.
+func keys(salted []byte) (clientKey, serverKey []byte) {
+	return computeHMAC(salted, "Client Key"), computeHMAC(salted, "Server Key")
+}
+
+func computeHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg)) // nolint: errcheck
+	return mac.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	x := make([]byte, len(a))
+	for i := range a {
+		x[i] = a[i] ^ b[i]
+	}
+	return x
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, nonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// parseAttributes parses a message of comma separated "name=value"
+// attributes. The attributes must start with names, in this order, further
+// attributes are ignored.
+func parseAttributes(msg string, names ...string) (map[string]string, error) {
+	fields := strings.Split(msg, ",")
+	if len(fields) < len(names) {
+		return nil, ErrMalformedMessage
+	}
+	attrs := make(map[string]string, len(names))
+	for i, name := range names {
+		if !strings.HasPrefix(fields[i], name+"=") {
+			return nil, ErrMalformedMessage
+		}
+		attrs[name] = fields[i][len(name)+1:]
+	}
+	return attrs, nil
+}
+
+var nameEscaper = strings.NewReplacer("=", "=3D", ",", "=2C")
+
+func escapeName(name string) string {
+	return nameEscaper.Replace(name)
+}
+
+// unescapeName decodes a user name, "=" may only appear as "=3D" or "=2C".
+func unescapeName(name string) (string, error) {
+	var b bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=3D"):
+			b.WriteByte('=')
+		case strings.HasPrefix(name[i:], "=2C"):
+			b.WriteByte(',')
+		default:
+			return "", ErrMalformedMessage
+		}
+		i += 2
+	}
+	if b.Len() == 0 {
+		return "", ErrMalformedMessage
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,112 @@
+package scram
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The example exchange of RFC 7677, section 3.
+func TestClientConversationRFC7677(t *testing.T) {
+	c := &ClientConversation{userName: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	assert.Equal(t, "n,,n=user,r=rOprNGfwEbeRWgbNEkqO", string(c.ClientFirst()))
+
+	clientFinal, err := c.ClientFinal([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	require.NoError(t, err)
+	assert.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", string(clientFinal))
+
+	assert.NoError(t, c.Verify([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")))
+	assert.Equal(t, ErrInvalidProof, c.Verify([]byte("v=AAAA")))
+	assert.Error(t, c.Verify([]byte("e=other-error")))
+}
+
+func exchange(t *testing.T, credentials map[string]Credentials, userName, password string) error {
+	client, err := NewClientConversation(userName, password)
+	require.NoError(t, err)
+	server := NewServerConversation(func(userName string) (Credentials, bool) {
+		c, ok := credentials[userName]
+		return c, ok
+	})
+
+	serverFirst, err := server.ServerFirst(client.ClientFirst())
+	if err != nil {
+		return err
+	}
+	clientFinal, err := client.ClientFinal(serverFirst)
+	require.NoError(t, err)
+	serverFinal, err := server.ServerFinal(clientFinal)
+	if err != nil {
+		return err
+	}
+	assert.Equal(t, userName, server.UserName())
+	return client.Verify(serverFinal)
+}
+
+func TestConversation(t *testing.T) {
+	pencil, err := NewCredentials("pencil", 0)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultIterations, pencil.Iterations)
+	credentials := map[string]Credentials{"user": pencil, "a=b,c": DeriveCredentials("x", []byte("salt"), 10)}
+
+	assert.NoError(t, exchange(t, credentials, "user", "pencil"))
+	assert.NoError(t, exchange(t, credentials, "a=b,c", "x"))
+	assert.Equal(t, ErrInvalidProof, exchange(t, credentials, "user", "eraser"))
+	assert.Equal(t, ErrUnknownUser, exchange(t, credentials, "other", "pencil"))
+}
+
+func TestServerConversationUnknownUser(t *testing.T) {
+	credentials := func(string) (Credentials, bool) { return Credentials{}, false }
+	serverFirst := func(userName string) map[string]string {
+		client, err := NewClientConversation(userName, "pencil")
+		require.NoError(t, err)
+		msg, err := NewServerConversation(credentials).ServerFirst(client.ClientFirst())
+		require.NoError(t, err)
+		attrs, err := parseAttributes(string(msg), "r", "s", "i")
+		require.NoError(t, err)
+		return attrs
+	}
+	first := serverFirst("other")
+	assert.Equal(t, "4096", first["i"])
+	salt, err := base64.StdEncoding.DecodeString(first["s"])
+	require.NoError(t, err)
+	assert.Len(t, salt, saltSize)
+	assert.Equal(t, first["s"], serverFirst("other")["s"], "same salt for every attempt")
+	assert.NotEqual(t, first["s"], serverFirst("another")["s"])
+
+	assert.Equal(t, ErrUnknownUser, exchange(t, nil, "other", "pencil"))
+}
+
+func TestServerConversationMalformed(t *testing.T) {
+	credentials := func(string) (Credentials, bool) { return DeriveCredentials("x", []byte("salt"), 10), true }
+	for _, clientFirst := range []string{"", "p=tls-unique,,n=user,r=abc", "n,,r=abc,n=user", "n,,n=,r=abc", "n,,n=a=3E,r=abc", "n,,n=user,r="} {
+		_, err := NewServerConversation(credentials).ServerFirst([]byte(clientFirst))
+		assert.Equal(t, ErrMalformedMessage, err, clientFirst)
+	}
+
+	s := NewServerConversation(credentials)
+	_, err := s.ServerFinal([]byte("c=biws,r=abc,p=AAAA"))
+	assert.Equal(t, ErrOutOfOrder, err)
+	_, err = s.ServerFirst([]byte("n,,n=user,r=abc"))
+	require.NoError(t, err)
+	_, err = s.ServerFinal([]byte("c=biws,r=abc,p=AAAA"))
+	assert.Equal(t, ErrMalformedMessage, err, "nonce of the server missing")
+}
+
+func TestCredentialsString(t *testing.T) {
+	salt, err := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	require.NoError(t, err)
+	c := DeriveCredentials("pencil", salt, 4096)
+	s := c.String()
+	assert.Regexp(t, `^SCRAM-SHA-256\$4096:W22ZaJ0SNY7soEsUEjb6gQ==\$[^:]+:[^:]+$`, s)
+
+	parsed, err := ParseCredentials(s)
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	for _, invalid := range []string{"", "SCRAM-SHA-1$4096:c2FsdA==$a:b", "SCRAM-SHA-256$x:c2FsdA==$a:b", "SCRAM-SHA-256$4096:c2FsdA==$a:b"} {
+		_, err = ParseCredentials(invalid)
+		assert.Error(t, err, invalid)
+	}
+}